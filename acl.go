@@ -0,0 +1,149 @@
+package merchdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	ops "github.com/jbooth/merchdb/ops"
+	"net/http"
+)
+
+type callerKey struct{}
+
+// WithACLs enforces the access control lists in the replicated _acls table,
+// managed through /admin/setACL.  The listed principals are admins of every
+// table regardless of the lists, so someone can grant the first permissions.
+// Principals come from the Authenticator set with WithAuth.
+func WithACLs(admins ...string) Option {
+	return func(c *config) {
+		c.acls = true
+		c.admins = make(map[string]bool, len(admins))
+		for _, a := range admins {
+			c.admins[a] = true
+		}
+	}
+}
+
+// returns the principal the request authenticated as, or the empty string if there's no authentication
+func caller(r *http.Request) string {
+	principal, _ := r.Context().Value(callerKey{}).(string)
+	return principal
+}
+
+func withCaller(r *http.Request, principal string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), callerKey{}, principal))
+}
+
+// returns the tables a request touches, or nil for a request that acts on the whole cluster
+type requestTables func(r *http.Request) []string
+
+// for routes with a {table} param
+func pathTable(r *http.Request) []string {
+	table := pathParam(r, "table")
+	if table == "" {
+		return nil
+	}
+	return []string{table}
+}
+
+func clusterWide(r *http.Request) []string {
+	return nil
+}
+
+// export is cluster-wide unless it's limited to some tables
+func exportTables(r *http.Request) []string {
+	return r.URL.Query()["table"]
+}
+
+// checks that the caller has need on every table the request touches, or on the
+// cluster if it doesn't name any
+func (s *Server) permitted(r *http.Request, need ops.Perm, tables []string) error {
+	return s.allowed(caller(r), need, tables)
+}
+
+// checks principal's permissions the same way as permitted
+func (s *Server) allowed(principal string, need ops.Perm, tables []string) error {
+	if s.admins[principal] {
+		return nil
+	}
+	if len(tables) == 0 {
+		tables = []string{""}
+	}
+	txn, err := s.flotilla.Read()
+	if err != nil {
+		return err
+	}
+	defer txn.Abort()
+	for _, table := range tables {
+		has, err := ops.Permission(txn, principal, table)
+		if err != nil {
+			return err
+		}
+		if has < need {
+			if table == "" {
+				return fmt.Errorf("%q needs %s permission on the cluster", principal, need)
+			}
+			return fmt.Errorf("%q needs %s permission on table %s", principal, need, table)
+		}
+	}
+	return nil
+}
+
+// wraps a handler so that it's only run for callers with need on the tables it touches
+func (s *Server) requires(need ops.Perm, tables requestTables, h http.HandlerFunc) http.HandlerFunc {
+	if !s.acls || need == ops.PERM_NONE {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := s.permitted(r, need, tables(r))
+		if err != nil {
+			s.reqLog(r).Info("Denied request", "caller", caller(r), "err", err)
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		h(w, r)
+	}
+}
+
+// url is formatted like /admin/setACL?principal=p&pattern=t1&perm=read
+// pattern is a table name or a prefix followed by *, and perm is one of none, read, write or admin
+func (s *Server) HandleSetACL(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	flotillaArgs := [][]byte{[]byte(q.Get("principal")), []byte(q.Get("pattern")), []byte(q.Get("perm"))}
+	result := s.command(r.Context(), ops.SETACL, flotillaArgs)
+	response := &WriteResponse{true, ""}
+	if result.Err != nil {
+		response.Ok = false
+		response.Err = result.Err.Error()
+	}
+	w.Header().Add("Content-Type", "application-json")
+	writeCommandStatus(w, result.Err)
+	enc := json.NewEncoder(w)
+	err := enc.Encode(response)
+	if err != nil {
+		s.reqLog(r).Error("Error encoding response", "err", err)
+	}
+}
+
+// url is /admin/acls, lists every grant
+func (s *Server) HandleACLs(w http.ResponseWriter, r *http.Request) {
+	txn, err := s.flotilla.Read()
+	if err != nil {
+		returnErr(w, err)
+		return
+	}
+	defer txn.Abort()
+	acls, err := ops.ACLs(txn)
+	response := &ACLResponse{true, "", acls}
+	if err != nil {
+		response.Ok = false
+		response.Err = err.Error()
+	}
+	w.Header().Add("Content-Type", "application-json")
+	enc := json.NewEncoder(w)
+	err = enc.Encode(response)
+	if err != nil {
+		s.reqLog(r).Error("Error encoding response", "err", err)
+	}
+}
@@ -0,0 +1,119 @@
+package merchdb
+
+import (
+	"context"
+	"errors"
+	"github.com/jbooth/flotilla"
+	ops "github.com/jbooth/merchdb/ops"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	// returned by command when MaxInflightCommands are already waiting on raft
+	ErrOverloaded = errors.New("Too many commands in flight, try again later")
+	// returned by command when the request's deadline passes first.  The command
+	// may still be applied.
+	ErrCommandTimeout = errors.New("Timed out waiting for command to be applied, it may still be applied")
+)
+
+// seconds clients are told to wait before retrying after a 503
+const overloadRetryAfter = 1
+
+// how long background work waits before resubmitting a command that was turned away
+const commandRetryInterval = 100 * time.Millisecond
+
+// takes an in-flight slot if there's one free
+func (s *Server) admit() bool {
+	if s.inflight == nil {
+		return true
+	}
+	select {
+	case s.inflight <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) release() {
+	if s.inflight != nil {
+		<-s.inflight
+	}
+}
+
+// submits a command through flotilla and waits for the result, failing fast with
+// ErrOverloaded if too many are in flight, or ErrCommandTimeout if ctx's deadline
+// or the command timeout passes first.  If ctx is a request's, its id is logged
+// with the command and with the op when it's applied here.
+func (s *Server) command(ctx context.Context, op string, args [][]byte) flotilla.Result {
+	lg := s.ctxLog(ctx)
+	if !s.admit() {
+		s.metrics.rejected.Inc(op, "overloaded")
+		lg.Info("Command turned away, too many in flight", "op", op)
+		return flotilla.Result{Err: ErrOverloaded}
+	}
+	if id := requestID(ctx); id != "" {
+		key := commandKey(op, args)
+		s.oplog.expect(key, id)
+		defer s.oplog.forget(key, id)
+	}
+	if s.commandTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.commandTimeout)
+		defer cancel()
+	}
+	span, forget := s.startCommandSpan(ctx, op, args)
+	start := time.Now()
+	results := s.flotilla.Command(op, args)
+	var result flotilla.Result
+	select {
+	case result = <-results:
+		s.metrics.commitLatency.Observe(time.Since(start).Seconds(), op)
+		s.release()
+	case <-ctx.Done():
+		s.metrics.rejected.Inc(op, "timeout")
+		lg.Warn("Timed out waiting for command", "op", op, "table", ops.OpTable(op, args), "latency", time.Since(start))
+		result = flotilla.Result{Err: ErrCommandTimeout}
+		// the slot stays taken until raft gets to it
+		go func() {
+			<-results
+			s.release()
+		}()
+	}
+	forget()
+	span.SetError(result.Err)
+	span.Finish()
+	return result
+}
+
+// sets a 503 status for commands that were turned away or timed out, or a 400 for
+// ones the op rejected as invalid.  Call after setting any other headers and before
+// writing the response body.
+func writeCommandStatus(w http.ResponseWriter, err error) {
+	if err == ErrOverloaded || err == ErrCommandTimeout {
+		w.Header().Set("Retry-After", strconv.Itoa(overloadRetryAfter))
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else if ops.IsInvalid(err) {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// like command, but resubmits commands that were turned away or timed out until
+// ctx is done or we're closed.  Only for commands that are safe to apply twice.
+func (s *Server) retryingCommand(ctx context.Context, op string, args [][]byte) flotilla.Result {
+	for {
+		result := s.command(ctx, op, args)
+		if result.Err != ErrOverloaded && result.Err != ErrCommandTimeout {
+			return result
+		}
+		select {
+		case <-ctx.Done():
+			return result
+		case <-s.closed:
+			return result
+		case <-time.After(commandRetryInterval):
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package merchdb
+
+import (
+	"context"
+	"github.com/jbooth/flotilla"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdmission(t *testing.T) {
+	db := newLocalDB(t, "/tmp/merchdbAdmissionTest")
+	db.stall = make(chan chan flotilla.Result, 10)
+	defer db.Close()
+	s := &Server{
+		flotilla:       db,
+		lg:             defaultLogger(),
+		metrics:        newServerMetrics(),
+		tracing:        newServerTracer(nil),
+		closed:         make(chan struct{}),
+		inflight:       make(chan struct{}, 1),
+		commandTimeout: time.Hour,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	result := s.command(ctx, "PutCols", nil)
+	if result.Err != ErrCommandTimeout {
+		t.Fatalf("Expected timeout, got %v", result.Err)
+	}
+	// the stalled command still holds the only slot
+	result = s.command(context.Background(), "PutCols", nil)
+	if result.Err != ErrOverloaded {
+		t.Fatalf("Expected overload, got %v", result.Err)
+	}
+	w := httptest.NewRecorder()
+	writeCommandStatus(w, result.Err)
+	if w.Code != 503 || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("Expected 503 with Retry-After, got %d", w.Code)
+	}
+
+	// once raft gets to it the slot frees up
+	(<-db.stall) <- flotilla.Result{}
+	go func() {
+		(<-db.stall) <- flotilla.Result{Response: []byte("ok")}
+	}()
+	deadline := time.Now().Add(time.Second)
+	for {
+		result = s.command(context.Background(), "PutCols", nil)
+		if result.Err != ErrOverloaded || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if result.Err != nil || string(result.Response) != "ok" {
+		t.Fatalf("Expected command to go through after the slot was released, got %v", result.Err)
+	}
+}
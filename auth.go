@@ -0,0 +1,195 @@
+package merchdb
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// headers for HMAC signed requests, see SignRequest
+const (
+	AuthKeyHeader       = "X-Merchdb-Key"
+	AuthTimestampHeader = "X-Merchdb-Timestamp"
+	AuthSignatureHeader = "X-Merchdb-Signature"
+)
+
+// signed request bodies are buffered to check them, so they're capped
+const maxSignedBody = 64 << 20
+
+// how far a signature's timestamp may be from our clock when HMACAuth.MaxSkew isn't set
+const defaultMaxSkew = 5 * time.Minute
+
+// probes need to get through without credentials
+var unauthenticatedPaths = map[string]bool{
+	"/health": true,
+	"/ready":  true,
+}
+
+// Authenticator checks the credentials on a request, returning the name of
+// the caller or an error saying why the credentials are missing or invalid.
+// It may replace r.Body, but must leave it readable from the start.
+type Authenticator interface {
+	Authenticate(r *http.Request) (string, error)
+}
+
+// WithAuth requires every request except health and readiness probes to pass a.
+func WithAuth(a Authenticator) Option {
+	return func(c *config) {
+		c.auth = a
+	}
+}
+
+// wraps the router so that requests without valid credentials get a 401
+func (s *Server) authenticated(h http.Handler) http.Handler {
+	if s.auth == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unauthenticatedPaths[r.URL.Path] {
+			h.ServeHTTP(w, r)
+			return
+		}
+		caller, err := s.auth.Authenticate(r)
+		if err != nil {
+			s.lg.Info("Rejected request", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr, "err", err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="merchdb"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		s.lg.Debug("Authenticated request", "path", r.URL.Path, "caller", caller)
+		h.ServeHTTP(w, withCaller(r, caller))
+	})
+}
+
+// TokenAuth accepts requests with an "Authorization: Bearer <token>" header
+// for any of its tokens, mapped to the name of the caller they belong to.
+type TokenAuth map[string]string
+
+func (t TokenAuth) Authenticate(r *http.Request) (string, error) {
+	authz := r.Header.Get("Authorization")
+	if authz == "" {
+		return "", fmt.Errorf("Missing Authorization header")
+	}
+	if !strings.HasPrefix(authz, "Bearer ") {
+		return "", fmt.Errorf("Authorization must be a bearer token")
+	}
+	presented := []byte(strings.TrimPrefix(authz, "Bearer "))
+	// check every token so timing doesn't reveal which ones came close
+	caller := ""
+	for token, name := range t {
+		if subtle.ConstantTimeCompare(presented, []byte(token)) == 1 {
+			caller = name
+		}
+	}
+	if caller == "" {
+		return "", fmt.Errorf("Invalid token")
+	}
+	return caller, nil
+}
+
+// HMACAuth accepts requests signed with SignRequest by any of its keys, which
+// are indexed by key id.  Signatures older or newer than MaxSkew are rejected,
+// which defaults to 5 minutes.
+type HMACAuth struct {
+	Keys    map[string][]byte
+	MaxSkew time.Duration
+}
+
+func (a *HMACAuth) Authenticate(r *http.Request) (string, error) {
+	keyID := r.Header.Get(AuthKeyHeader)
+	if keyID == "" {
+		return "", fmt.Errorf("Missing %s header", AuthKeyHeader)
+	}
+	key, ok := a.Keys[keyID]
+	if !ok {
+		return "", fmt.Errorf("Unknown key %s", keyID)
+	}
+	ts, err := strconv.ParseInt(r.Header.Get(AuthTimestampHeader), 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("Bad %s header : %s", AuthTimestampHeader, err)
+	}
+	maxSkew := a.MaxSkew
+	if maxSkew <= 0 {
+		maxSkew = defaultMaxSkew
+	}
+	skew := time.Since(time.Unix(ts, 0))
+	if skew > maxSkew || skew < -maxSkew {
+		return "", fmt.Errorf("Signature timestamp is %s off, max %s", skew, maxSkew)
+	}
+	sig, err := hex.DecodeString(r.Header.Get(AuthSignatureHeader))
+	if err != nil || len(sig) == 0 {
+		return "", fmt.Errorf("Missing or malformed %s header", AuthSignatureHeader)
+	}
+	body, err := readBody(r)
+	if err != nil {
+		return "", err
+	}
+	if !hmac.Equal(sig, signature(key, r, ts, body)) {
+		return "", fmt.Errorf("Invalid signature for key %s", keyID)
+	}
+	return keyID, nil
+}
+
+// AnyAuth accepts requests that pass any of its authenticators, so that for
+// instance tokens and signed requests can both be allowed.
+type AnyAuth []Authenticator
+
+func (auths AnyAuth) Authenticate(r *http.Request) (string, error) {
+	errs := make([]string, 0, len(auths))
+	for _, a := range auths {
+		caller, err := a.Authenticate(r)
+		if err == nil {
+			return caller, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return "", fmt.Errorf("%s", strings.Join(errs, ", "))
+}
+
+// SignRequest signs r with key for HMACAuth, covering the method, path, query,
+// current time and body.  The body is buffered and replaced.
+func SignRequest(r *http.Request, keyID string, key []byte) error {
+	body, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	ts := time.Now().Unix()
+	r.Header.Set(AuthKeyHeader, keyID)
+	r.Header.Set(AuthTimestampHeader, strconv.FormatInt(ts, 10))
+	r.Header.Set(AuthSignatureHeader, hex.EncodeToString(signature(key, r, ts, body)))
+	return nil
+}
+
+// HMAC-SHA256 over method, path with query, timestamp and body hash, one per line
+func signature(key []byte, r *http.Request, ts int64, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%s", r.Method, r.URL.RequestURI(), ts, hex.EncodeToString(bodyHash[:]))
+	return mac.Sum(nil)
+}
+
+// reads the whole body, leaving a copy in its place for whoever reads it next
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSignedBody+1))
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxSignedBody {
+		return nil, fmt.Errorf("Signed request body over %d bytes", maxSignedBody)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
@@ -0,0 +1,77 @@
+package merchdb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuth(t *testing.T) {
+	key := []byte("secret")
+	s := &Server{lg: defaultLogger()}
+	s.auth = AnyAuth{
+		TokenAuth{"tok1": "alice"},
+		&HMACAuth{Keys: map[string][]byte{"k1": key}, MaxSkew: time.Minute},
+	}
+	var body string
+	h := s.authenticated(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := make([]byte, 64)
+		n, _ := r.Body.Read(b)
+		body = string(b[:n])
+	}))
+	serve := func(r *http.Request) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	expect := func(name string, r *http.Request, code int) {
+		if got := serve(r); got != code {
+			t.Fatalf("%s : expected %d, got %d", name, code, got)
+		}
+	}
+
+	expect("no credentials", httptest.NewRequest("GET", "/getRow/t1/r1", nil), 401)
+	expect("probe", httptest.NewRequest("GET", "/health", nil), 200)
+
+	r := httptest.NewRequest("GET", "/getRow/t1/r1", nil)
+	r.Header.Set("Authorization", "Bearer tok1")
+	expect("good token", r, 200)
+	r = httptest.NewRequest("GET", "/getRow/t1/r1", nil)
+	r.Header.Set("Authorization", "Bearer tok2")
+	expect("bad token", r, 401)
+
+	r = httptest.NewRequest("POST", "/admin/import?x=1", strings.NewReader("dump"))
+	if err := SignRequest(r, "k1", key); err != nil {
+		t.Fatal(err)
+	}
+	expect("signed", r, 200)
+	if body != "dump" {
+		t.Fatalf("Body not restored after checking signature, got %q", body)
+	}
+
+	r = httptest.NewRequest("POST", "/admin/import?x=1", strings.NewReader("dump"))
+	SignRequest(r, "k1", key)
+	r.URL.RawQuery = "x=2"
+	expect("tampered query", r, 401)
+
+	r = httptest.NewRequest("POST", "/admin/import", strings.NewReader("dump"))
+	SignRequest(r, "k1", []byte("wrong"))
+	expect("wrong key", r, 401)
+
+	r = httptest.NewRequest("POST", "/admin/import", strings.NewReader("dump"))
+	SignRequest(r, "k1", key)
+	r.Header.Set(AuthTimestampHeader, "1")
+	expect("stale", r, 401)
+
+	// without a MaxSkew set signatures still expire, but not straight away
+	s.auth = &HMACAuth{Keys: map[string][]byte{"k1": key}}
+	r = httptest.NewRequest("POST", "/admin/import", strings.NewReader("dump"))
+	SignRequest(r, "k1", key)
+	expect("default skew", r, 200)
+	r = httptest.NewRequest("POST", "/admin/import", strings.NewReader("dump"))
+	SignRequest(r, "k1", key)
+	r.Header.Set(AuthTimestampHeader, "1")
+	expect("stale with default skew", r, 401)
+}
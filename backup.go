@@ -0,0 +1,247 @@
+package merchdb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	mdb "github.com/jbooth/gomdb"
+	ops "github.com/jbooth/merchdb/ops"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// name of the manifest file written alongside a backup's data files
+const BackupManifestFile = "manifest.json"
+
+// mdb keeps everything in one file, lock.mdb is recreated on open
+const backupDataFile = "data.mdb"
+
+// describes a backup taken by /admin/backup
+type BackupManifest struct {
+	Created      time.Time
+	FlotillaAddr string
+	DataDir      string
+	// the number of commands applied to the backed up data, see ops.AppliedCommands.
+	// It counts merchdb's commands, not raft log entries.
+	AppliedCommands uint64
+	// raft's applied index just before the copy was taken, so the copy has at least
+	// the entries up to it.  Zero if our flotilla doesn't report raft's stats, which
+	// flotilla.DefaultOpsDB doesn't.
+	RaftAppliedIndex uint64
+	// compacted backups copy entries rather than pages, leaving out free pages
+	Compacted bool
+	Tables    []string
+}
+
+// url is formatted like /admin/backup?dir=/path/to/backup&compact=false
+// copies this node's database from a consistent snapshot into a new environment in dir,
+// which must not already exist, and writes a manifest next to it.
+// compact defaults to true, see Backup.  Responds with the manifest.
+func (s *Server) HandleBackup(w http.ResponseWriter, r *http.Request) {
+	dir := r.URL.Query().Get("dir")
+	if dir == "" {
+		badRequest(w, fmt.Errorf("backup requires a dir param"))
+		return
+	}
+	compact := true
+	if compactParam := r.URL.Query().Get("compact"); compactParam != "" {
+		var err error
+		compact, err = strconv.ParseBool(compactParam)
+		if err != nil {
+			badRequest(w, fmt.Errorf("Invalid compact param %s : %s", compactParam, err))
+			return
+		}
+	}
+	if _, canCopyPages := s.flotilla.(envProvider); !compact && !canCopyPages {
+		badRequest(w, ErrNoPageCopy)
+		return
+	}
+	manifest, err := s.Backup(dir, compact)
+	if err != nil {
+		returnErr(w, err)
+		return
+	}
+	w.Header().Add("Content-Type", "application-json")
+	enc := json.NewEncoder(w)
+	err = enc.Encode(manifest)
+	if err != nil {
+		s.reqLog(r).Error("Error encoding response", "err", err)
+	}
+}
+
+// flotilla builds that expose their mdb environment allow page level copies
+type envProvider interface {
+	Env() *mdb.Env
+}
+
+var ErrNoPageCopy = errors.New("Uncompacted backups need a flotilla that exposes its mdb environment, use compact=true")
+
+// Backup copies this node's database into dir, see HandleBackup.
+// Compacted copies are made entry by entry from a read transaction and work with
+// any flotilla.  Uncompacted copies use mdb's own copy, which requires our flotilla
+// to expose its environment.
+func (s *Server) Backup(dir string, compact bool) (*BackupManifest, error) {
+	if _, err := os.Stat(dir); err == nil {
+		return nil, fmt.Errorf("Backup dir %s already exists", dir)
+	}
+	envSource, canCopyPages := s.flotilla.(envProvider)
+	if !compact && !canCopyPages {
+		return nil, ErrNoPageCopy
+	}
+	manifest := &BackupManifest{Created: time.Now(), FlotillaAddr: s.flotillaAddr, DataDir: s.dataDir, Compacted: compact}
+	manifest.RaftAppliedIndex, _ = s.raftStat("applied_index")
+	var err error
+	if compact {
+		var txn *mdb.Txn
+		txn, err = s.flotilla.Read()
+		if err != nil {
+			return nil, err
+		}
+		defer txn.Abort()
+		err = describeBackup(txn, manifest)
+		if err == nil {
+			err = ops.CopyEnv(txn, dir)
+		}
+	} else {
+		// mdb's copy runs its own read transaction, so describe the copy rather than the source
+		err = os.MkdirAll(dir, 0755)
+		if err == nil {
+			err = envSource.Env().Copy(dir)
+		}
+		if err == nil {
+			err = describeCopy(dir, manifest)
+		}
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("Error copying to %s : %s", dir, err)
+	}
+	manifestBytes, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, BackupManifestFile), manifestBytes, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.lg.Info("Backed up", "tables", manifest.Tables, "dir", dir, "appliedCommands", manifest.AppliedCommands)
+	return manifest, nil
+}
+
+// fills in the tables and applied commands in the snapshot txn sees
+func describeBackup(txn *mdb.Txn, manifest *BackupManifest) error {
+	var err error
+	manifest.Tables, err = ops.Tables(txn)
+	if err != nil {
+		return err
+	}
+	manifest.AppliedCommands, err = ops.AppliedCommands(txn)
+	return err
+}
+
+// fills in the manifest from a copied environment
+func describeCopy(dir string, manifest *BackupManifest) error {
+	return ReadBackup(dir, func(txn *mdb.Txn) error {
+		return describeBackup(txn, manifest)
+	})
+}
+
+// ReadBackup opens the mdb environment in a backup or restored data dir and
+// calls read with a read transaction on it.  Nothing else may have it open.
+func ReadBackup(dir string, read func(txn *mdb.Txn) error) error {
+	env, err := mdb.NewEnv()
+	if err != nil {
+		return err
+	}
+	defer env.Close()
+	err = env.SetMaxDBs(mdb.DBI(1024))
+	if err != nil {
+		return err
+	}
+	err = env.Open(dir, mdb.RDONLY, uint(0644))
+	if err != nil {
+		return err
+	}
+	txn, err := env.BeginTxn(nil, mdb.RDONLY)
+	if err != nil {
+		return err
+	}
+	defer txn.Abort()
+	return read(txn)
+}
+
+// Restore copies the backup in from into the mdb environment dir to, and checks the
+// copy holds the commands the backup's manifest says it does.  The manifest is
+// copied along with the data, so the restored dir records what it came from.
+//
+// Backups hold only merchdb's data, not flotilla's raft log, snapshots or stable
+// store, so a restored node can't rejoin the cluster the backup came from: raft
+// would either replay commands the data already has or leave it diverged.
+// Restore only seeds a new cluster, by restoring the same backup to every node
+// before any of them first starts, so to must be empty or not exist yet.
+func Restore(from string, to string) (*BackupManifest, error) {
+	manifestBytes, err := ioutil.ReadFile(filepath.Join(from, BackupManifestFile))
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read manifest, is %s a backup? : %s", from, err)
+	}
+	manifest := &BackupManifest{}
+	err = json.Unmarshal(manifestBytes, manifest)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := ioutil.ReadDir(to)
+	if err == nil && len(existing) > 0 {
+		return nil, fmt.Errorf("%s isn't empty, restore only seeds nodes of a new cluster", to)
+	}
+	target := filepath.Join(to, backupDataFile)
+	err = os.MkdirAll(to, 0755)
+	if err != nil {
+		return nil, err
+	}
+	err = copyFile(filepath.Join(from, backupDataFile), target)
+	if err == nil {
+		err = ReadBackup(to, func(txn *mdb.Txn) error {
+			applied, err := ops.AppliedCommands(txn)
+			if err == nil && applied != manifest.AppliedCommands {
+				err = fmt.Errorf("Backup in %s has %d applied commands but its manifest says %d, is it from a different backup?", from, applied, manifest.AppliedCommands)
+			}
+			return err
+		})
+	}
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(to, BackupManifestFile), manifestBytes, 0644)
+	}
+	if err != nil {
+		os.Remove(target)
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func copyFile(from string, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	err = out.Sync()
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
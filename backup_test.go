@@ -0,0 +1,159 @@
+package merchdb
+
+import (
+	"context"
+	"encoding/json"
+	mdb "github.com/jbooth/gomdb"
+	ops "github.com/jbooth/merchdb/ops"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// splits space separated args for a command
+func byteArgs(args string) [][]byte {
+	ret := make([][]byte, 0)
+	for _, arg := range strings.Fields(args) {
+		ret = append(ret, []byte(arg))
+	}
+	return ret
+}
+
+// a localDB reporting fixed raft stats
+type statsDB struct {
+	*localDB
+	stats map[string]string
+}
+
+func (db *statsDB) Stats() map[string]string {
+	return db.stats
+}
+
+func TestBackupRestore(t *testing.T) {
+	s := &Server{
+		flotilla:     newLocalDB(t, "/tmp/merchdbBackupTest"),
+		flotillaAddr: "127.0.0.1:1103",
+		dataDir:      "/tmp/merchdbBackupTest",
+		lg:           defaultLogger(),
+		metrics:      newServerMetrics(),
+		tracing:      newServerTracer(nil),
+		closed:       make(chan struct{}),
+	}
+	defer s.flotilla.Close()
+	for _, args := range []string{"row1 t1 a 1", "row2 t1 a 2", "row1 t2 b 3"} {
+		result := s.command(context.Background(), ops.PUTCOLS, byteArgs(args))
+		if result.Err != nil {
+			t.Fatal(result.Err)
+		}
+	}
+	// rejected, so not counted
+	result := s.command(context.Background(), ops.PUTCOLS, byteArgs("row1 t1 a"))
+	if result.Err == nil {
+		t.Fatal("Expected an error for an odd number of column args")
+	}
+
+	rt := newRouter()
+	rt.handle("/admin/backup", s.HandleBackup)
+	backup := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest("GET", "/admin/backup"+query, nil))
+		return w
+	}
+	dir := t.TempDir()
+	backupDir := filepath.Join(dir, "backup")
+	for _, query := range []string{"", "?compact=maybe&dir=" + backupDir, "?compact=false&dir=" + backupDir} {
+		if w := backup(query); w.Code != 400 {
+			t.Fatalf("Expected 400 for backup%s, got %d : %s", query, w.Code, w.Body.String())
+		}
+	}
+	w := backup("?dir=" + backupDir)
+	if w.Code != 200 {
+		t.Fatalf("Backup returned %d : %s", w.Code, w.Body.String())
+	}
+	manifest := &BackupManifest{}
+	err := json.NewDecoder(w.Body).Decode(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.AppliedCommands != 3 || manifest.RaftAppliedIndex != 0 || len(manifest.Tables) != 2 || !manifest.Compacted || manifest.FlotillaAddr != s.flotillaAddr {
+		t.Fatalf("Unexpected manifest %+v", manifest)
+	}
+	if w := backup("?dir=" + backupDir); w.Code != 500 {
+		t.Fatalf("Expected backing up over an existing backup to fail, got %d", w.Code)
+	}
+
+	restoreDir := filepath.Join(dir, "restored")
+	restored, err := Restore(backupDir, restoreDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.AppliedCommands != 3 {
+		t.Fatalf("Unexpected manifest from restore %+v", restored)
+	}
+	err = ReadBackup(restoreDir, func(txn *mdb.Txn) error {
+		encoded, err := ops.ReadRow(txn, "t1", []byte("row2"), nil)
+		if err != nil {
+			return err
+		}
+		cols, err := ops.DecodeCols(encoded)
+		if err != nil {
+			return err
+		}
+		if len(cols) != 2 || string(cols[1]) != "2" {
+			t.Fatalf("Unexpected restored row %q", cols)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(restoreDir, BackupManifestFile)); err != nil {
+		t.Fatalf("Expected restore to copy the manifest : %s", err)
+	}
+	_, err = Restore(backupDir, restoreDir)
+	if err == nil {
+		t.Fatal("Expected restoring over existing data to fail")
+	}
+	// anything already there may be raft state the backup doesn't match
+	usedDir := filepath.Join(dir, "used")
+	err = os.MkdirAll(filepath.Join(usedDir, "raft"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Restore(backupDir, usedDir)
+	if err == nil {
+		t.Fatal("Expected restoring into a dir that isn't empty to fail")
+	}
+
+	// raft's index is recorded when flotilla reports it
+	s.flotilla = &statsDB{s.flotilla.(*localDB), map[string]string{"applied_index": "42"}}
+	manifest, err = s.Backup(filepath.Join(dir, "withIndex"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.RaftAppliedIndex != 42 || manifest.AppliedCommands != 3 {
+		t.Fatalf("Unexpected manifest %+v", manifest)
+	}
+
+	// a manifest that doesn't match the data it's with
+	manifest.AppliedCommands = 4
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(backupDir, BackupManifestFile), manifestBytes, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mismatchDir := filepath.Join(dir, "mismatch")
+	_, err = Restore(backupDir, mismatchDir)
+	if err == nil {
+		t.Fatal("Expected restoring with a mismatched manifest to fail")
+	}
+	if _, err := os.Stat(filepath.Join(mismatchDir, backupDataFile)); err == nil {
+		t.Fatal("Expected a failed restore to remove the data it copied")
+	}
+}
@@ -0,0 +1,106 @@
+package merchdb
+
+import (
+	"context"
+	"github.com/jbooth/flotilla"
+	ops "github.com/jbooth/merchdb/ops"
+	"time"
+)
+
+// a putCols waiting to go out in the next batch
+type pendingWrite struct {
+	args   [][]byte
+	result chan flotilla.Result
+}
+
+// coalesces concurrent putCols into BatchPutCols commands, so they share a raft
+// entry and an mdb commit
+type writeBatcher struct {
+	s       *Server
+	window  time.Duration
+	maxSize int
+	writes  chan *pendingWrite
+}
+
+func newWriteBatcher(s *Server, window time.Duration, maxSize int) *writeBatcher {
+	if maxSize < 1 {
+		maxSize = 1
+	}
+	return &writeBatcher{s, window, maxSize, make(chan *pendingWrite)}
+}
+
+// submits putCols args, through the batcher if there is one
+func (s *Server) putCols(ctx context.Context, args [][]byte) flotilla.Result {
+	if s.batcher == nil {
+		return s.command(ctx, ops.PUTCOLS, args)
+	}
+	return s.batcher.submit(ctx, args)
+}
+
+func (b *writeBatcher) submit(ctx context.Context, args [][]byte) flotilla.Result {
+	w := &pendingWrite{args, make(chan flotilla.Result, 1)}
+	select {
+	case b.writes <- w:
+	case <-b.s.closed:
+		// let writes still in flight at shutdown through on their own
+		return b.s.command(ctx, ops.PUTCOLS, args)
+	case <-ctx.Done():
+		return flotilla.Result{Err: ErrCommandTimeout}
+	}
+	select {
+	case result := <-w.result:
+		return result
+	case <-ctx.Done():
+		return flotilla.Result{Err: ErrCommandTimeout}
+	}
+}
+
+// collects writes arriving within window of the first one, up to maxSize, and
+// sends them off while collecting the next batch
+func (b *writeBatcher) run() {
+	for {
+		var first *pendingWrite
+		select {
+		case first = <-b.writes:
+		case <-b.s.closed:
+			return
+		}
+		batch := []*pendingWrite{first}
+		timer := time.NewTimer(b.window)
+	collect:
+		for len(batch) < b.maxSize {
+			select {
+			case w := <-b.writes:
+				batch = append(batch, w)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+		go b.flush(batch)
+	}
+}
+
+func (b *writeBatcher) flush(batch []*pendingWrite) {
+	if len(batch) == 1 {
+		batch[0].result <- b.s.command(context.Background(), ops.PUTCOLS, batch[0].args)
+		return
+	}
+	writes := make([][][]byte, len(batch))
+	for i, w := range batch {
+		writes[i] = w.args
+	}
+	b.s.metrics.batchSize.Observe(float64(len(batch)))
+	result := b.s.command(context.Background(), ops.BATCHPUTCOLS, ops.BatchArgs(writes))
+	errs := make([]error, len(batch))
+	if result.Err == nil {
+		errs, result.Err = ops.BatchResults(result.Response, len(batch))
+	}
+	for i, w := range batch {
+		if result.Err != nil {
+			w.result <- flotilla.Result{Err: result.Err}
+		} else {
+			w.result <- flotilla.Result{Err: errs[i]}
+		}
+	}
+}
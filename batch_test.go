@@ -0,0 +1,50 @@
+package merchdb
+
+import (
+	"context"
+	"fmt"
+	ops "github.com/jbooth/merchdb/ops"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWriteBatcher(t *testing.T) {
+	db := newLocalDB(t, "/tmp/merchdbWriteBatcherTest")
+	defer db.Close()
+	s := &Server{
+		flotilla: db,
+		lg:       defaultLogger(),
+		metrics:  newServerMetrics(),
+		tracing:  newServerTracer(nil),
+		closed:   make(chan struct{}),
+	}
+	defer close(s.closed)
+	s.batcher = newWriteBatcher(s, 50*time.Millisecond, 8)
+	go s.batcher.run()
+
+	results := make([]error, 8)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			table := "good"
+			if i == 3 {
+				// reserved, so the write fails
+				table = "_bad"
+			}
+			args := [][]byte{[]byte(fmt.Sprintf("row%d", i)), []byte(table), []byte("c"), []byte("v")}
+			results[i] = s.putCols(context.Background(), args).Err
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range results {
+		if (err != nil) != (i == 3) {
+			t.Fatalf("Unexpected result for write %d : %v", i, err)
+		}
+	}
+	if sent := db.commands(); len(sent) != 1 || sent[0] != ops.BATCHPUTCOLS {
+		t.Fatalf("Expected all 8 writes in one batch, got commands %v", sent)
+	}
+}
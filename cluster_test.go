@@ -0,0 +1,348 @@
+package merchdb_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jbooth/merchdb"
+	"github.com/jbooth/merchdb/clustertest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// how long to wait for elections, catching up and the like
+const clusterTimeout = 30 * time.Second
+
+func startCluster(t *testing.T, opts clustertest.Options) *clustertest.Cluster {
+	if testing.Short() {
+		t.Skip("Skipping cluster test in short mode")
+	}
+	c, err := clustertest.Start(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	ctx, cancel := context.WithTimeout(context.Background(), clusterTimeout)
+	defer cancel()
+	err = c.WaitReady(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func waitLeader(t *testing.T, c *clustertest.Cluster) *clustertest.Node {
+	ctx, cancel := context.WithTimeout(context.Background(), clusterTimeout)
+	defer cancel()
+	leader, err := c.WaitLeader(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leader
+}
+
+// sends a request to node i and decodes its json response, failing unless it's a 200
+func doJSON(t *testing.T, c *clustertest.Cluster, i int, method string, path string, body []byte, response interface{}) {
+	t.Helper()
+	status, respBody, err := c.Do(i, method, path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != 200 {
+		t.Fatalf("%s %s on node %d : status %d : %s", method, path, i, status, respBody)
+	}
+	err = json.Unmarshal(respBody, response)
+	if err != nil {
+		t.Fatalf("%s %s on node %d : bad response %q : %s", method, path, i, respBody, err)
+	}
+}
+
+func getJSON(t *testing.T, c *clustertest.Cluster, i int, path string, response interface{}) {
+	t.Helper()
+	doJSON(t, c, i, "GET", path, nil, response)
+}
+
+func write(t *testing.T, c *clustertest.Cluster, i int, path string) {
+	t.Helper()
+	response := &merchdb.WriteResponse{}
+	getJSON(t, c, i, path, response)
+	if !response.Ok {
+		t.Fatalf("%s on node %d failed", path, i)
+	}
+}
+
+// polls until check passes on node i's local reads, for checking a node has caught up
+func eventually(t *testing.T, what string, check func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(clusterTimeout)
+	for !check() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// waits for node i to have applied col=val in the row
+func waitCol(t *testing.T, c *clustertest.Cluster, i int, table string, row string, col string, val string) {
+	t.Helper()
+	eventually(t, fmt.Sprintf("%s/%s %s=%s on node %d", table, row, col, val, i), func() bool {
+		status, body, err := c.Get(i, "/getRowFast/"+table+"/"+row)
+		if err != nil || status != 200 {
+			return false
+		}
+		response := &merchdb.ReadResponse{}
+		return json.Unmarshal(body, response) == nil && fmt.Sprint(response.Cols[col]) == val
+	})
+}
+
+func TestMerchDB(t *testing.T) {
+	c := startCluster(t, clustertest.Options{})
+
+	// test some column PUTs and a get
+	write(t, c, 0, "/putCols/table1/row1?col1=val1&col2=val2")
+	write(t, c, 1, "/putCols/table1/row1?col3=val3&col4=val4")
+
+	row := &merchdb.ReadResponse{}
+	getJSON(t, c, 2, "/getRow/table1/row1", row)
+	if !row.Ok || len(row.Cols) != 4 || row.Cols["col1"] != "val1" || row.Cols["col4"] != "val4" {
+		t.Fatalf("Unexpected row %+v", row)
+	}
+
+	// test get of bad key
+	row = &merchdb.ReadResponse{}
+	getJSON(t, c, 2, "/getRow/table1/badrow", row)
+	if !row.Ok || len(row.Cols) != 0 {
+		t.Fatalf("Expected no columns for a missing row, got %+v", row)
+	}
+}
+
+// exercises every endpoint, writing through node 0 and reading from the others
+func TestClusterEndpoints(t *testing.T) {
+	c := startCluster(t, clustertest.Options{
+		Forward: merchdb.FORWARD_PROXY,
+		ServerOptions: func(node int) []merchdb.Option {
+			return []merchdb.Option{merchdb.WithRateLimits(merchdb.RateLimitConfig{})}
+		},
+	})
+
+	// schemas, families and indexes
+	response := &merchdb.WriteResponse{}
+	doJSON(t, c, 0, "PUT", "/setSchema/t1", []byte(`{"Columns":{"n":{"Type":"int64"}}}`), response)
+	if !response.Ok {
+		t.Fatal("setSchema failed")
+	}
+	schema := &merchdb.SchemaResponse{}
+	getJSON(t, c, 1, "/getSchema/t1", schema)
+	if !schema.Ok || schema.Schema == nil || schema.Schema.Columns["n"].Type != "int64" {
+		t.Fatalf("Unexpected schema %+v", schema)
+	}
+	write(t, c, 0, "/setFamily/t1/f?versions=2")
+	write(t, c, 0, "/createIndex/t1/byColor?column=color")
+
+	// writes and replicated reads
+	write(t, c, 0, "/putCols/t1/r1?color=red&n=5")
+	write(t, c, 0, "/putRow/t1/r2?color=blue&n=7")
+	row := &merchdb.ReadResponse{}
+	getJSON(t, c, 1, "/getRow/t1/r1", row)
+	if !row.Ok || row.Cols["color"] != "red" || fmt.Sprint(row.Cols["n"]) != "5" {
+		t.Fatalf("Unexpected row %+v", row)
+	}
+	row = &merchdb.ReadResponse{}
+	getJSON(t, c, 2, "/getCols/t1/r1?n", row)
+	if !row.Ok || len(row.Cols) != 1 || fmt.Sprint(row.Cols["n"]) != "5" {
+		t.Fatalf("Unexpected cols %+v", row)
+	}
+
+	// local reads, once each node has caught up
+	for i := range c.Nodes {
+		waitCol(t, c, i, "t1", "r2", "color", "blue")
+		row = &merchdb.ReadResponse{}
+		getJSON(t, c, i, "/getColsFast/t1/r2?color", row)
+		if !row.Ok || len(row.Cols) != 1 || row.Cols["color"] != "blue" {
+			t.Fatalf("Unexpected cols on node %d : %+v", i, row)
+		}
+		lookup := &merchdb.LookupResponse{}
+		getJSON(t, c, i, "/lookup/t1/byColor/red", lookup)
+		if !lookup.Ok || len(lookup.Keys) != 1 || lookup.Keys[0] != "r1" {
+			t.Fatalf("Unexpected lookup on node %d : %+v", i, lookup)
+		}
+	}
+	write(t, c, 0, "/backfillIndex/t1/byColor")
+
+	// versions kept by a family
+	write(t, c, 0, "/putCols/t1/r1?f:x=1")
+	write(t, c, 0, "/putCols/t1/r1?f:x=2")
+	write(t, c, 0, "/putCols/t1/r1?f:x=3")
+	waitCol(t, c, 1, "t1", "r1", "f:x", "3")
+	versions := &merchdb.VersionsResponse{}
+	getJSON(t, c, 1, "/getVersions/t1/r1/f:x", versions)
+	if !versions.Ok || len(versions.Versions) != 2 || versions.Versions[0].Value != "3" || versions.Versions[1].Value != "2" || versions.Versions[0].Timestamp < versions.Versions[1].Timestamp {
+		t.Fatalf("Unexpected versions %+v", versions)
+	}
+	write(t, c, 0, "/delRow/t1/r2")
+	row = &merchdb.ReadResponse{}
+	getJSON(t, c, 1, "/getRow/t1/r2", row)
+	if !row.Ok || len(row.Cols) != 0 {
+		t.Fatalf("Expected deleted row to be empty, got %+v", row)
+	}
+
+	// the wire protocol, writing through one node and reading through another
+	writer, err := merchdb.DialWire(c.Nodes[0].WireAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	reader, err := merchdb.DialWire(c.Nodes[1].WireAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	err = writer.PutCols("t1", []byte("r3"), [][]byte{[]byte("color"), []byte("green")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := reader.GetCols("t1", []byte("r3"), [][]byte{[]byte("color")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cols) != 2 || string(cols[1]) != "green" {
+		t.Fatalf("Unexpected wire cols %q", cols)
+	}
+
+	// export, and import the dump into a new cluster
+	status, dump, err := c.Get(1, "/admin/export?table=t1")
+	if err != nil || status != 200 {
+		t.Fatalf("Export failed : %d %s %v", status, dump, err)
+	}
+	restored := startCluster(t, clustertest.Options{Nodes: 1})
+	status, body, err := restored.Do(0, "POST", "/admin/import", dump)
+	if err != nil || status != 200 {
+		t.Fatalf("Import failed : %d %s %v", status, body, err)
+	}
+	lines := bytes.Split(bytes.TrimSpace(body), []byte("\n"))
+	progress := &merchdb.ImportProgress{}
+	err = json.Unmarshal(lines[len(lines)-1], progress)
+	if err != nil || !progress.Ok || !progress.Done || progress.Tables == 0 {
+		t.Fatalf("Unexpected import result %s", body)
+	}
+	waitCol(t, restored, 0, "t1", "r3", "color", "green")
+	// rerunning it finds the table's definitions already there and loads the same columns
+	status, body, err = restored.Do(0, "POST", "/admin/import", dump)
+	lines = bytes.Split(bytes.TrimSpace(body), []byte("\n"))
+	if err != nil || status != 200 || json.Unmarshal(lines[len(lines)-1], progress) != nil || !progress.Ok {
+		t.Fatalf("Importing again failed : %d %s %v", status, body, err)
+	}
+	manifest := &merchdb.BackupManifest{}
+	getJSON(t, c, 2, "/admin/backup?dir="+filepath.Join(t.TempDir(), "backup"), manifest)
+	if manifest.AppliedCommands == 0 || len(manifest.Tables) == 0 {
+		t.Fatalf("Unexpected backup manifest %+v", manifest)
+	}
+
+	// admin
+	peers := &merchdb.PeersResponse{}
+	getJSON(t, c, 1, "/admin/peers", peers)
+	if !peers.Ok || len(peers.Peers) != len(c.Nodes) {
+		t.Fatalf("Unexpected peers %+v", peers)
+	}
+	write(t, c, 0, "/admin/setACL?principal=bob&pattern=t1&perm=read")
+	for i := range c.Nodes {
+		eventually(t, fmt.Sprintf("ACL on node %d", i), func() bool {
+			acls := &merchdb.ACLResponse{}
+			getJSON(t, c, i, "/admin/acls", acls)
+			return len(acls.ACLs) == 1 && acls.ACLs[0].Principal == "bob"
+		})
+	}
+	limits := &merchdb.RateLimitConfig{}
+	doJSON(t, c, 2, "PUT", "/admin/rateLimits", []byte(`{"DefaultClient":{"Read":{"Rate":1000,"Burst":1000}}}`), limits)
+	getJSON(t, c, 2, "/admin/rateLimits", limits)
+	if limits.DefaultClient.Read.Rate != 1000 {
+		t.Fatalf("Unexpected rate limits %+v", limits)
+	}
+
+	// status and monitoring
+	for i := range c.Nodes {
+		for _, path := range []string{"/health", "/ready", "/status", "/metrics"} {
+			status, body, err := c.Get(i, path)
+			if err != nil || status != 200 {
+				t.Fatalf("%s on node %d : %d %s %v", path, i, status, body, err)
+			}
+		}
+	}
+	_, metrics, _ := c.Get(0, "/metrics")
+	if !strings.Contains(string(metrics), "merchdb_") {
+		t.Fatalf("Expected merchdb metrics, got %s", metrics)
+	}
+
+	// bad requests
+	if status, _, _ := c.Get(0, "/putCols/t1"); status != 404 {
+		t.Fatalf("Expected a 404 for a missing row, got %d", status)
+	}
+	if status, _, _ := c.Get(0, "/putCols/t1/r1?a=1&a=2"); status != 400 {
+		t.Fatalf("Expected a 400 for a repeated column, got %d", status)
+	}
+	if status, _, _ := c.Get(0, "/nope"); status != 404 {
+		t.Fatalf("Expected a 404 for an unknown endpoint, got %d", status)
+	}
+}
+
+// kills the leader, writes through its replacement and checks the old leader catches up when it's back
+func TestClusterFailover(t *testing.T) {
+	c := startCluster(t, clustertest.Options{Forward: merchdb.FORWARD_REDIRECT})
+	leader := waitLeader(t, c)
+	write(t, c, leader.Index, "/putCols/t/before?v=1")
+
+	err := c.Kill(leader.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newLeader := waitLeader(t, c)
+	if newLeader == leader {
+		t.Fatal("Killed node is still leader")
+	}
+	write(t, c, newLeader.Index, "/putCols/t/after?v=2")
+
+	err = c.Restart(leader.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitCol(t, c, leader.Index, "t", "before", "v", "1")
+	waitCol(t, c, leader.Index, "t", "after", "v", "2")
+}
+
+// cuts the leader off from the others, writes through the majority and checks the old
+// leader catches up once the partition heals
+func TestClusterPartition(t *testing.T) {
+	c := startCluster(t, clustertest.Options{
+		Forward: merchdb.FORWARD_PROXY,
+		Config: func(node int, sc *merchdb.ServerConfig) {
+			sc.CommandTimeout = 2 * time.Second
+		},
+	})
+	leader := waitLeader(t, c)
+	write(t, c, leader.Index, "/putCols/t/before?v=1")
+
+	c.Isolate(leader.Index)
+	newLeader := waitLeader(t, c)
+	if newLeader == leader {
+		t.Fatal("Isolated node is still leader")
+	}
+	write(t, c, newLeader.Index, "/putCols/t/during?v=2")
+	// the minority can't commit anything, or forward it across the partition
+	status, body, err := c.Get(leader.Index, "/putCols/t/lost?v=3")
+	if err == nil && status == 200 {
+		response := &merchdb.WriteResponse{}
+		if json.Unmarshal(body, response) == nil && response.Ok {
+			t.Fatal("Write to the isolated node succeeded")
+		}
+	}
+
+	c.Heal()
+	waitCol(t, c, leader.Index, "t", "during", "v", "2")
+	for _, node := range c.Followers() {
+		waitCol(t, c, node.Index, "t", "before", "v", "1")
+	}
+}
@@ -0,0 +1,457 @@
+// Package clustertest runs merchdb clusters inside a single process for
+// integration tests, on random local ports with data in a temp dir.  Nodes can
+// be killed and restarted, and the flotilla traffic between any two nodes cut
+// to simulate partitions.
+//
+// Each node lists the other nodes in its peers by the address of a Link
+// proxying to them, rather than by their real flotilla address.  That covers
+// raft's replication and elections, which dial the peer list.  Each node also
+// registers a proxy as its web address, so writes followers forward to the
+// leader with Options.Forward are cut off by partitions as well.  Commands
+// flotilla forwards itself, without Options.Forward, still go straight to the
+// leader's own flotilla address, which it learns at runtime.
+package clustertest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jbooth/merchdb"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// how often waits poll the nodes
+const pollInterval = 50 * time.Millisecond
+
+// how long a restarting node keeps trying for its old ports, which the OS may
+// not have released yet
+const restartTimeout = 10 * time.Second
+
+// how long the leader lease lasts on nodes that forward writes, short so tests
+// don't wait long for it to move
+const leaderLease = 1 * time.Second
+
+// returned by WaitLeader when the nodes' flotilla doesn't say who leads and they
+// don't forward writes, so don't hold the leader lease
+var ErrLeadershipUnknown = errors.New("Flotilla doesn't report leadership, use WaitReady or Options.Forward")
+
+// doesn't follow redirects, so a node's 307 to the leader comes back as it is
+var client = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+type Options struct {
+	// defaults to 3
+	Nodes int
+	// parent for the nodes' data dirs, a new temp dir if empty.  Removed on
+	// Close only if it was created here.
+	Dir string
+	// how nodes handle writes when they aren't the leader, see merchdb.WithForwarding.
+	// Forwarding nodes also hold the leader lease, which WaitLeader needs when
+	// flotilla doesn't report raft's leader.  Set it for partition tests, so
+	// forwarded writes can't cross a partition.
+	Forward merchdb.ForwardMode
+	// changes the ServerConfig each node is started with, after its addresses are filled in
+	Config func(node int, sc *merchdb.ServerConfig)
+	// options for each node's server
+	ServerOptions func(node int) []merchdb.Option
+}
+
+// Node is one member of a Cluster.  Its addresses and data dir stay the same
+// across restarts.
+type Node struct {
+	Index   int
+	DataDir string
+	WebAddr string
+	// the proxy for WebAddr this node registers, which other nodes forward writes to
+	AdvertiseAddr string
+	WireAddr      string
+	FlotillaAddr  string
+	// the flotilla addresses this node dials, its own and then the Links to the others
+	Peers []string
+
+	lock     *sync.Mutex
+	server   *merchdb.Server
+	webProxy *webProxy
+}
+
+// the running server, nil while the node is down
+func (n *Node) Server() *merchdb.Server {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.server
+}
+
+// returns an http url for path on this node
+func (n *Node) URL(path string) string {
+	return "http://" + n.WebAddr + path
+}
+
+type Cluster struct {
+	Nodes []*Node
+	// Links[from][to] carries from's flotilla traffic to to, nil where from == to
+	Links   [][]*Link
+	opts    Options
+	tempDir bool
+}
+
+// reserves a local port, which stays reserved until the listener is closed
+func reserveAddr() (net.Listener, error) {
+	return net.Listen("tcp", "127.0.0.1:0")
+}
+
+// Start starts a cluster and returns once every node is up, which doesn't mean
+// they've elected a leader, see WaitLeader and WaitReady.
+func Start(opts Options) (*Cluster, error) {
+	if opts.Nodes == 0 {
+		opts.Nodes = 3
+	}
+	c := &Cluster{opts: opts}
+	if opts.Dir == "" {
+		dir, err := os.MkdirTemp("", "merchdb-cluster")
+		if err != nil {
+			return nil, err
+		}
+		c.opts.Dir = dir
+		c.tempDir = true
+	}
+	err := c.layout()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	// start them together, a node can't finish starting without a quorum
+	errs := make(chan error, len(c.Nodes))
+	for i := range c.Nodes {
+		go func(i int) {
+			errs <- c.Restart(i)
+		}(i)
+	}
+	for range c.Nodes {
+		if startErr := <-errs; startErr != nil && err == nil {
+			err = startErr
+		}
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// picks addresses and dirs for every node and sets up the links between them
+func (c *Cluster) layout() error {
+	n := c.opts.Nodes
+	// held until the links are listening, so they can't be handed one of the nodes' ports
+	reserved := make([]net.Listener, 0, 3*n)
+	defer func() {
+		for _, l := range reserved {
+			l.Close()
+		}
+	}()
+	c.Nodes = make([]*Node, n)
+	for i := range c.Nodes {
+		node := &Node{Index: i, lock: &sync.Mutex{}}
+		node.DataDir = filepath.Join(c.opts.Dir, fmt.Sprintf("node%d", i))
+		err := os.MkdirAll(node.DataDir, 0755)
+		if err != nil {
+			return err
+		}
+		for _, addr := range []*string{&node.WebAddr, &node.WireAddr, &node.FlotillaAddr} {
+			l, err := reserveAddr()
+			if err != nil {
+				return err
+			}
+			reserved = append(reserved, l)
+			*addr = l.Addr().String()
+		}
+		c.Nodes[i] = node
+	}
+	c.Links = make([][]*Link, n)
+	for from := range c.Nodes {
+		c.Links[from] = make([]*Link, n)
+		peers := []string{c.Nodes[from].FlotillaAddr}
+		for to := range c.Nodes {
+			if from == to {
+				continue
+			}
+			link, err := newLink(from, to, c.Nodes[to].FlotillaAddr)
+			if err != nil {
+				return err
+			}
+			c.Links[from][to] = link
+			peers = append(peers, link.Addr())
+		}
+		c.Nodes[from].Peers = peers
+	}
+	for _, node := range c.Nodes {
+		p, err := newWebProxy(c, node.Index)
+		if err != nil {
+			return err
+		}
+		node.webProxy = p
+		node.AdvertiseAddr = p.Addr()
+	}
+	return nil
+}
+
+// returns the index of the node with flotillaAddr, -1 if there's none
+func (c *Cluster) nodeAt(flotillaAddr string) int {
+	for _, node := range c.Nodes {
+		if node.FlotillaAddr == flotillaAddr {
+			return node.Index
+		}
+	}
+	return -1
+}
+
+// Restart starts node i if it's down
+func (c *Cluster) Restart(i int) error {
+	node := c.Nodes[i]
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	if node.server != nil {
+		return nil
+	}
+	sc := merchdb.DefaultServerConfig()
+	sc.WebAddr = node.WebAddr
+	sc.AdvertiseAddr = node.AdvertiseAddr
+	sc.WireAddr = node.WireAddr
+	sc.FlotillaAddr = node.FlotillaAddr
+	sc.DataDir = node.DataDir
+	sc.Peers = node.Peers
+	if c.opts.Forward != merchdb.FORWARD_NONE {
+		sc.LeaderLease = leaderLease
+	}
+	if c.opts.Config != nil {
+		c.opts.Config(i, &sc)
+	}
+	opts := []merchdb.Option{merchdb.WithForwarding(c.opts.Forward)}
+	if c.opts.ServerOptions != nil {
+		opts = append(opts, c.opts.ServerOptions(i)...)
+	}
+	deadline := time.Now().Add(restartTimeout)
+	for {
+		s, err := merchdb.NewServerWithConfig(sc, opts...)
+		if err == nil {
+			node.server = s
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Couldn't start node %d : %s", i, err)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// Kill closes node i's server, cutting off any requests in flight.  Its data stays for Restart.
+func (c *Cluster) Kill(i int) error {
+	node := c.Nodes[i]
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	if node.server == nil {
+		return nil
+	}
+	err := node.server.Close()
+	node.server = nil
+	return err
+}
+
+// Partition cuts every link between nodes in different groups, and heals the
+// links within groups.  Nodes left out of every group are cut off from all the others.
+func (c *Cluster) Partition(groups ...[]int) {
+	group := make(map[int]int)
+	for g, members := range groups {
+		for _, i := range members {
+			group[i] = g + 1
+		}
+	}
+	for from, links := range c.Links {
+		for to, link := range links {
+			if link == nil {
+				continue
+			}
+			if group[from] != 0 && group[from] == group[to] {
+				link.Heal()
+			} else {
+				link.Cut()
+			}
+		}
+	}
+	for _, node := range c.Nodes {
+		node.webProxy.partitioned()
+	}
+}
+
+// Isolate cuts node i off from the rest of the cluster, leaving the others connected
+func (c *Cluster) Isolate(i int) {
+	rest := make([]int, 0, len(c.Nodes)-1)
+	for j := range c.Nodes {
+		if j != i {
+			rest = append(rest, j)
+		}
+	}
+	c.Partition([]int{i}, rest)
+}
+
+// Heal restores every link
+func (c *Cluster) Heal() {
+	for _, links := range c.Links {
+		for _, link := range links {
+			if link != nil {
+				link.Heal()
+			}
+		}
+	}
+}
+
+// whether node i can reach node j, ignoring whether either is running
+func (c *Cluster) connected(i int, j int) bool {
+	return i == j || !c.Links[i][j].IsCut() && !c.Links[j][i].IsCut()
+}
+
+// Leader returns the running node that believes it's leader, or holds the leader
+// lease when flotilla doesn't report raft's leader, and is connected to a
+// majority, or nil if there's none.  A deposed leader on the minority side
+// of a partition can go on believing it leads for a while, so its claim is
+// ignored.
+func (c *Cluster) Leader() *Node {
+	for _, node := range c.Nodes {
+		s := node.Server()
+		if s == nil {
+			continue
+		}
+		status := s.Status()
+		if status.Role != "leader" && (status.Role != "unknown" || status.LeaseHolder != node.FlotillaAddr) {
+			continue
+		}
+		reachable := 0
+		for _, other := range c.Nodes {
+			if other.Server() != nil && c.connected(node.Index, other.Index) {
+				reachable++
+			}
+		}
+		if reachable > len(c.Nodes)/2 {
+			return node
+		}
+	}
+	return nil
+}
+
+// WaitLeader waits for Leader to return a node.  With flotilla.DefaultOpsDB the leader
+// is the holder of the leader lease, so after losing one this takes up to
+// ServerConfig.LeaderLease for the lease to run out, and the nodes have to
+// forward writes to hold one at all.
+func (c *Cluster) WaitLeader(ctx context.Context) (*Node, error) {
+	for {
+		if leader := c.Leader(); leader != nil {
+			return leader, nil
+		}
+		for _, node := range c.Nodes {
+			if s := node.Server(); s != nil && s.Status().Role == "unknown" && c.opts.Forward == merchdb.FORWARD_NONE {
+				return nil, ErrLeadershipUnknown
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("No leader elected : %s", ctx.Err())
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// WaitReady waits for every running node to have caught up with the leader, see Server.Ready
+func (c *Cluster) WaitReady(ctx context.Context) error {
+	for _, node := range c.Nodes {
+		for {
+			s := node.Server()
+			if s == nil {
+				break
+			}
+			err := s.Ready()
+			if err == nil {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("Node %d isn't ready : %s", node.Index, err)
+			case <-time.After(pollInterval):
+			}
+		}
+	}
+	return nil
+}
+
+// Followers returns the running nodes other than the leader
+func (c *Cluster) Followers() []*Node {
+	leader := c.Leader()
+	ret := make([]*Node, 0, len(c.Nodes))
+	for _, node := range c.Nodes {
+		if node != leader && node.Server() != nil {
+			ret = append(ret, node)
+		}
+	}
+	return ret
+}
+
+// Get fetches path from node i, returning the status and body
+func (c *Cluster) Get(i int, path string) (int, []byte, error) {
+	return c.Do(i, "GET", path, nil)
+}
+
+// Do sends a request to node i, returning the status and body.  Redirects aren't followed.
+func (c *Cluster) Do(i int, method string, path string, body []byte) (int, []byte, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, c.Nodes[i].URL(path), reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, respBody, err
+}
+
+// Close stops every node and link, and removes the data if it's in a temp dir
+func (c *Cluster) Close() error {
+	var err error
+	for i := range c.Nodes {
+		if c.Nodes[i] == nil {
+			continue
+		}
+		if killErr := c.Kill(i); killErr != nil && err == nil {
+			err = killErr
+		}
+	}
+	for _, links := range c.Links {
+		for _, link := range links {
+			if link != nil {
+				link.Close()
+			}
+		}
+	}
+	for _, node := range c.Nodes {
+		if node != nil && node.webProxy != nil {
+			node.webProxy.Close()
+		}
+	}
+	if c.tempDir {
+		os.RemoveAll(c.opts.Dir)
+	}
+	return err
+}
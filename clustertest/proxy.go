@@ -0,0 +1,239 @@
+package clustertest
+
+import (
+	"context"
+	"github.com/jbooth/merchdb"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+)
+
+// Link is a TCP proxy standing in for one node's flotilla address in another
+// node's peer list, so the traffic between them can be cut.
+type Link struct {
+	From, To int
+	target   string
+	listener net.Listener
+	lock     *sync.Mutex
+	cut      bool
+	closed   bool
+	conns    map[net.Conn]bool
+}
+
+func newLink(from int, to int, target string) (*Link, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	link := &Link{
+		From:     from,
+		To:       to,
+		target:   target,
+		listener: l,
+		lock:     &sync.Mutex{},
+		conns:    make(map[net.Conn]bool),
+	}
+	go link.accept()
+	return link, nil
+}
+
+// the address From dials to reach To
+func (l *Link) Addr() string {
+	return l.listener.Addr().String()
+}
+
+func (l *Link) accept() {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			return
+		}
+		go l.forward(conn)
+	}
+}
+
+// tracks conn so Cut can close it, returning false if the link is cut already
+func (l *Link) track(conn net.Conn) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.cut || l.closed {
+		return false
+	}
+	l.conns[conn] = true
+	return true
+}
+
+func (l *Link) untrack(conn net.Conn) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.conns, conn)
+}
+
+func (l *Link) forward(in net.Conn) {
+	defer in.Close()
+	if !l.track(in) {
+		return
+	}
+	defer l.untrack(in)
+	out, err := net.Dial("tcp", l.target)
+	if err != nil {
+		return
+	}
+	defer out.Close()
+	if !l.track(out) {
+		return
+	}
+	defer l.untrack(out)
+	done := make(chan struct{}, 2)
+	pipe := func(dst net.Conn, src net.Conn) {
+		io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go pipe(out, in)
+	go pipe(in, out)
+	// once either side is done, closing both ends the other copy
+	<-done
+}
+
+// Cut drops the connections through the link and refuses new ones until it's healed
+func (l *Link) Cut() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.cut = true
+	for conn := range l.conns {
+		conn.Close()
+	}
+}
+
+func (l *Link) Heal() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.cut = false
+}
+
+func (l *Link) IsCut() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.cut
+}
+
+func (l *Link) Close() error {
+	l.lock.Lock()
+	l.closed = true
+	for conn := range l.conns {
+		conn.Close()
+	}
+	l.lock.Unlock()
+	return l.listener.Close()
+}
+
+// webProxy stands in for a node's web address in the node registry, so writes the
+// other nodes forward to it over http are dropped across partitions too.  Requests
+// that weren't forwarded by a node, like the tests' own, always go through.
+type webProxy struct {
+	c        *Cluster
+	to       int
+	listener net.Listener
+	server   *http.Server
+	proxy    *httputil.ReverseProxy
+	lock     *sync.Mutex
+	inflight map[*forwardedReq]bool
+}
+
+// a forwarded request in flight through a webProxy
+type forwardedReq struct {
+	from   int
+	cancel context.CancelFunc
+}
+
+func newWebProxy(c *Cluster, to int) (*webProxy, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	target := &url.URL{Scheme: "http", Host: c.Nodes[to].WebAddr}
+	p := &webProxy{
+		c:        c,
+		to:       to,
+		listener: l,
+		lock:     &sync.Mutex{},
+		inflight: make(map[*forwardedReq]bool),
+	}
+	p.proxy = &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			// keep the client the forwarding node saw, rather than adding ourselves
+			pr.Out.Header["X-Forwarded-For"] = pr.In.Header["X-Forwarded-For"]
+		},
+		// so import progress streams through
+		FlushInterval: -1,
+		ErrorLog:      log.New(io.Discard, "", 0),
+	}
+	p.server = &http.Server{Handler: p}
+	go p.server.Serve(l)
+	return p, nil
+}
+
+// the address other nodes forward writes to
+func (p *webProxy) Addr() string {
+	return p.listener.Addr().String()
+}
+
+func (p *webProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	from := p.c.nodeAt(r.Header.Get(merchdb.ForwardedHeader))
+	if from < 0 {
+		p.proxy.ServeHTTP(w, r)
+		return
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	req := &forwardedReq{from, cancel}
+	if !p.track(req) {
+		// like the connection dropping, which the forwarding node answers with a 502
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err == nil {
+			conn.Close()
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer p.untrack(req)
+	p.proxy.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// tracks req so partitions can cut it off, returning false if it's cut off already
+func (p *webProxy) track(req *forwardedReq) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.c.connected(req.from, p.to) {
+		return false
+	}
+	p.inflight[req] = true
+	return true
+}
+
+func (p *webProxy) untrack(req *forwardedReq) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.inflight, req)
+}
+
+// cuts off requests in flight from nodes that are no longer connected
+func (p *webProxy) partitioned() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for req := range p.inflight {
+		if !p.c.connected(req.from, p.to) {
+			req.cancel()
+		}
+	}
+}
+
+func (p *webProxy) Close() error {
+	return p.server.Close()
+}
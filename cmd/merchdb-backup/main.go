@@ -0,0 +1,134 @@
+// merchdb-backup takes hot backups of a running merchdb node and restores them
+// into the data directories of a new cluster's nodes.
+//
+//	merchdb-backup backup -node localhost:8001 -dir /backups/2014-06-01 [-compact=false] [-token t] [-ca ca.pem [-cert c.pem -key k.pem]]
+//	merchdb-backup restore -from /backups/2014-06-01 -to /data/newnode/mdb
+//
+// backup asks the node to write the copy, so dir is a path on the node's machine.
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/jbooth/merchdb"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	switch os.Args[1] {
+	case "backup":
+		err = backup(os.Args[2:])
+	case "restore":
+		err = restore(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s backup|restore [flags]\n", os.Args[0])
+	os.Exit(2)
+}
+
+func backup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	node := flags.String("node", "localhost:8001", "web address of the node to back up")
+	dir := flags.String("dir", "", "directory on the node's machine to write the backup to, must not exist")
+	compact := flags.Bool("compact", true, "copy entries rather than pages, leaving out free space")
+	token := flags.String("token", os.Getenv("MERCHDB_TOKEN"), "API token, if the node requires one")
+	caFile := flags.String("ca", "", "CA bundle to verify the node's cert, connects over https if set")
+	certFile := flags.String("cert", "", "client cert, if the node requires one")
+	keyFile := flags.String("key", "", "key for -cert")
+	flags.Parse(args)
+	if *dir == "" {
+		return fmt.Errorf("backup requires -dir")
+	}
+	client, scheme, err := httpClient(*caFile, *certFile, *keyFile)
+	if err != nil {
+		return err
+	}
+	params := url.Values{}
+	params.Set("dir", *dir)
+	params.Set("compact", fmt.Sprint(*compact))
+	req, err := http.NewRequest("GET", scheme+"://"+*node+"/admin/backup?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Backup failed with status %d : %s", resp.StatusCode, string(msg))
+	}
+	manifest := &merchdb.BackupManifest{}
+	err = json.NewDecoder(resp.Body).Decode(manifest)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Backed up tables %v from %s to %s with %d applied commands\n", manifest.Tables, manifest.FlotillaAddr, *dir, manifest.AppliedCommands)
+	return nil
+}
+
+// returns a client and url scheme for talking to a node, using TLS if a CA is given
+func httpClient(caFile string, certFile string, keyFile string) (*http.Client, string, error) {
+	if caFile == "" {
+		return http.DefaultClient, "http", nil
+	}
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, "", err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, "", fmt.Errorf("No certs found in %s", caFile)
+	}
+	tlsConfig := &tls.Config{RootCAs: pool}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, "", err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}, "https", nil
+}
+
+// restores a backup into the empty mdb environment dir of a node that hasn't been
+// started yet.  Backups don't include raft's state, so this only seeds a new cluster,
+// with every node restored from the same backup before any of them starts.
+func restore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	from := flags.String("from", "", "backup directory written by backup")
+	to := flags.String("to", "", "empty mdb environment directory for a node of the new cluster")
+	flags.Parse(args)
+	if *from == "" || *to == "" {
+		return fmt.Errorf("restore requires -from and -to")
+	}
+	manifest, err := merchdb.Restore(*from, *to)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restored tables %v from backup of %s taken %s with %d applied commands\n",
+		manifest.Tables, manifest.FlotillaAddr, manifest.Created, manifest.AppliedCommands)
+	return nil
+}
@@ -0,0 +1,89 @@
+package merchdb
+
+import (
+	"github.com/jbooth/merchdb/trace"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// ServerConfig holds the addresses and HTTP limits for NewServerWithConfig.
+// Zero timeouts and sizes mean no limit, as with net/http.Server.
+type ServerConfig struct {
+	WebAddr      string
+	FlotillaAddr string
+	DataDir      string
+	// flotilla addresses of every node in the cluster, including this one
+	Peers []string
+	// address to serve the binary wire protocol on, in the same forms as WebAddr,
+	// or empty to not serve it
+	WireAddr string
+	// web address other nodes send clients to for this node.  Defaults to WebAddr, with
+	// a missing or wildcard host like ":8001", "0.0.0.0" or "[::]" replaced by
+	// FlotillaAddr's host.
+	AdvertiseAddr string
+	// how long a claim on the leader lease lasts, see lease.go.  Only used to forward
+	// writes, see WithForwarding, when flotilla doesn't report raft's leader.  Each
+	// node sends a raft command every third of it, so it's off by default and
+	// forwarded writes are then submitted locally.
+	LeaderLease time.Duration
+
+	// time to read a whole request, including the body.  Like WriteTimeout and
+	// MaxBodyBytes it doesn't apply to /admin/import, /admin/export or /admin/backup,
+	// which stream whole tables and run as long as they need to.
+	ReadTimeout time.Duration
+	// time to read request headers
+	ReadHeaderTimeout time.Duration
+	// time from the end of reading the request headers until the response is written
+	WriteTimeout time.Duration
+	// time to keep idle keep-alive connections open
+	IdleTimeout time.Duration
+	// largest request body accepted, bigger ones get a 413 or fail while being read
+	MaxBodyBytes int64
+	// largest request headers accepted
+	MaxHeaderBytes int
+
+	// commands waiting on raft at once, past which requests fail fast with a 503
+	MaxInflightCommands int
+	// longest a request waits for its command to be applied, before a 503.  The
+	// command may still be applied after the request gives up on it.
+	CommandTimeout time.Duration
+
+	// how long to hold a putCols waiting for others to batch it with, zero to
+	// send each on its own.  Batched writes share a raft entry and mdb commit.
+	WriteBatchWindow time.Duration
+	// most putCols sent in one batch
+	MaxWriteBatch int
+}
+
+// returns the config NewServer uses, without addresses
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		ReadTimeout:       30 * time.Second,
+		ReadHeaderTimeout: 5 * time.Second,
+		WriteTimeout:      60 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+		MaxBodyBytes:      64 << 20,
+		MaxHeaderBytes:    1 << 20,
+
+		MaxInflightCommands: 1024,
+		CommandTimeout:      10 * time.Second,
+
+		MaxWriteBatch: 256,
+	}
+}
+
+// optional settings for NewServer and NewServerWithConfig
+type config struct {
+	forward    ForwardMode
+	logger     *slog.Logger
+	exporter   trace.Exporter
+	auth       Authenticator
+	acls       bool
+	admins     map[string]bool
+	tls        *TLSConfig
+	listener   net.Listener
+	rateLimits *RateLimitConfig
+}
+
+type Option func(*config)
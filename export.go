@@ -0,0 +1,180 @@
+package merchdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	ops "github.com/jbooth/merchdb/ops"
+	"io"
+	"net/http"
+)
+
+// number of columns sent per ImportCols command
+const importBatchCols = 1000
+
+// url is formatted like /admin/export?table=t1&table=t2
+// streams a dump in the format described in ops/export.go, of the listed tables or all
+// tables if none are listed, from a consistent snapshot of this node's copy of the data
+func (s *Server) HandleExport(w http.ResponseWriter, r *http.Request) {
+	var tables []string = r.URL.Query()["table"]
+	txn, err := s.flotilla.Read()
+	if err != nil {
+		returnErr(w, err)
+		return
+	}
+	defer txn.Abort()
+	w.Header().Add("Content-Type", "application-json")
+	err = ops.Export(txn, tables, w)
+	if err != nil {
+		// too late to change the status code, the dump will be truncated
+		s.reqLog(r).Error("Error exporting", "err", err)
+	}
+}
+
+// url is formatted like /admin/import, with a dump from /admin/export as the request body.
+// Loads the dump through replicated commands, streaming an ImportProgress line after each batch.
+func (s *Server) HandleImport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application-json")
+	enc := json.NewEncoder(w)
+	flusher, canFlush := w.(http.Flusher)
+	progress := &ImportProgress{Ok: true}
+	err := s.importDump(r.Context(), json.NewDecoder(r.Body), func() {
+		err := enc.Encode(progress)
+		if err != nil {
+			s.reqLog(r).Error("Error encoding response", "err", err)
+		}
+		if canFlush {
+			flusher.Flush()
+		}
+	}, progress)
+	if err != nil {
+		s.reqLog(r).Error("Error importing", "err", err)
+		progress.Ok = false
+		progress.Err = err.Error()
+	}
+	progress.Done = true
+	err = enc.Encode(progress)
+	if err != nil {
+		s.reqLog(r).Error("Error encoding response", "err", err)
+	}
+}
+
+// reads a dump from dec and applies it, calling report after each batch is replicated
+func (s *Server) importDump(ctx context.Context, dec *json.Decoder, report func(), progress *ImportProgress) error {
+	header := &ops.ExportRecord{}
+	err := dec.Decode(header)
+	if err != nil {
+		return fmt.Errorf("Couldn't read dump header : %s", err)
+	}
+	if header.Kind != ops.EXPORT_HEADER || header.Version != ops.ExportVersion {
+		return fmt.Errorf("Unsupported dump, expected %s record with version %d", ops.EXPORT_HEADER, ops.ExportVersion)
+	}
+	indexes := make([][2]string, 0)
+	table := ""
+	batch := make([]*ops.ExportRecord, 0, importBatchCols)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		result := s.retryingCommand(ctx, ops.IMPORTCOLS, ops.ImportArgs(table, batch))
+		if result.Err != nil {
+			return result.Err
+		}
+		progress.Cols += len(batch)
+		batch = batch[:0]
+		report()
+		return nil
+	}
+	for {
+		record := &ops.ExportRecord{}
+		err = dec.Decode(record)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch record.Kind {
+		case ops.EXPORT_TABLE:
+			err = flush()
+			if err != nil {
+				return err
+			}
+			table = record.Table
+			err = s.importTableDef(ctx, record)
+			if err != nil {
+				return err
+			}
+			for _, idx := range record.Indexes {
+				indexes = append(indexes, [2]string{table, idx.Name})
+			}
+			progress.Tables++
+		case ops.EXPORT_COL:
+			if record.Table != table {
+				return fmt.Errorf("Column for table %s found in section for table %s", record.Table, table)
+			}
+			batch = append(batch, record)
+			if len(batch) == importBatchCols {
+				err = flush()
+				if err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("Unknown record kind %s", record.Kind)
+		}
+	}
+	err = flush()
+	if err != nil {
+		return err
+	}
+	// indexes were maintained as columns were loaded, backfill just marks them ready
+	for _, idx := range indexes {
+		err = s.backfillIndex(ctx, idx[0], idx[1])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recreates a table's schema, families and index definitions before its columns are loaded.
+// Each op succeeds if the definition is already there, as it is when a command that
+// timed out was applied anyway or an import is rerun, so they're safe to retry.
+func (s *Server) importTableDef(ctx context.Context, record *ops.ExportRecord) error {
+	tableName := []byte(record.Table)
+	run := func(op string, args [][]byte) error {
+		result := s.retryingCommand(ctx, op, args)
+		if result.Err != nil {
+			return fmt.Errorf("Error recreating table %s : %s", record.Table, result.Err)
+		}
+		return nil
+	}
+	if record.Schema != nil {
+		schemaBytes, err := json.Marshal(record.Schema)
+		if err != nil {
+			return err
+		}
+		err = run(ops.SETSCHEMA, [][]byte{tableName, schemaBytes})
+		if err != nil {
+			return err
+		}
+	}
+	for _, f := range record.Families {
+		settings, err := json.Marshal(f)
+		if err != nil {
+			return err
+		}
+		err = run(ops.SETFAMILY, [][]byte{tableName, []byte(f.Name), settings})
+		if err != nil {
+			return err
+		}
+	}
+	for _, idx := range record.Indexes {
+		err := run(ops.CREATEINDEX, [][]byte{tableName, []byte(idx.Name), []byte(idx.Column)})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
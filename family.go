@@ -0,0 +1,103 @@
+package merchdb
+
+import (
+	"encoding/json"
+	"fmt"
+	ops "github.com/jbooth/merchdb/ops"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// url is formatted like /setFamily/tableName/familyName?ttl=3600&versions=3
+// ttl is in seconds, either param may be omitted to keep values forever or keep a single version.
+// Family names can't contain ':' or '.'.
+// Columns named familyName:qualifier are stored in the family once it's been set.
+// Existing columns aren't moved into a new family, so it's refused with a 400 if
+// the table already has columns named like it.  That's checked on this node before
+// the command is sent, so declare families before writing their columns.
+func (s *Server) HandleSetFamily(w http.ResponseWriter, r *http.Request) {
+	var err error
+	settings := struct {
+		TTL      int64
+		Versions int
+	}{}
+	params := r.URL.Query()
+	if ttl := params.Get("ttl"); ttl != "" {
+		settings.TTL, err = strconv.ParseInt(ttl, 10, 64)
+		if err != nil {
+			badRequest(w, fmt.Errorf("Invalid ttl %s : %s", ttl, err))
+			return
+		}
+	}
+	if versions := params.Get("versions"); versions != "" {
+		settings.Versions, err = strconv.Atoi(versions)
+		if err != nil {
+			badRequest(w, fmt.Errorf("Invalid versions %s : %s", versions, err))
+			return
+		}
+	}
+	settingsBytes, err := json.Marshal(settings)
+	if err != nil {
+		returnErr(w, err)
+		return
+	}
+	table, fam := pathParam(r, "table"), pathParam(r, "family")
+	txn, err := s.flotilla.Read()
+	if err != nil {
+		returnErr(w, err)
+		return
+	}
+	err = ops.CheckNewFamily(txn, table, fam)
+	txn.Abort()
+	if err == nil {
+		err = s.command(r.Context(), ops.SETFAMILY, [][]byte{[]byte(table), []byte(fam), settingsBytes}).Err
+	}
+	response := &WriteResponse{true, ""}
+	if err != nil {
+		response.Ok = false
+		response.Err = err.Error()
+	}
+	w.Header().Add("Content-Type", "application-json")
+	writeCommandStatus(w, err)
+	enc := json.NewEncoder(w)
+	err = enc.Encode(response)
+	if err != nil {
+		s.reqLog(r).Error("Error encoding response", "err", err)
+	}
+}
+
+// url is formatted like /getVersions/tableName/rowKey/familyName:qualifier
+// returns every live version this node has of the column, newest first.  Columns
+// outside a family have a single version.
+func (s *Server) HandleGetVersions(w http.ResponseWriter, r *http.Request) {
+	table := pathParam(r, "table")
+	rowKey := pathParam(r, "row")
+	col := pathParam(r, "col")
+	txn, err := s.flotilla.Read()
+	if err != nil {
+		returnErr(w, err)
+		return
+	}
+	defer txn.Abort()
+	response := &VersionsResponse{Key: rowKey, Col: col, Versions: make([]VersionResponse, 0)}
+	schema, err := ops.GetSchema(txn, table)
+	var versions []ops.Version
+	if err == nil {
+		versions, err = ops.ReadVersions(txn, table, []byte(rowKey), []byte(col), time.Now())
+	}
+	if err != nil {
+		response.Err = err.Error()
+	} else {
+		response.Ok = true
+		for _, v := range versions {
+			response.Versions = append(response.Versions, VersionResponse{v.Timestamp, schema.Render(col, v.Value)})
+		}
+	}
+	w.Header().Add("Content-Type", "application-json")
+	enc := json.NewEncoder(w)
+	err = enc.Encode(response)
+	if err != nil {
+		s.reqLog(r).Error("Error encoding response", "err", err)
+	}
+}
@@ -0,0 +1,114 @@
+package merchdb
+
+import (
+	"fmt"
+	"github.com/jbooth/flotilla"
+	mdb "github.com/jbooth/gomdb"
+	ops "github.com/jbooth/merchdb/ops"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// the flotilla fakes shared by the tests in this package
+
+// the ops a server gives flotilla, counting applied commands
+var localOps = ops.CountApplied(ops.Ops)
+
+// a single node flotilla applying ops directly to a local env.  Servers sharing
+// one act like nodes of a cluster that's always caught up.
+type localDB struct {
+	env  *mdb.Env
+	lock *sync.Mutex
+	// every command sent, in order
+	sent []string
+	// if set, commands are handed over here unanswered instead of being applied,
+	// and only complete when the test sends their result
+	stall chan chan flotilla.Result
+	// the ops commands are applied with, localOps if nil
+	ops map[string]flotilla.Command
+}
+
+func newLocalDB(t *testing.T, dbPath string) *localDB {
+	os.RemoveAll(dbPath)
+	os.MkdirAll(dbPath, 0755)
+	env, err := mdb.NewEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.SetMaxDBs(mdb.DBI(1024))
+	env.SetMaxReaders(1024)
+	err = env.Open(dbPath, mdb.CREATE, uint(0755))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &localDB{env: env, lock: &sync.Mutex{}}
+}
+
+func (db *localDB) Read() (*mdb.Txn, error) {
+	return db.env.BeginTxn(nil, mdb.RDONLY)
+}
+
+func (db *localDB) Command(cmd string, args [][]byte) <-chan flotilla.Result {
+	db.lock.Lock()
+	db.sent = append(db.sent, cmd)
+	db.lock.Unlock()
+	ret := make(chan flotilla.Result, 1)
+	if db.stall != nil {
+		db.stall <- ret
+		return ret
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	cmds := db.ops
+	if cmds == nil {
+		cmds = localOps
+	}
+	op, ok := cmds[cmd]
+	if !ok {
+		ret <- flotilla.Result{Err: fmt.Errorf("No such op %s", cmd)}
+		return ret
+	}
+	txn, err := db.env.BeginTxn(nil, uint(0))
+	if err != nil {
+		ret <- flotilla.Result{Err: err}
+		return ret
+	}
+	resp, err := op(args, txn)
+	if err == nil && !db.finished() {
+		err = fmt.Errorf("%s left its txn open", cmd)
+	}
+	ret <- flotilla.Result{Response: resp, Err: err}
+	return ret
+}
+
+// returns the commands sent so far
+func (db *localDB) commands() []string {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return append([]string{}, db.sent...)
+}
+
+// ops must commit or abort their txn, or the next write blocks forever
+func (db *localDB) finished() bool {
+	began := make(chan *mdb.Txn, 1)
+	go func() {
+		txn, _ := db.env.BeginTxn(nil, uint(0))
+		began <- txn
+	}()
+	select {
+	case txn := <-began:
+		if txn != nil {
+			txn.Abort()
+		}
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+func (db *localDB) Close() error {
+	db.env.Close()
+	return nil
+}
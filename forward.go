@@ -0,0 +1,147 @@
+package merchdb
+
+import (
+	"context"
+	"fmt"
+	ops "github.com/jbooth/merchdb/ops"
+	"github.com/jbooth/merchdb/trace"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+)
+
+// how a follower handles write requests, see WithForwarding
+type ForwardMode int
+
+const (
+	// submit writes locally and let flotilla forward the command to the leader
+	FORWARD_NONE ForwardMode = iota
+	// proxy write requests to the leader's web address
+	FORWARD_PROXY
+	// respond to write requests with a 307 redirect to the leader's web address
+	FORWARD_REDIRECT
+)
+
+// ForwardedHeader is set to the proxying node's flotilla address on requests
+// we've proxied, so a node with a stale view of the leader doesn't proxy them again
+const ForwardedHeader = "X-Merchdb-Forwarded"
+
+// how long to wait between attempts to register our web address
+const registerRetryInterval = 1 * time.Second
+
+// WithForwarding sets how this server handles writes when it isn't the leader.
+// Leadership comes from flotilla if it reports it, otherwise from the leader lease,
+// and with neither writes are always submitted locally.
+func WithForwarding(mode ForwardMode) Option {
+	return func(c *config) {
+		c.forward = mode
+	}
+}
+
+// wraps a handler for a write endpoint so that followers forward it to the leader
+func (s *Server) leaderOnly(h http.HandlerFunc) http.HandlerFunc {
+	if s.forward == FORWARD_NONE {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		l := s.leadership()
+		if l == nil || l.IsLeader() || r.Header.Get(ForwardedHeader) != "" {
+			h(w, r)
+			return
+		}
+		leaderWeb, err := s.leaderWebAddr(l)
+		if err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		target := &url.URL{Scheme: "http", Host: leaderWeb}
+		if r.TLS != nil {
+			target.Scheme = "https"
+		}
+		if s.forward == FORWARD_REDIRECT {
+			redirectTo := *r.URL
+			redirectTo.Scheme = target.Scheme
+			redirectTo.Host = target.Host
+			http.Redirect(w, r, redirectTo.String(), http.StatusTemporaryRedirect)
+			return
+		}
+		r.Header.Set(ForwardedHeader, s.flotillaAddr)
+		if span := trace.FromContext(r.Context()); span != nil {
+			r.Header.Set(trace.TraceparentHeader, span.SpanContext().Traceparent())
+		}
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		proxy.ErrorLog = slog.NewLogLogger(s.reqLog(r).Handler(), slog.LevelError)
+		if transport := s.proxyTransport(); transport != nil {
+			proxy.Transport = transport
+		}
+		proxy.ServeHTTP(w, r)
+	}
+}
+
+// looks up the current leader's web address in our copy of the node registry
+func (s *Server) leaderWebAddr(l leaderer) (string, error) {
+	leader := l.Leader()
+	if leader == nil {
+		return "", fmt.Errorf("No leader")
+	}
+	txn, err := s.flotilla.Read()
+	if err != nil {
+		return "", err
+	}
+	defer txn.Abort()
+	return ops.NodeWebAddr(txn, leader.String())
+}
+
+// publishes our advertised web address under our flotilla address through raft,
+// retrying until there's a leader to accept it or we're closed
+func (s *Server) registerNode() {
+	if s.advertiseAddr == "" {
+		s.lg.Info("Not registering web address, other nodes can't reach a unix socket", "webAddr", s.http.Addr)
+		return
+	}
+	flotillaAddr := resolvedAddr(s.flotillaAddr)
+	args := [][]byte{[]byte(flotillaAddr), []byte(s.advertiseAddr)}
+	for {
+		result := s.command(context.Background(), ops.REGISTERNODE, args)
+		if result.Err == nil {
+			return
+		}
+		s.lg.Warn("Error registering web address, retrying", "webAddr", s.advertiseAddr, "node", flotillaAddr, "err", result.Err)
+		select {
+		case <-s.closed:
+			return
+		case <-time.After(registerRetryInterval):
+		}
+	}
+}
+
+// returns the web address other nodes should use for us: advertise if it's set,
+// otherwise webAddr with a missing or wildcard host swapped for flotillaAddr's host,
+// since that's the host other nodes already reach us on.  Empty for a unix socket.
+func advertiseAddr(advertise string, webAddr string, flotillaAddr string) string {
+	if advertise != "" {
+		return advertise
+	}
+	if isUnixAddr(webAddr) {
+		return ""
+	}
+	host, port, err := net.SplitHostPort(webAddr)
+	if err != nil {
+		return webAddr
+	}
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+		return webAddr
+	}
+	flotillaHost, _, err := net.SplitHostPort(flotillaAddr)
+	if err != nil || flotillaHost == "" {
+		return webAddr
+	}
+	if ip := net.ParseIP(flotillaHost); ip != nil && ip.IsUnspecified() {
+		return webAddr
+	}
+	return net.JoinHostPort(flotillaHost, port)
+}
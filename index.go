@@ -0,0 +1,115 @@
+package merchdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	ops "github.com/jbooth/merchdb/ops"
+	"net/http"
+)
+
+// url is formatted like /createIndex/tableName/indexName?column=colName
+// defines the index and kicks off a backfill of existing rows, lookups will fail until it completes.
+// Index names can't contain '.'.  Creating an index again on the same column succeeds
+// without changing it, on a different column it's refused.
+func (s *Server) HandleCreateIndex(w http.ResponseWriter, r *http.Request) {
+	table, index := pathParam(r, "table"), pathParam(r, "index")
+	column := r.URL.Query().Get("column")
+	if column == "" {
+		badRequest(w, fmt.Errorf("createIndex requires a column param"))
+		return
+	}
+	flotillaArgs := [][]byte{[]byte(table), []byte(index), []byte(column)}
+	result := s.command(r.Context(), ops.CREATEINDEX, flotillaArgs)
+	response := &WriteResponse{true, ""}
+	if result.Err != nil {
+		response.Ok = false
+		response.Err = result.Err.Error()
+	} else {
+		go s.backfillIndex(context.WithoutCancel(r.Context()), table, index)
+	}
+	w.Header().Add("Content-Type", "application-json")
+	writeCommandStatus(w, result.Err)
+	enc := json.NewEncoder(w)
+	err := enc.Encode(response)
+	if err != nil {
+		s.reqLog(r).Error("Error encoding response", "err", err)
+	}
+}
+
+// url is formatted like /backfillIndex/tableName/indexName
+// restarts the backfill for an index, in case the node running the original backfill died.
+// 404s if the index hasn't been created.
+func (s *Server) HandleBackfillIndex(w http.ResponseWriter, r *http.Request) {
+	table, index := pathParam(r, "table"), pathParam(r, "index")
+	txn, err := s.flotilla.Read()
+	if err != nil {
+		returnErr(w, err)
+		return
+	}
+	exists, err := ops.IndexExists(txn, table, index)
+	txn.Abort()
+	if err != nil {
+		returnErr(w, err)
+		return
+	}
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmt.Sprintf("No index %s on table %s", index, table)))
+		return
+	}
+	go s.backfillIndex(context.WithoutCancel(r.Context()), table, index)
+	w.Header().Add("Content-Type", "application-json")
+	enc := json.NewEncoder(w)
+	err = enc.Encode(&WriteResponse{true, ""})
+	if err != nil {
+		s.reqLog(r).Error("Error encoding response", "err", err)
+	}
+}
+
+// url is formatted like /lookup/tableName/indexName/value
+// returns the keys of all rows where the indexed column is equal to value
+func (s *Server) HandleLookup(w http.ResponseWriter, r *http.Request) {
+	txn, err := s.flotilla.Read()
+	if err != nil {
+		returnErr(w, err)
+		return
+	}
+	rowKeys, err := ops.LookupIndex(txn, pathParam(r, "table"), pathParam(r, "index"), []byte(pathParam(r, "value")))
+	response := &LookupResponse{}
+	if err != nil {
+		response.Ok = false
+		response.Err = err.Error()
+	} else {
+		response.Ok = true
+		response.Keys = make([]string, len(rowKeys))
+		for i, k := range rowKeys {
+			response.Keys[i] = string(k)
+		}
+	}
+	txn.Abort()
+
+	w.Header().Add("Content-Type", "application-json")
+	enc := json.NewEncoder(w)
+	err = enc.Encode(response)
+	if err != nil {
+		s.reqLog(r).Error("Error encoding response", "err", err)
+	}
+}
+
+// runs BackfillIndex commands a chunk at a time until the index is marked ready
+func (s *Server) backfillIndex(ctx context.Context, table string, index string) error {
+	start := []byte{}
+	for {
+		result := s.retryingCommand(ctx, ops.BACKFILLINDEX, [][]byte{[]byte(table), []byte(index), start})
+		if result.Err != nil {
+			s.lg.Error("Error backfilling index", "table", table, "index", index, "err", result.Err)
+			return result.Err
+		}
+		if len(result.Response) == 0 {
+			s.lg.Info("Finished backfilling index", "table", table, "index", index)
+			return nil
+		}
+		start = result.Response
+	}
+}
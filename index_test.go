@@ -0,0 +1,58 @@
+package merchdb
+
+import (
+	"context"
+	ops "github.com/jbooth/merchdb/ops"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBackfillIndex(t *testing.T) {
+	db := newLocalDB(t, "/tmp/merchdbBackfillIndexTest")
+	defer db.Close()
+	s := &Server{
+		flotilla: db,
+		lg:       defaultLogger(),
+		metrics:  newServerMetrics(),
+		tracing:  newServerTracer(nil),
+		closed:   make(chan struct{}),
+	}
+	rt := newRouter()
+	rt.handle("/backfillIndex/{table}/{index}", s.HandleBackfillIndex)
+	backfill := func() int {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest("GET", "/backfillIndex/users/byEmail", nil))
+		return w.Code
+	}
+	if code := backfill(); code != 404 {
+		t.Fatalf("Expected a 404 backfilling a missing index, got %d", code)
+	}
+	if len(db.commands()) != 0 {
+		t.Fatalf("Expected no commands for a missing index, got %v", db.commands())
+	}
+	result := s.command(context.Background(), ops.CREATEINDEX, byteArgs("users byEmail email"))
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	if code := backfill(); code != 200 {
+		t.Fatalf("Expected a 200 backfilling an index, got %d", code)
+	}
+	// the backfill runs in the background, let it finish before closing the db
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		txn, err := db.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ops.LookupIndex(txn, "users", "byEmail", []byte("a@b.com"))
+		txn.Abort()
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Backfill never finished : %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
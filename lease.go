@@ -0,0 +1,107 @@
+package merchdb
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	ops "github.com/jbooth/merchdb/ops"
+	"net"
+	"time"
+)
+
+// leadership as held through the replicated lease in ops/lease.go, for flotillas that
+// don't report raft's leader.  The holder is whichever node most recently managed to
+// commit a claim, so it's always a node that can reach a majority, though not
+// necessarily raft's leader.  Nodes judge expiry by their own clocks, so with clock
+// skew two nodes can both think they hold it for a moment.  Writes still go through
+// raft either way, the lease only decides where they're forwarded.
+type leaseLeader struct {
+	s *Server
+}
+
+// returns how this node learns where to forward writes: from flotilla if it reports
+// raft's leader, otherwise from the lease if we're forwarding and have one configured,
+// or nil if neither is available.  Claiming the lease costs a raft command every
+// third of its ttl, so nodes that don't forward don't take part.
+func (s *Server) leadership() leaderer {
+	if l, ok := s.flotilla.(leaderer); ok {
+		return l
+	}
+	if s.leaseTTL <= 0 || s.forward == FORWARD_NONE {
+		return nil
+	}
+	return &leaseLeader{s}
+}
+
+func (l *leaseLeader) IsLeader() bool {
+	lease := l.s.currentLease()
+	return lease != nil && lease.Holder == resolvedAddr(l.s.flotillaAddr)
+}
+
+func (l *leaseLeader) Leader() net.Addr {
+	lease := l.s.currentLease()
+	if lease == nil {
+		return nil
+	}
+	addr, err := net.ResolveTCPAddr("tcp", lease.Holder)
+	if err != nil {
+		return nil
+	}
+	return addr
+}
+
+// returns the lease if it's held and hasn't expired by our clock, otherwise nil
+func (s *Server) currentLease() *ops.Lease {
+	txn, err := s.flotilla.Read()
+	if err != nil {
+		return nil
+	}
+	lease, err := ops.ReadLease(txn)
+	txn.Abort()
+	if err != nil || lease.Holder == "" || time.Now().UnixNano() >= lease.Expires {
+		return nil
+	}
+	return lease
+}
+
+// the lease's epoch, which counts how many times it's changed hands
+func (s *Server) leaseEpoch() (uint64, bool) {
+	txn, err := s.flotilla.Read()
+	if err != nil {
+		return 0, false
+	}
+	defer txn.Abort()
+	lease, err := ops.ReadLease(txn)
+	if err != nil {
+		return 0, false
+	}
+	return lease.Epoch, true
+}
+
+// renews the lease while we hold it, and claims it whenever it runs out, until we're closed
+func (s *Server) holdLease() {
+	self := resolvedAddr(s.flotillaAddr)
+	ttl := make([]byte, 8)
+	binary.LittleEndian.PutUint64(ttl, uint64(s.leaseTTL))
+	for {
+		lease := s.currentLease()
+		if lease == nil || lease.Holder == self {
+			ctx, cancel := context.WithTimeout(context.Background(), s.leaseTTL)
+			result := s.command(ctx, ops.ACQUIRELEASE, [][]byte{[]byte(self), ops.Timestamp(time.Now()), ttl})
+			cancel()
+			if result.Err != nil {
+				s.lg.Debug("Couldn't claim leader lease", "err", result.Err)
+			} else if lease == nil {
+				claimed := &ops.Lease{}
+				if json.Unmarshal(result.Response, claimed) == nil && claimed.Holder == self {
+					s.lg.Info("Took leader lease", "epoch", claimed.Epoch)
+				}
+			}
+		}
+		select {
+		case <-s.closed:
+			return
+		case <-time.After(s.leaseTTL / 3):
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package merchdb
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/jbooth/flotilla"
+	ops "github.com/jbooth/merchdb/ops"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a server on a flotilla shared with others, tracking leadership through the lease
+func leaseTestServer(db flotilla.DefaultOpsDB, dataDir string, flotillaAddr string, ttl time.Duration, forward ForwardMode) *Server {
+	return &Server{
+		flotilla:     db,
+		http:         &http.Server{},
+		flotillaAddr: flotillaAddr,
+		dataDir:      dataDir,
+		peersLock:    &sync.RWMutex{},
+		readyLock:    &sync.Mutex{},
+		leaseTTL:     ttl,
+		lg:           defaultLogger(),
+		metrics:      newServerMetrics(),
+		tracing:      newServerTracer(nil),
+		closed:       make(chan struct{}),
+		config:       config{forward: forward},
+	}
+}
+
+func waitHolder(t *testing.T, s *Server, holder string) *StatusResponse {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := s.Status()
+		if status.LeaseHolder == holder {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s never saw %s take the lease : %+v", s.flotillaAddr, holder, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLeaseStatus(t *testing.T) {
+	dataDir := "/tmp/merchdbLeaseStatusTest"
+	db := newLocalDB(t, dataDir)
+	defer db.Close()
+	ttl := 300 * time.Millisecond
+	first := leaseTestServer(db, dataDir, "127.0.0.1:1101", ttl, FORWARD_PROXY)
+	second := leaseTestServer(db, dataDir, "127.0.0.1:1102", ttl, FORWARD_PROXY)
+	for _, node := range []string{"127.0.0.1:1101 127.0.0.1:8001", "127.0.0.1:1102 127.0.0.1:8002"} {
+		result := first.command(context.Background(), ops.REGISTERNODE, byteArgs(node))
+		if result.Err != nil {
+			t.Fatal(result.Err)
+		}
+	}
+	status := second.Status()
+	if status.LeaseHolder != "" || status.LeaseEpoch != 0 {
+		t.Fatalf("Expected no holder before the lease is taken, got %+v", status)
+	}
+
+	go first.holdLease()
+	waitHolder(t, first, "127.0.0.1:1101")
+	go second.holdLease()
+	defer close(second.closed)
+	// the holder keeps renewing, so the other node doesn't take over
+	time.Sleep(2 * ttl)
+	status = second.Status()
+	if status.LeaseHolder != "127.0.0.1:1101" || status.LeaseEpoch != 1 {
+		t.Fatalf("Unexpected status while the lease is held %+v", status)
+	}
+	// the lease says nothing about raft, which this flotilla doesn't report
+	if status.Role != "unknown" || status.Leader != "" || status.Term != 0 {
+		t.Fatalf("Expected the lease kept out of the raft fields, got %+v", status)
+	}
+	if web, err := second.leaderWebAddr(second.leadership()); err != nil || web != "127.0.0.1:8001" {
+		t.Fatalf("Expected writes forwarded to 127.0.0.1:8001, got %q %v", web, err)
+	}
+
+	// once the holder stops renewing the other node takes over
+	close(first.closed)
+	status = waitHolder(t, second, "127.0.0.1:1102")
+	if status.LeaseEpoch != 2 {
+		t.Fatalf("Unexpected status after failover %+v", status)
+	}
+	if !second.leadership().IsLeader() || first.leadership().IsLeader() {
+		t.Fatalf("Expected only the new holder to lead")
+	}
+}
+
+// without forwarding there's nothing to use a lease for, so none is taken
+func TestLeaseNeedsForwarding(t *testing.T) {
+	dataDir := "/tmp/merchdbLeaseNeedsForwardingTest"
+	db := newLocalDB(t, dataDir)
+	defer db.Close()
+	s := leaseTestServer(db, dataDir, "127.0.0.1:1101", time.Second, FORWARD_NONE)
+	if s.leadership() != nil {
+		t.Fatalf("Expected no leadership tracking without forwarding")
+	}
+	status := s.Status()
+	if status.Role != "unknown" || status.LeaseHolder != "" || status.LeaseEpoch != 0 {
+		t.Fatalf("Unexpected status %+v", status)
+	}
+	if DefaultServerConfig().LeaderLease != 0 {
+		t.Fatalf("Expected the lease off by default")
+	}
+}
+
+func TestForwarding(t *testing.T) {
+	dataDir := "/tmp/merchdbForwardingTest"
+	db := newLocalDB(t, dataDir)
+	defer db.Close()
+	leader := leaseTestServer(db, dataDir, "127.0.0.1:1101", time.Minute, FORWARD_PROXY)
+	var forwardedFrom string
+	leaderWeb := httptest.NewServer(leader.leaderOnly(func(w http.ResponseWriter, r *http.Request) {
+		forwardedFrom = r.Header.Get(ForwardedHeader)
+		w.Write([]byte("leader " + r.URL.RequestURI()))
+	}))
+	defer leaderWeb.Close()
+	result := leader.command(context.Background(), ops.REGISTERNODE, byteArgs("127.0.0.1:1101 "+leaderWeb.Listener.Addr().String()))
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	ttl := make([]byte, 8)
+	binary.LittleEndian.PutUint64(ttl, uint64(time.Minute))
+	result = leader.command(context.Background(), ops.ACQUIRELEASE, [][]byte{[]byte("127.0.0.1:1101"), ops.Timestamp(time.Now()), ttl})
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+
+	local := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("local"))
+	}
+	serve := func(s *Server, url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.leaderOnly(local)(w, httptest.NewRequest("POST", url, nil))
+		return w
+	}
+
+	// the leader serves writes itself
+	w := serve(leader, "/putCols/t/r?a=1")
+	if w.Code != 200 || w.Body.String() != "local" {
+		t.Fatalf("Expected the leader to serve locally, got %d %s", w.Code, w.Body.String())
+	}
+
+	proxier := leaseTestServer(db, dataDir, "127.0.0.1:1102", time.Minute, FORWARD_PROXY)
+	w = serve(proxier, "/putCols/t/r?a=1")
+	if w.Code != 200 || w.Body.String() != "leader /putCols/t/r?a=1" || forwardedFrom != "127.0.0.1:1102" {
+		t.Fatalf("Expected the write proxied to the leader, got %d %s from %q", w.Code, w.Body.String(), forwardedFrom)
+	}
+
+	redirector := leaseTestServer(db, dataDir, "127.0.0.1:1103", time.Minute, FORWARD_REDIRECT)
+	w = serve(redirector, "/putCols/t/r?a=1")
+	expLocation := "http://" + leaderWeb.Listener.Addr().String() + "/putCols/t/r?a=1"
+	if w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != expLocation {
+		t.Fatalf("Expected a redirect to %s, got %d %s", expLocation, w.Code, w.Header().Get("Location"))
+	}
+
+	// without leadership tracking writes are always served locally
+	unknown := leaseTestServer(db, dataDir, "127.0.0.1:1104", 0, FORWARD_PROXY)
+	w = serve(unknown, "/putCols/t/r?a=1")
+	if w.Code != 200 || w.Body.String() != "local" {
+		t.Fatalf("Expected a local write without leadership, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAdvertiseAddr(t *testing.T) {
+	for _, c := range []struct {
+		advertise    string
+		webAddr      string
+		flotillaAddr string
+		exp          string
+	}{
+		{"", "10.0.0.1:8001", "10.0.0.1:1103", "10.0.0.1:8001"},
+		{"", "web1:8001", "10.0.0.1:1103", "web1:8001"},
+		{"", ":8001", "10.0.0.1:1103", "10.0.0.1:8001"},
+		{"", "0.0.0.0:8001", "node1:1103", "node1:8001"},
+		{"", "[::]:8001", "[fd00::1]:1103", "[fd00::1]:8001"},
+		// nothing better to use
+		{"", ":8001", ":1103", ":8001"},
+		{"", "unix:/tmp/merchdb.sock", "10.0.0.1:1103", ""},
+		{"lb.example.com:80", ":8001", "10.0.0.1:1103", "lb.example.com:80"},
+	} {
+		got := advertiseAddr(c.advertise, c.webAddr, c.flotillaAddr)
+		if got != c.exp {
+			t.Fatalf("advertiseAddr(%q, %q, %q) : expected %q, got %q", c.advertise, c.webAddr, c.flotillaAddr, c.exp, got)
+		}
+	}
+}
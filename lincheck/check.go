@@ -0,0 +1,209 @@
+// Package lincheck checks that merchdb's replicated ops are linearizable.  Run
+// drives concurrent clients against a clustertest cluster while crashing and
+// partitioning its nodes, recording every op with when it was called and
+// returned.  Check then searches each row's history for an order of the ops
+// that's consistent with both those times and a model of a row, in the manner
+// of Wing & Gong's algorithm as used by Knossos and Porcupine.
+package lincheck
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+type OpKind int
+
+const (
+	GET OpKind = iota
+	PUT
+	DEL
+)
+
+var opKindNames = []string{"get", "put", "del"}
+
+func (k OpKind) String() string {
+	if int(k) < len(opKindNames) {
+		return opKindNames[k]
+	}
+	return fmt.Sprintf("OpKind(%d)", int(k))
+}
+
+// Return of a write whose outcome the client never learned.  It may have been
+// applied at any point after it was called, or not at all.
+const Unknown = time.Duration(math.MaxInt64)
+
+// Op is one client operation on a row, timed from the start of the run
+type Op struct {
+	Client int
+	Kind   OpKind
+	Row    string
+	// the columns a PUT wrote, or the whole row a GET read
+	Cols   map[string]string
+	Call   time.Duration
+	Return time.Duration
+}
+
+func (op Op) String() string {
+	ret := "?"
+	if op.Return != Unknown {
+		ret = op.Return.String()
+	}
+	return fmt.Sprintf("client %d %s %s %s [%s, %s]", op.Client, op.Kind, op.Row, encodeRow(op.Cols), op.Call, ret)
+}
+
+// Result of checking a history
+type Result struct {
+	Ok bool
+	// the first row with no valid order, and its history
+	Row string
+	Ops []Op
+}
+
+func (r *Result) String() string {
+	if r.Ok {
+		return "linearizable"
+	}
+	lines := make([]string, 0, len(r.Ops)+1)
+	lines = append(lines, fmt.Sprintf("history of row %s isn't linearizable :", r.Row))
+	for _, op := range r.Ops {
+		lines = append(lines, "  "+op.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Check checks whether history is linearizable.  Rows are independent, so each
+// row's ops are checked on their own, which keeps the search small.
+func Check(history []Op) *Result {
+	rows := make(map[string][]Op)
+	for _, op := range history {
+		rows[op.Row] = append(rows[op.Row], op)
+	}
+	keys := make([]string, 0, len(rows))
+	for row := range rows {
+		keys = append(keys, row)
+	}
+	sort.Strings(keys)
+	for _, row := range keys {
+		if !linearizable(rows[row]) {
+			return &Result{false, row, rows[row]}
+		}
+	}
+	return &Result{Ok: true}
+}
+
+// applies op to row, returning the row after and whether op could have happened
+// with row as it was
+func step(row map[string]string, op Op) (map[string]string, bool) {
+	switch op.Kind {
+	case PUT:
+		next := make(map[string]string, len(row)+len(op.Cols))
+		for k, v := range row {
+			next[k] = v
+		}
+		for k, v := range op.Cols {
+			next[k] = v
+		}
+		return next, true
+	case DEL:
+		return map[string]string{}, true
+	default:
+		return row, encodeRow(row) == encodeRow(op.Cols)
+	}
+}
+
+// canonical form of a row, for comparing and remembering states
+func encodeRow(row map[string]string) string {
+	cols := make([]string, 0, len(row))
+	for k, v := range row {
+		cols = append(cols, fmt.Sprintf("%q=%q", k, v))
+	}
+	sort.Strings(cols)
+	return "{" + strings.Join(cols, " ") + "}"
+}
+
+// searches for a valid order of one row's ops
+type search struct {
+	// sorted by call
+	ops []Op
+	// which ops are in the order so far
+	done []uint64
+	// orders already found to be dead ends, by which ops they hold and the row they leave
+	visited map[string]bool
+}
+
+func (s *search) isDone(i int) bool {
+	return s.done[i/64]&(1<<(i%64)) != 0
+}
+
+func (s *search) flip(i int) {
+	s.done[i/64] ^= 1 << (i % 64)
+}
+
+func (s *search) key(row map[string]string) string {
+	buf := make([]byte, 0, 8*len(s.done))
+	for _, word := range s.done {
+		buf = binary.LittleEndian.AppendUint64(buf, word)
+	}
+	return string(buf) + encodeRow(row)
+}
+
+// extends the order so far, with row as it leaves it.  remaining counts the
+// ops that returned and aren't in the order yet, writes of unknown outcome can
+// be left out.
+func (s *search) extend(row map[string]string, remaining int) bool {
+	if remaining == 0 {
+		return true
+	}
+	key := s.key(row)
+	if s.visited[key] {
+		return false
+	}
+	// an op can only go next if it was called before every op not yet in the order returned
+	deadline := Unknown
+	for i, op := range s.ops {
+		if !s.isDone(i) && op.Return < deadline {
+			deadline = op.Return
+		}
+	}
+	for i, op := range s.ops {
+		if op.Call > deadline {
+			break
+		}
+		if s.isDone(i) {
+			continue
+		}
+		next, ok := step(row, op)
+		if !ok {
+			continue
+		}
+		returned := 0
+		if op.Return != Unknown {
+			returned = 1
+		}
+		s.flip(i)
+		if s.extend(next, remaining-returned) {
+			return true
+		}
+		s.flip(i)
+	}
+	s.visited[key] = true
+	return false
+}
+
+func linearizable(ops []Op) bool {
+	sorted := make([]Op, len(ops))
+	copy(sorted, ops)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Call < sorted[j].Call })
+	remaining := 0
+	for _, op := range sorted {
+		if op.Return != Unknown {
+			remaining++
+		}
+	}
+	s := &search{sorted, make([]uint64, (len(sorted)+63)/64), make(map[string]bool)}
+	return s.extend(map[string]string{}, remaining)
+}
@@ -0,0 +1,65 @@
+package lincheck
+
+import (
+	"testing"
+	"time"
+)
+
+func putOp(client int, cols map[string]string, call int, ret int) Op {
+	return Op{client, PUT, "r", cols, time.Duration(call), time.Duration(ret)}
+}
+
+func getOp(client int, cols map[string]string, call int, ret int) Op {
+	return Op{client, GET, "r", cols, time.Duration(call), time.Duration(ret)}
+}
+
+func delOp(client int, call int, ret int) Op {
+	return Op{client, DEL, "r", nil, time.Duration(call), time.Duration(ret)}
+}
+
+func TestCheck(t *testing.T) {
+	a1 := map[string]string{"a": "1"}
+	a2 := map[string]string{"a": "2"}
+	b3 := map[string]string{"b": "3"}
+	a1b3 := map[string]string{"a": "1", "b": "3"}
+	empty := map[string]string{}
+	unknown := int(Unknown)
+
+	for _, c := range []struct {
+		name    string
+		history []Op
+		ok      bool
+	}{
+		{"empty", []Op{}, true},
+		{"sequential", []Op{putOp(0, a1, 0, 1), getOp(1, a1, 2, 3), putOp(0, b3, 4, 5), getOp(1, a1b3, 6, 7), delOp(0, 8, 9), getOp(1, empty, 10, 11)}, true},
+		{"stale read", []Op{putOp(0, a1, 0, 1), putOp(0, a2, 2, 3), getOp(1, a1, 4, 5)}, false},
+		{"read before write", []Op{getOp(1, a1, 0, 1), putOp(0, a1, 2, 3)}, false},
+		{"concurrent read sees write", []Op{putOp(0, a1, 0, 10), getOp(1, a1, 1, 2)}, true},
+		{"concurrent read misses write", []Op{putOp(0, a1, 0, 10), getOp(1, empty, 1, 2)}, true},
+		// once one read has seen the write, a later read can't miss it
+		{"reads disagree", []Op{putOp(0, a1, 0, 10), getOp(1, a1, 1, 2), getOp(2, empty, 3, 4)}, false},
+		{"concurrent writes", []Op{putOp(0, a1, 0, 10), putOp(1, a2, 0, 10), getOp(2, a1, 11, 12), getOp(2, a1, 13, 14)}, true},
+		{"concurrent writes flip", []Op{putOp(0, a1, 0, 10), putOp(1, a2, 0, 10), getOp(2, a1, 11, 12), getOp(2, a2, 13, 14)}, false},
+		{"unknown write applied late", []Op{putOp(0, a1, 0, unknown), getOp(1, empty, 1, 2), getOp(1, a1, 100, 101)}, true},
+		{"unknown write never applied", []Op{putOp(0, a1, 0, unknown), getOp(1, empty, 100, 101)}, true},
+		{"unknown write undone", []Op{putOp(0, a1, 0, unknown), getOp(1, a1, 1, 2), getOp(1, empty, 3, 4)}, false},
+		{"delete", []Op{putOp(0, a1, 0, 1), delOp(1, 2, 10), getOp(0, a1, 3, 4), getOp(0, empty, 5, 6), getOp(0, empty, 11, 12)}, true},
+	} {
+		result := Check(c.history)
+		if result.Ok != c.ok {
+			t.Errorf("%s : expected ok %v, got %s", c.name, c.ok, result)
+		}
+	}
+}
+
+func TestCheckRowsIndependent(t *testing.T) {
+	history := []Op{
+		{0, PUT, "r1", map[string]string{"a": "1"}, 0, 1},
+		{1, GET, "r2", map[string]string{}, 2, 3},
+		{1, GET, "r1", map[string]string{}, 4, 5},
+	}
+	result := Check(history)
+	if result.Ok || result.Row != "r1" || len(result.Ops) != 2 {
+		t.Fatalf("Expected row r1 to fail, got %s", result)
+	}
+}
@@ -0,0 +1,220 @@
+package lincheck
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jbooth/merchdb/clustertest"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// the table clients work on
+const table = "lincheck"
+
+// the columns clients write, each put writes one or both
+var columns = []string{"a", "b"}
+
+type Options struct {
+	// concurrent clients, defaults to 5
+	Clients int
+	// rows the clients spread their ops over, defaults to 3.  Fewer rows means
+	// more contention.
+	Rows int
+	// how long to run for, defaults to 10s
+	Duration time.Duration
+	// how long faults last and the gaps between them, defaults to 1s.  Negative
+	// runs without faults.
+	FaultInterval time.Duration
+	// how long a client waits for a response before giving up on an op,
+	// defaults to 5s
+	OpTimeout time.Duration
+	// seeds the clients' and the nemesis' choices, for repeating a run
+	Seed int64
+}
+
+func (opts *Options) defaults() {
+	if opts.Clients == 0 {
+		opts.Clients = 5
+	}
+	if opts.Rows == 0 {
+		opts.Rows = 3
+	}
+	if opts.Duration == 0 {
+		opts.Duration = 10 * time.Second
+	}
+	if opts.FaultInterval == 0 {
+		opts.FaultInterval = 1 * time.Second
+	}
+	if opts.OpTimeout == 0 {
+		opts.OpTimeout = 5 * time.Second
+	}
+}
+
+// the parts of merchdb's responses we check
+type response struct {
+	Ok   bool
+	Cols map[string]string
+}
+
+type recorder struct {
+	start time.Time
+	lock  *sync.Mutex
+	ops   []Op
+}
+
+func (r *recorder) now() time.Duration {
+	return time.Since(r.start)
+}
+
+func (r *recorder) record(op Op) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.ops = append(r.ops, op)
+}
+
+// Run runs clients against c for opts.Duration while a nemesis kills,
+// restarts, partitions and heals its nodes, and returns the history they
+// recorded for Check.  Every node is up and connected again when it returns.
+// Clients read with /getRow, which goes through raft, and write with /putCols
+// and /delRow, sending each op to a random node.
+func Run(ctx context.Context, c *clustertest.Cluster, opts Options) ([]Op, error) {
+	opts.defaults()
+	ctx, cancel := context.WithTimeout(ctx, opts.Duration)
+	defer cancel()
+	rec := &recorder{start: time.Now(), lock: &sync.Mutex{}, ops: make([]Op, 0)}
+	// keep connections from being reused across faults, a stale one would only time out
+	client := &http.Client{Timeout: opts.OpTimeout, Transport: &http.Transport{DisableKeepAlives: true}}
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < opts.Clients; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			runClient(ctx, c, client, rec, id, rand.New(rand.NewSource(opts.Seed+int64(id))), opts.Rows)
+		}(i)
+	}
+	var err error
+	if opts.FaultInterval > 0 {
+		err = nemesis(ctx, c, rand.New(rand.NewSource(opts.Seed-1)), opts.FaultInterval)
+	}
+	wg.Wait()
+	return rec.ops, err
+}
+
+func runClient(ctx context.Context, c *clustertest.Cluster, client *http.Client, rec *recorder, id int, rnd *rand.Rand, rows int) {
+	for seq := 0; ctx.Err() == nil; seq++ {
+		op := Op{Client: id, Row: fmt.Sprintf("row%d", rnd.Intn(rows))}
+		path := "/getRow/" + table + "/" + op.Row
+		switch n := rnd.Intn(10); {
+		case n < 5:
+			op.Kind = GET
+		case n < 9:
+			op.Kind = PUT
+			op.Cols = make(map[string]string)
+			params := url.Values{}
+			for _, col := range columns {
+				if len(op.Cols) == 0 || rnd.Intn(2) == 0 {
+					// values are unique so a read shows which write it saw
+					op.Cols[col] = fmt.Sprintf("%d-%d", id, seq)
+					params.Set(col, op.Cols[col])
+				}
+			}
+			path = "/putCols/" + table + "/" + op.Row + "?" + params.Encode()
+		default:
+			op.Kind = DEL
+			path = "/delRow/" + table + "/" + op.Row
+		}
+		node := c.Nodes[rnd.Intn(len(c.Nodes))]
+		op.Call = rec.now()
+		resp, err := get(client, node.URL(path))
+		op.Return = rec.now()
+
+		var dialErr *net.OpError
+		switch {
+		case errors.As(err, &dialErr) && dialErr.Op == "dial":
+			// never reached the node
+			continue
+		case err != nil || !resp.Ok:
+			if op.Kind == GET {
+				// a failed read tells us nothing
+				continue
+			}
+			op.Return = Unknown
+		case op.Kind == GET:
+			op.Cols = resp.Cols
+		}
+		rec.record(op)
+	}
+}
+
+func get(client *http.Client, url string) (*response, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	ret := &response{}
+	if resp.StatusCode != 200 {
+		return ret, nil
+	}
+	err = json.NewDecoder(resp.Body).Decode(ret)
+	return ret, err
+}
+
+// alternates between injecting a fault and healing the cluster until ctx is done.
+// Heals on the way out too, so a failed fault doesn't leave nodes down or cut off.
+func nemesis(ctx context.Context, c *clustertest.Cluster, rnd *rand.Rand, interval time.Duration) (err error) {
+	defer func() {
+		healErr := heal(c)
+		if err == nil {
+			err = healErr
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+		switch rnd.Intn(3) {
+		case 0:
+			err = c.Kill(rnd.Intn(len(c.Nodes)))
+		case 1:
+			c.Isolate(rnd.Intn(len(c.Nodes)))
+		default:
+			// a random split that leaves a majority on one side
+			order := rnd.Perm(len(c.Nodes))
+			split := len(c.Nodes)/2 + 1
+			c.Partition(order[:split], order[split:])
+		}
+		if err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(interval):
+		}
+		err = heal(c)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// reconnects every node and restarts any that are down
+func heal(c *clustertest.Cluster) error {
+	c.Heal()
+	for i := range c.Nodes {
+		err := c.Restart(i)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package lincheck
+
+import (
+	"context"
+	"github.com/jbooth/merchdb"
+	"github.com/jbooth/merchdb/clustertest"
+	"testing"
+	"time"
+)
+
+func TestLinearizable(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping cluster test in short mode")
+	}
+	c, err := clustertest.Start(clustertest.Options{
+		Config: func(node int, sc *merchdb.ServerConfig) {
+			sc.CommandTimeout = 2 * time.Second
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	err = c.WaitReady(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seed := time.Now().UnixNano()
+	t.Logf("Seed %d", seed)
+	history, err := Run(context.Background(), c, Options{Duration: 10 * time.Second, OpTimeout: 3 * time.Second, Seed: seed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	acked := 0
+	for _, op := range history {
+		if op.Kind != GET && op.Return != Unknown {
+			acked++
+		}
+	}
+	if acked == 0 {
+		t.Fatal("No writes succeeded")
+	}
+	t.Logf("Checking %d ops, %d acknowledged writes", len(history), acked)
+	result := Check(history)
+	if !result.Ok {
+		t.Fatal(result)
+	}
+}
@@ -0,0 +1,50 @@
+package merchdb
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// web addresses with this prefix are unix domain socket paths, like unix:/var/run/merchdb.sock
+const unixAddrPrefix = "unix:"
+
+// WithListener serves the web API on l instead of binding webAddr, for tests
+// and embedding.  The server closes l when it's closed.
+func WithListener(l net.Listener) Option {
+	return func(c *config) {
+		c.listener = l
+	}
+}
+
+func isUnixAddr(webAddr string) bool {
+	return strings.HasPrefix(webAddr, unixAddrPrefix)
+}
+
+// binds webAddr, which is a unix socket path with unixAddrPrefix or else a TCP
+// host:port.  TCP addresses listen on IPv4 or IPv6 depending on the host, with
+// an empty host or [::] listening on both where the OS allows it.
+func listenWeb(webAddr string) (net.Listener, error) {
+	if isUnixAddr(webAddr) {
+		path := strings.TrimPrefix(webAddr, unixAddrPrefix)
+		// a socket left behind by an unclean exit would make the bind fail
+		if st, err := os.Stat(path); err == nil && st.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't bind to unix socket %s : %s", path, err)
+		}
+		return l, nil
+	}
+	httpAddr, err := net.ResolveTCPAddr("tcp", webAddr)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't resolve webAddr %s : %s", webAddr, err)
+	}
+	l, err := net.ListenTCP("tcp", httpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't bind to httpAddr %s : %s", httpAddr, err)
+	}
+	return l, nil
+}
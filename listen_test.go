@@ -0,0 +1,45 @@
+package merchdb
+
+import (
+	"net"
+	"os"
+	"testing"
+)
+
+func TestListenWeb(t *testing.T) {
+	sock := "/tmp/merchdbListenTest.sock"
+	os.Remove(sock)
+	for i := 0; i < 2; i++ {
+		// the second time around the socket file is stale, as if we'd crashed
+		l, err := listenWeb(unixAddrPrefix + sock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if i == 0 {
+			l.(*net.UnixListener).SetUnlinkOnClose(false)
+		}
+		l.Close()
+	}
+
+	for _, addr := range []string{"127.0.0.1:0", "[::1]:0", ":0"} {
+		l, err := listenWeb(addr)
+		if err != nil {
+			if addr == "[::1]:0" {
+				t.Logf("Skipping IPv6 loopback : %s", err)
+				continue
+			}
+			t.Fatal(err)
+		}
+		l.Close()
+	}
+
+	_, err := listenWeb("not an address")
+	if err == nil {
+		t.Fatal("Expected error for bad address")
+	}
+}
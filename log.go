@@ -0,0 +1,185 @@
+package merchdb
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/jbooth/flotilla"
+	mdb "github.com/jbooth/gomdb"
+	ops "github.com/jbooth/merchdb/ops"
+	"github.com/jbooth/merchdb/trace"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// request IDs are taken from this header if the client sets it, and echoed back on the response
+const requestIDHeader = "X-Request-Id"
+
+type logCtxKey struct{}
+
+type requestIDCtxKey struct{}
+
+// WithLogger sets the logger for the server and its ops.  Defaults to text
+// output on stderr at info level, op and request traces are logged at debug.
+func WithLogger(lg *slog.Logger) Option {
+	return func(c *config) {
+		c.logger = lg
+	}
+}
+
+func defaultLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(os.Stderr, nil)).With("component", "merchdb")
+}
+
+// returns the logger for a request, tagged with its request id
+func (s *Server) reqLog(r *http.Request) *slog.Logger {
+	return s.ctxLog(r.Context())
+}
+
+// returns the logger for the request ctx belongs to, or the server's if it's not from one
+func (s *Server) ctxLog(ctx context.Context) *slog.Logger {
+	if lg, ok := ctx.Value(logCtxKey{}).(*slog.Logger); ok {
+		return lg
+	}
+	return s.lg
+}
+
+// returns the id of the request ctx belongs to, empty if it's not from one
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDCtxKey{}).(string)
+	return id
+}
+
+// assigns the request an id, echoes it on the response and attaches a logger carrying it and the trace id
+func (s *Server) withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get(requestIDHeader)
+	if id == "" {
+		id = newRequestID()
+	}
+	w.Header().Set(requestIDHeader, id)
+	lg := s.lg.With("request_id", id)
+	if span := trace.FromContext(r.Context()); span != nil {
+		lg = lg.With("trace_id", span.Context.TraceID.String())
+	}
+	ctx := context.WithValue(r.Context(), requestIDCtxKey{}, id)
+	return r.WithContext(context.WithValue(ctx, logCtxKey{}, lg))
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// server errors are worth a warning, everything else is a trace
+func (s *Server) logRequest(r *http.Request, handler string, status int, elapsed time.Duration) {
+	level := slog.LevelDebug
+	if status >= http.StatusInternalServerError {
+		level = slog.LevelWarn
+	}
+	s.reqLog(r).Log(r.Context(), level, "request",
+		"method", r.Method, "path", r.URL.Path, "handler", handler, "status", status, "latency", elapsed)
+}
+
+// Like tracing, ops run without a context, so commands submitted here leave the
+// request id keyed by op and args for the local apply's log lines to pick up.
+type opLog struct {
+	lg      *slog.Logger
+	lock    *sync.Mutex
+	pending map[string][]string
+}
+
+func newOpLog(lg *slog.Logger) *opLog {
+	return &opLog{lg, &sync.Mutex{}, make(map[string][]string)}
+}
+
+// leaves id for the apply of a command with key, does nothing on a nil opLog
+func (l *opLog) expect(key string, id string) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.pending[key] = append(l.pending[key], id)
+}
+
+// takes the oldest request id waiting on key, empty if there's none
+func (l *opLog) claim(key string) string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	waiting := l.pending[key]
+	if len(waiting) == 0 {
+		return ""
+	}
+	l.forgetLocked(key, waiting[0])
+	return waiting[0]
+}
+
+// drops id if the apply never claimed it, does nothing on a nil opLog
+func (l *opLog) forget(key string, id string) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.forgetLocked(key, id)
+}
+
+func (l *opLog) forgetLocked(key string, id string) {
+	waiting := l.pending[key]
+	for i, w := range waiting {
+		if w == id {
+			waiting = append(waiting[:i], waiting[i+1:]...)
+			break
+		}
+	}
+	if len(waiting) == 0 {
+		delete(l.pending, key)
+	} else {
+		l.pending[key] = waiting
+	}
+}
+
+// wraps each op so that it's logged when applied
+func (l *opLog) logOps(cmds map[string]flotilla.Command) map[string]flotilla.Command {
+	ret := make(map[string]flotilla.Command, len(cmds))
+	for name, cmd := range cmds {
+		ret[name] = l.logOp(name, cmd)
+	}
+	return ret
+}
+
+func (l *opLog) logOp(name string, cmd flotilla.Command) flotilla.Command {
+	return func(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+		lg := l.lg
+		if id := l.claim(commandKey(name, args)); id != "" {
+			lg = lg.With("request_id", id)
+		}
+		ctx := context.Background()
+		if lg.Enabled(ctx, slog.LevelDebug) {
+			lg.Debug("applying op", "op", name, "args", printableArgs(args))
+		}
+		start := time.Now()
+		ret, err := cmd(args, txn)
+		elapsed := time.Since(start)
+		if err != nil {
+			lg.Warn("op failed", "op", name, "table", ops.OpTable(name, args), "latency", elapsed, "err", err)
+		} else {
+			lg.Debug("applied op", "op", name, "table", ops.OpTable(name, args), "latency", elapsed)
+		}
+		return ret, err
+	}
+}
+
+// args are mostly text, quote them so binary ones don't mangle the output
+func printableArgs(args [][]byte) []string {
+	ret := make([]string, len(args))
+	for i, a := range args {
+		ret[i] = strconv.Quote(string(a))
+	}
+	return ret
+}
@@ -0,0 +1,114 @@
+package merchdb
+
+import (
+	"bytes"
+	"context"
+	"github.com/jbooth/flotilla"
+	ops "github.com/jbooth/merchdb/ops"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a buffer shared by the test and the server's loggers
+type syncBuffer struct {
+	buf  *bytes.Buffer
+	lock *sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+// returns what's been logged since the last call
+func (b *syncBuffer) take() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	ret := b.buf.String()
+	b.buf.Reset()
+	return ret
+}
+
+func TestRequestLogs(t *testing.T) {
+	out := &syncBuffer{&bytes.Buffer{}, &sync.Mutex{}}
+	lg := slog.New(slog.NewTextHandler(out, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	db := newLocalDB(t, "/tmp/merchdbRequestLogsTest")
+	defer db.Close()
+	s := &Server{
+		flotilla: db,
+		lg:       lg,
+		metrics:  newServerMetrics(),
+		tracing:  newServerTracer(nil),
+		oplog:    newOpLog(lg),
+		closed:   make(chan struct{}),
+	}
+	db.ops = s.oplog.logOps(localOps)
+	h := s.instrumented("/putCols/{table}/{row}", func(w http.ResponseWriter, r *http.Request) {
+		result := s.command(r.Context(), ops.PUTCOLS, byteArgs("row1 table1 col1 val1"))
+		writeCommandStatus(w, result.Err)
+	})
+	put := func(id string) string {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/putCols/table1/row1?col1=val1", nil)
+		if id != "" {
+			r.Header.Set(requestIDHeader, id)
+		}
+		h(w, r)
+		if w.Code != 200 {
+			t.Fatalf("Unexpected status %d", w.Code)
+		}
+		return w.Header().Get(requestIDHeader)
+	}
+	// the op's lines carry the id of the request that submitted it, as well as the request's own
+	expectLines := func(logged string, id string) {
+		for _, line := range []string{
+			`level=DEBUG msg="applying op" request_id=` + id + ` op=PutCols args="[\"row1\" \"table1\" \"col1\" \"val1\"]"`,
+			`level=DEBUG msg="applied op" request_id=` + id + ` op=PutCols table=table1 latency=`,
+			`level=DEBUG msg=request request_id=` + id + ` method=GET path=/putCols/table1/row1 handler=/putCols/{table}/{row} status=200 latency=`,
+		} {
+			if !strings.Contains(logged, line) {
+				t.Fatalf("Expected %q in the logs : %s", line, logged)
+			}
+		}
+	}
+
+	if id := put("client-1"); id != "client-1" {
+		t.Fatalf("Expected the client's request id echoed, got %q", id)
+	}
+	expectLines(out.take(), "client-1")
+	id := put("")
+	if !regexp.MustCompile(`^[0-9a-f]{16}$`).MatchString(id) {
+		t.Fatalf("Expected a generated request id, got %q", id)
+	}
+	expectLines(out.take(), id)
+
+	// commands that weren't submitted for a request are logged without one
+	result := s.command(context.Background(), ops.PUTCOLS, byteArgs("row1 table1 col1 val2"))
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	if logged := out.take(); strings.Contains(logged, "request_id") || !strings.Contains(logged, `msg="applied op" op=PutCols`) {
+		t.Fatalf("Expected the op logged without a request id : %s", logged)
+	}
+
+	db.stall = make(chan chan flotilla.Result, 1)
+	r := s.withRequestID(httptest.NewRecorder(), httptest.NewRequest("GET", "/putCols/table1/row1", nil))
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Millisecond)
+	defer cancel()
+	result = s.command(ctx, ops.PUTCOLS, byteArgs("row1 table1 col1 val3"))
+	(<-db.stall) <- flotilla.Result{}
+	if result.Err != ErrCommandTimeout {
+		t.Fatalf("Expected a timeout, got %v", result.Err)
+	}
+	line := `level=WARN msg="Timed out waiting for command" request_id=` + requestID(r.Context()) + ` op=PutCols table=table1 latency=`
+	if logged := out.take(); !strings.Contains(logged, line) {
+		t.Fatalf("Expected %q in the logs : %s", line, logged)
+	}
+}
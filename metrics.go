@@ -0,0 +1,182 @@
+package merchdb
+
+import (
+	"github.com/jbooth/flotilla"
+	mdb "github.com/jbooth/gomdb"
+	"github.com/jbooth/merchdb/metrics"
+	ops "github.com/jbooth/merchdb/ops"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type serverMetrics struct {
+	registry      *metrics.Registry
+	ops           *metrics.Counter
+	opLatency     *metrics.Histogram
+	responses     *metrics.Counter
+	httpLatency   *metrics.Histogram
+	commitLatency *metrics.Histogram
+	rejected      *metrics.Counter
+	batchSize     *metrics.Histogram
+	wireRequests  *metrics.Counter
+	wireLatency   *metrics.Histogram
+}
+
+func newServerMetrics() *serverMetrics {
+	r := metrics.NewRegistry()
+	return &serverMetrics{
+		registry: r,
+		ops: r.NewCounter("merchdb_ops_total",
+			"Ops applied to this node's state machine, by op name and result.", "op", "result"),
+		opLatency: r.NewHistogram("merchdb_op_duration_seconds",
+			"Time to apply an op to this node's state machine, including commit.", metrics.LatencyBuckets, "op"),
+		responses: r.NewCounter("merchdb_http_responses_total",
+			"HTTP responses by handler and status code.", "handler", "code"),
+		httpLatency: r.NewHistogram("merchdb_http_duration_seconds",
+			"Time to serve HTTP requests by handler.", metrics.LatencyBuckets, "handler"),
+		commitLatency: r.NewHistogram("merchdb_raft_commit_duration_seconds",
+			"Time from submitting a command to flotilla until its result is available, by op name.", metrics.LatencyBuckets, "op"),
+		rejected: r.NewCounter("merchdb_commands_rejected_total",
+			"Commands turned away because too many were in flight, or that timed out waiting on raft.", "op", "reason"),
+		batchSize: r.NewHistogram("merchdb_write_batch_size",
+			"Writes coalesced into each BatchPutCols command.", []float64{2, 4, 8, 16, 32, 64, 128, 256, 512}),
+		wireRequests: r.NewCounter("merchdb_wire_requests_total",
+			"Wire protocol requests by op and response status.", "op", "status"),
+		wireLatency: r.NewHistogram("merchdb_wire_duration_seconds",
+			"Time to answer wire protocol requests by op.", metrics.LatencyBuckets, "op"),
+	}
+}
+
+// wraps each op so that it's counted and timed when applied
+func (m *serverMetrics) instrumentOps(cmds map[string]flotilla.Command) map[string]flotilla.Command {
+	ret := make(map[string]flotilla.Command, len(cmds))
+	for name, cmd := range cmds {
+		ret[name] = m.instrumentOp(name, cmd)
+	}
+	return ret
+}
+
+func (m *serverMetrics) instrumentOp(name string, cmd flotilla.Command) flotilla.Command {
+	return func(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+		start := time.Now()
+		ret, err := cmd(args, txn)
+		m.opLatency.Observe(time.Since(start).Seconds(), name)
+		result := "ok"
+		if err != nil {
+			result = "error"
+		}
+		m.ops.Inc(name, result)
+		return ret, err
+	}
+}
+
+// records status codes so we can count them
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// keeps streaming handlers working through the wrapper
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// wraps a handler to count its responses, time, log and trace it, under the name it's registered at
+func (s *Server) instrumented(name string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r, span := s.startRequestSpan(r, name)
+		r = s.withRequestID(w, r)
+		rec := &statusRecorder{w, http.StatusOK}
+		h(rec, r)
+		elapsed := time.Since(start)
+		s.metrics.httpLatency.Observe(elapsed.Seconds(), name)
+		s.metrics.responses.Inc(name, strconv.Itoa(rec.status))
+		s.logRequest(r, name, rec.status, elapsed)
+		finishRequestSpan(span, rec.status)
+	}
+}
+
+// registers gauges computed from our copy of the database at scrape time
+func (s *Server) registerStorageMetrics() {
+	r := s.metrics.registry
+	// entries is the number of columns, rows aren't cheap to count
+	statGauges := []struct {
+		name string
+		help string
+		val  func(*mdb.Stat) uint64
+	}{
+		{"merchdb_mdb_entries", "Entries in each mdb dbi. For tables and families this is the number of columns.",
+			func(st *mdb.Stat) uint64 { return st.Entries }},
+		{"merchdb_mdb_depth", "B-tree depth of each mdb dbi.",
+			func(st *mdb.Stat) uint64 { return uint64(st.Depth) }},
+		{"merchdb_mdb_branch_pages", "Branch pages in each mdb dbi.",
+			func(st *mdb.Stat) uint64 { return st.BranchPages }},
+		{"merchdb_mdb_leaf_pages", "Leaf pages in each mdb dbi.",
+			func(st *mdb.Stat) uint64 { return st.LeafPages }},
+		{"merchdb_mdb_overflow_pages", "Overflow pages in each mdb dbi.",
+			func(st *mdb.Stat) uint64 { return st.OverflowPages }},
+	}
+	for _, g := range statGauges {
+		val := g.val
+		r.NewGaugeFunc(g.name, g.help, func() ([]metrics.Sample, error) {
+			stats, err := s.dbiStats()
+			if err != nil {
+				return nil, err
+			}
+			samples := make([]metrics.Sample, 0, len(stats))
+			for name, st := range stats {
+				samples = append(samples, metrics.Sample{LabelValues: []string{name}, Value: float64(val(st))})
+			}
+			return samples, nil
+		}, "dbi")
+	}
+
+	// flotilla.DefaultOpsDB doesn't expose its mdb env, so there are no gauges for the map
+	// size or reader slots, which only the env reports.  Space used is summed from the
+	// dbis' pages instead, and the data dir's size bounds the mdb file along with raft's logs.
+	r.NewGaugeFunc("merchdb_mdb_used_bytes", "Bytes in the pages of every mdb dbi, not counting free pages.", func() ([]metrics.Sample, error) {
+		stats, err := s.dbiStats()
+		if err != nil {
+			return nil, err
+		}
+		var used uint64 = 0
+		for _, st := range stats {
+			used += (st.BranchPages + st.LeafPages + st.OverflowPages) * uint64(st.PSize)
+		}
+		return []metrics.Sample{{Value: float64(used)}}, nil
+	})
+	r.NewGaugeFunc("merchdb_data_dir_bytes", "Bytes of files in the data dir, including the mdb file and raft's logs and snapshots.", func() ([]metrics.Sample, error) {
+		size, err := dirSize(s.dataDir)
+		if err != nil {
+			return nil, err
+		}
+		return []metrics.Sample{{Value: float64(size)}}, nil
+	})
+}
+
+func (s *Server) dbiStats() (map[string]*mdb.Stat, error) {
+	txn, err := s.flotilla.Read()
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Abort()
+	return ops.DBIStats(txn)
+}
+
+// url is /metrics, in the prometheus text format
+func (s *Server) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "text/plain; version=0.0.4")
+	err := s.metrics.registry.Write(w)
+	if err != nil {
+		s.reqLog(r).Error("Error writing metrics", "err", err)
+	}
+}
@@ -0,0 +1,242 @@
+// Package metrics implements counters, histograms and gauges that render in
+// the prometheus text exposition format, without pulling in a client library.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// default histogram buckets for latencies in seconds
+var LatencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type collector interface {
+	write(w *bufio.Writer) error
+}
+
+// Registry holds metrics and renders them in registration order
+type Registry struct {
+	lock       *sync.Mutex
+	collectors []collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{&sync.Mutex{}, nil}
+}
+
+func (r *Registry) register(c collector) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// Write renders every registered metric in the prometheus text format
+func (r *Registry) Write(w io.Writer) error {
+	r.lock.Lock()
+	collectors := append([]collector{}, r.collectors...)
+	r.lock.Unlock()
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		err := c.write(bw)
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// name, help and label names shared by all metric types
+type desc struct {
+	name       string
+	help       string
+	labelNames []string
+}
+
+func (d desc) header(w *bufio.Writer, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, escapeHelp(d.help), d.name, typ)
+}
+
+// renders {k1="v1",k2="v2"} for the provided label values plus any extra pairs
+func (d desc) labels(values []string, extra ...string) string {
+	if len(values) != len(d.labelNames) {
+		panic(fmt.Sprintf("metric %s has labels %v, got values %v", d.name, d.labelNames, values))
+	}
+	pairs := make([]string, 0, len(values)+len(extra)/2)
+	for i, v := range values {
+		pairs = append(pairs, d.labelNames[i]+"="+strconv.Quote(v))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+strconv.Quote(extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeHelp(help string) string {
+	return strings.NewReplacer("\\", `\\`, "\n", `\n`).Replace(help)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// label values joined into a map key
+func seriesKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// Counter is a monotonically increasing value per set of label values
+type Counter struct {
+	desc
+	lock   *sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	labelValues []string
+	val         float64
+}
+
+func (r *Registry) NewCounter(name string, help string, labelNames ...string) *Counter {
+	c := &Counter{desc{name, help, labelNames}, &sync.Mutex{}, make(map[string]*counterSeries)}
+	r.register(c)
+	return c
+}
+
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key := seriesKey(labelValues)
+	s, ok := c.series[key]
+	if !ok {
+		s = &counterSeries{append([]string{}, labelValues...), 0}
+		c.series[key] = s
+	}
+	s.val += delta
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) write(w *bufio.Writer) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.header(w, "counter")
+	keys := make([]string, 0, len(c.series))
+	for k := range c.series {
+		keys = append(keys, k)
+	}
+	for _, key := range sortedKeys(keys) {
+		s := c.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labels(s.labelValues), formatFloat(s.val))
+	}
+	return nil
+}
+
+// Histogram counts observations into cumulative buckets per set of label values
+type Histogram struct {
+	desc
+	buckets []float64
+	lock    *sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+// buckets are upper bounds and must be sorted ascending, +Inf is added automatically
+func (r *Registry) NewHistogram(name string, help string, buckets []float64, labelNames ...string) *Histogram {
+	h := &Histogram{desc{name, help, labelNames}, buckets, &sync.Mutex{}, make(map[string]*histogramSeries)}
+	r.register(h)
+	return h
+}
+
+func (h *Histogram) Observe(val float64, labelValues ...string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	key := seriesKey(labelValues)
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{append([]string{}, labelValues...), make([]uint64, len(h.buckets)), 0, 0}
+		h.series[key] = s
+	}
+	for i, upper := range h.buckets {
+		if val <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += val
+}
+
+func (h *Histogram) write(w *bufio.Writer) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.header(w, "histogram")
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	for _, key := range sortedKeys(keys) {
+		s := h.series[key]
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labels(s.labelValues, "le", formatFloat(upper)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labels(s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labels(s.labelValues), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labels(s.labelValues), s.count)
+	}
+	return nil
+}
+
+// Sample is a single gauge value reported by a GaugeFunc
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// GaugeFunc reports values computed when metrics are rendered
+type GaugeFunc struct {
+	desc
+	collect func() ([]Sample, error)
+}
+
+// collect is called on every render, if it returns an error the gauge is left out
+func (r *Registry) NewGaugeFunc(name string, help string, collect func() ([]Sample, error), labelNames ...string) *GaugeFunc {
+	g := &GaugeFunc{desc{name, help, labelNames}, collect}
+	r.register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) error {
+	samples, err := g.collect()
+	if err != nil {
+		return nil
+	}
+	g.header(w, "gauge")
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.labels(s.LabelValues), formatFloat(s.Value))
+	}
+	return nil
+}
+
+func sortedKeys(keys []string) []string {
+	sort.Strings(keys)
+	return keys
+}
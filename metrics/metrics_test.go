@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("requests_total", "Requests served.", "handler", "code")
+	h := r.NewHistogram("latency_seconds", "Request latency.", []float64{0.1, 1}, "op")
+	r.NewGaugeFunc("entries", "Entries per table.", func() ([]Sample, error) {
+		return []Sample{{[]string{"t1"}, 3}}, nil
+	}, "table")
+	r.NewGaugeFunc("broken", "Fails to collect.", func() ([]Sample, error) {
+		return nil, fmt.Errorf("no data")
+	})
+
+	c.Inc("/getRow/", "200")
+	c.Inc("/getRow/", "200")
+	c.Inc("/putCols/", "500")
+	h.Observe(0.05, "PutCols")
+	h.Observe(0.5, "PutCols")
+	h.Observe(5, "PutCols")
+
+	out := &bytes.Buffer{}
+	err := r.Write(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{handler="/getRow/",code="200"} 2
+requests_total{handler="/putCols/",code="500"} 1
+# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{op="PutCols",le="0.1"} 1
+latency_seconds_bucket{op="PutCols",le="1"} 2
+latency_seconds_bucket{op="PutCols",le="+Inf"} 3
+latency_seconds_sum{op="PutCols"} 5.55
+latency_seconds_count{op="PutCols"} 3
+# HELP entries Entries per table.
+# TYPE entries gauge
+entries{table="t1"} 3
+`
+	if out.String() != expected {
+		t.Fatalf("Expected\n%s\ngot\n%s", expected, out.String())
+	}
+}
@@ -0,0 +1,39 @@
+package merchdb
+
+import (
+	"context"
+	ops "github.com/jbooth/merchdb/ops"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// the storage gauges have to work with a flotilla that only gives us transactions
+func TestStorageMetrics(t *testing.T) {
+	dataDir := "/tmp/merchdbStorageMetricsTest"
+	s := &Server{
+		flotilla: newLocalDB(t, dataDir),
+		dataDir:  dataDir,
+		lg:       defaultLogger(),
+		metrics:  newServerMetrics(),
+		tracing:  newServerTracer(nil),
+		closed:   make(chan struct{}),
+	}
+	defer s.flotilla.Close()
+	s.registerStorageMetrics()
+	result := s.command(context.Background(), ops.PUTCOLS, byteArgs("row1 table1 col1 val1"))
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	w := httptest.NewRecorder()
+	s.HandleMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, line := range []string{`merchdb_mdb_entries{dbi="table1"} 1`, "merchdb_mdb_used_bytes ", "merchdb_data_dir_bytes "} {
+		if !strings.Contains(body, line) {
+			t.Fatalf("Expected %q in metrics : %s", line, body)
+		}
+	}
+	if strings.Contains(body, "merchdb_mdb_used_bytes 0\n") {
+		t.Fatalf("Expected some used bytes : %s", body)
+	}
+}
@@ -0,0 +1,110 @@
+package merchdb
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/jbooth/merchdb/ops"
+	"net/http"
+	"time"
+)
+
+// how often a node checks whether it's become leader while an old store waits to be converted
+const migrateCheckInterval = 5 * time.Second
+
+// converts a store written in the old key format, see ops.MigrateKeys.  Each
+// command converts one batch and each table can be used again as soon as it's
+// done, so the rest of the store keeps working meanwhile.  Only the leader sends
+// the commands, so if we can't tell who leads nothing happens until an admin
+// calls /admin/migrateKeys on one node.
+func (s *Server) migrateKeys() {
+	for {
+		current, err := s.keysCurrent()
+		if err != nil {
+			s.lg.Error("Error checking key format", "err", err)
+			return
+		}
+		if current {
+			return
+		}
+		l := s.leadership()
+		if l == nil {
+			s.lg.Warn("Tables use the key format from before secondary indexes, call /admin/migrateKeys on one node to convert them")
+			return
+		}
+		if l.IsLeader() {
+			s.convertKeys(l)
+		}
+		select {
+		case <-s.closed:
+			return
+		case <-time.After(migrateCheckInterval):
+		}
+	}
+}
+
+// url is /admin/migrateKeys
+// starts converting a store in the old key format from this node, see migrateKeys.
+// Responds once it's started, tables become usable as they're converted.
+func (s *Server) HandleMigrateKeys(w http.ResponseWriter, r *http.Request) {
+	current, err := s.keysCurrent()
+	if err != nil {
+		returnErr(w, err)
+		return
+	}
+	if !current {
+		go s.convertKeys(nil)
+	}
+	w.Header().Add("Content-Type", "application-json")
+	enc := json.NewEncoder(w)
+	err = enc.Encode(&WriteResponse{true, ""})
+	if err != nil {
+		s.reqLog(r).Error("Error encoding response", "err", err)
+	}
+}
+
+// whether the store is in the current key format
+func (s *Server) keysCurrent() (bool, error) {
+	txn, err := s.flotilla.Read()
+	if err != nil {
+		return false, err
+	}
+	defer txn.Abort()
+	version, err := ops.KeyFormatVersion(txn)
+	return version == ops.KeyFormat, err
+}
+
+// sends MigrateKeys commands until the store is converted or we're closed, or if
+// leader is set until we stop leading.  Does nothing if it's already running here.
+func (s *Server) convertKeys(leader leaderer) {
+	s.migrateLock.Lock()
+	if s.migrating {
+		s.migrateLock.Unlock()
+		return
+	}
+	s.migrating = true
+	s.migrateLock.Unlock()
+	defer func() {
+		s.migrateLock.Lock()
+		s.migrating = false
+		s.migrateLock.Unlock()
+	}()
+	s.lg.Info("Migrating tables to the current key format", "to", ops.KeyFormat)
+	for leader == nil || leader.IsLeader() {
+		result := s.command(context.Background(), ops.MIGRATEKEYS, nil)
+		if result.Err == nil && len(result.Response) == 0 {
+			s.lg.Info("Finished migrating tables to the current key format")
+			return
+		}
+		wait := time.Duration(0)
+		if result.Err != nil {
+			s.lg.Warn("Error migrating key format, retrying", "err", result.Err)
+			wait = registerRetryInterval
+		}
+		select {
+		case <-s.closed:
+			return
+		case <-time.After(wait):
+		}
+	}
+	s.lg.Info("No longer leader, leaving the key format migration to the new one")
+}
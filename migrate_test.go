@@ -0,0 +1,83 @@
+package merchdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	mdb "github.com/jbooth/gomdb"
+	ops "github.com/jbooth/merchdb/ops"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// without a leader to leave it to, nothing is converted until an admin asks one node to
+func TestMigrateKeys(t *testing.T) {
+	db := newLocalDB(t, "/tmp/merchdbMigrateKeysTest")
+	defer db.Close()
+	// a row written in the old format, with padding after the column
+	txn, err := db.env.BeginTxn(nil, uint(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := "t1"
+	dbi, err := txn.DBIOpen(&table, mdb.CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := binary.LittleEndian.AppendUint32(nil, 4)
+	key = append(append(key, "row1col1"...), 0, 0, 0, 0)
+	err = txn.Put(dbi, key, []byte("val1"), uint(0))
+	if err == nil {
+		err = txn.Commit()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		flotilla:    db,
+		lg:          defaultLogger(),
+		metrics:     newServerMetrics(),
+		tracing:     newServerTracer(nil),
+		closed:      make(chan struct{}),
+		migrateLock: &sync.Mutex{},
+	}
+	defer close(s.closed)
+
+	s.migrateKeys()
+	if len(db.commands()) != 0 {
+		t.Fatalf("Expected no commands without a leader, got %v", db.commands())
+	}
+	w := httptest.NewRecorder()
+	s.HandleMigrateKeys(w, httptest.NewRequest("GET", "/admin/migrateKeys", nil))
+	if w.Code != 200 {
+		t.Fatalf("migrateKeys returned %d : %s", w.Code, w.Body.String())
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		current, err := s.keysCurrent()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if current {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Store never converted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	txn, err = s.flotilla.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txn.Abort()
+	encoded, err := ops.ReadRow(txn, "t1", []byte("row1"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := ops.DecodeCols(encoded)
+	if err != nil || fmt.Sprintf("%q", cols) != `["col1" "val1"]` {
+		t.Fatalf("Unexpected row after converting %q %v", cols, err)
+	}
+}
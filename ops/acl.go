@@ -0,0 +1,159 @@
+package ops
+
+import (
+	"fmt"
+	mdb "github.com/jbooth/gomdb"
+	"strings"
+)
+
+// access control lists, granting principals permissions on tables
+// key:  packed (principal, table pattern), see packRowColKey
+// val:  permission name
+const aclMetaTable = "_acls"
+
+// grants to this principal apply to everyone
+const ANY_PRINCIPAL = "*"
+
+// a table pattern ending in this matches every table starting with the rest of it,
+// so "*" alone matches every table and also grants cluster-wide permissions
+const PATTERN_WILDCARD = "*"
+
+// each permission implies the ones below it
+type Perm int
+
+const (
+	PERM_NONE Perm = iota
+	PERM_READ
+	PERM_WRITE
+	PERM_ADMIN
+)
+
+var permNames = []string{"none", "read", "write", "admin"}
+
+func (p Perm) String() string {
+	if p < PERM_NONE || p > PERM_ADMIN {
+		return fmt.Sprintf("Perm(%d)", int(p))
+	}
+	return permNames[p]
+}
+
+func (p Perm) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *Perm) UnmarshalText(text []byte) error {
+	parsed, err := ParsePerm(string(text))
+	*p = parsed
+	return err
+}
+
+func ParsePerm(name string) (Perm, error) {
+	for i, n := range permNames {
+		if n == name {
+			return Perm(i), nil
+		}
+	}
+	return PERM_NONE, invalidf("Unknown permission %q, expected one of %v", name, permNames)
+}
+
+// one grant of a permission to a principal
+type ACLEntry struct {
+	Principal string
+	Pattern   string
+	Perm      Perm
+}
+
+// whether pattern covers table, the empty table is the cluster itself and only
+// matches the bare wildcard
+func patternMatches(pattern string, table string) bool {
+	if !strings.HasSuffix(pattern, PATTERN_WILDCARD) {
+		return table != "" && pattern == table
+	}
+	prefix := strings.TrimSuffix(pattern, PATTERN_WILDCARD)
+	if table == "" {
+		return prefix == ""
+	}
+	return strings.HasPrefix(table, prefix)
+}
+
+// sets a principal's permission on a table pattern, removing the grant if the permission is none
+// args:
+// 0: principal
+// 1: table name, or prefix followed by PATTERN_WILDCARD
+// 2: permission name
+func SetACL(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+	if len(args) != 3 {
+		txn.Abort()
+		return nil, invalidf("SetACL requires principal, pattern and permission, got %d args", len(args))
+	}
+	if len(args[0]) == 0 || len(args[1]) == 0 {
+		txn.Abort()
+		return nil, invalidf("SetACL requires a non-empty principal and pattern")
+	}
+	perm, err := ParsePerm(string(args[2]))
+	if err != nil {
+		txn.Abort()
+		return nil, err
+	}
+	dbi, err := openDBI(txn, aclMetaTable)
+	if err != nil {
+		txn.Abort()
+		return nil, err
+	}
+	key := packRowColKey(rowColKey{args[0], args[1]})
+	if perm == PERM_NONE {
+		err = txn.Del(dbi, key, nil)
+		if err == mdb.NotFound {
+			err = nil
+		}
+	} else {
+		err = txn.Put(dbi, key, []byte(perm.String()), uint(0))
+	}
+	if err != nil {
+		txn.Abort()
+		return nil, err
+	}
+	return nobytes, commit(txn)
+}
+
+// returns every grant, ordered by principal and then pattern
+func ACLs(txn *mdb.Txn) ([]ACLEntry, error) {
+	ret := make([]ACLEntry, 0)
+	metaTable := aclMetaTable
+	dbi, err := txn.DBIOpen(&metaTable, 0)
+	if err == mdb.NotFound {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = forEachEntry(txn, dbi, func(k []byte, v []byte) error {
+		key := splitRowColKey(k)
+		perm, err := ParsePerm(string(v))
+		if err != nil {
+			return err
+		}
+		ret = append(ret, ACLEntry{string(key.rowKey), string(key.colKey), perm})
+		return nil
+	})
+	return ret, err
+}
+
+// returns the highest permission granted to principal on table, either directly
+// or through ANY_PRINCIPAL.  The empty table asks for cluster-wide permissions.
+func Permission(txn *mdb.Txn, principal string, table string) (Perm, error) {
+	acls, err := ACLs(txn)
+	if err != nil {
+		return PERM_NONE, err
+	}
+	perm := PERM_NONE
+	for _, acl := range acls {
+		if acl.Principal != principal && acl.Principal != ANY_PRINCIPAL {
+			continue
+		}
+		if acl.Perm > perm && patternMatches(acl.Pattern, table) {
+			perm = acl.Perm
+		}
+	}
+	return perm, nil
+}
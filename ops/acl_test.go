@@ -0,0 +1,74 @@
+package ops
+
+import (
+	mdb "github.com/jbooth/gomdb"
+	"testing"
+)
+
+func TestACLs(t *testing.T) {
+	env := testEnv("/tmp/merchDbACLTest")
+	defer env.Close()
+
+	for _, grant := range [][]string{
+		{"alice", "orders", "write"},
+		{"alice", "billing_*", "read"},
+		{"bob", "billing_*", "admin"},
+		{"bob", "billing_ledger", "read"},
+		{ANY_PRINCIPAL, "public", "read"},
+		{"root", "*", "admin"},
+		{"carol", "orders", "write"},
+	} {
+		_, err := runOp(env, SetACL, grant...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// none revokes
+	_, err := runOp(env, SetACL, "carol", "orders", "none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = runOp(env, SetACL, "carol", "orders", "superuser")
+	if err == nil {
+		t.Fatal("Expected error for unknown permission")
+	}
+
+	txn, err := env.BeginTxn(nil, mdb.RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txn.Abort()
+	for _, c := range []struct {
+		principal string
+		table     string
+		expected  Perm
+	}{
+		{"alice", "orders", PERM_WRITE},
+		{"alice", "orders2", PERM_NONE},
+		{"alice", "billing_ledger", PERM_READ},
+		{"alice", "public", PERM_READ},
+		{"alice", "", PERM_NONE},
+		// the highest matching grant wins
+		{"bob", "billing_ledger", PERM_ADMIN},
+		{"bob", "billing", PERM_NONE},
+		{"carol", "orders", PERM_NONE},
+		{"root", "anything", PERM_ADMIN},
+		{"root", "", PERM_ADMIN},
+	} {
+		perm, err := Permission(txn, c.principal, c.table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm != c.expected {
+			t.Fatalf("Expected %s for %s on %q, got %s", c.expected, c.principal, c.table, perm)
+		}
+	}
+
+	acls, err := ACLs(txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(acls) != 6 {
+		t.Fatalf("Expected 6 grants, got %v", acls)
+	}
+}
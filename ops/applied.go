@@ -0,0 +1,77 @@
+package ops
+
+import (
+	"encoding/binary"
+	"github.com/jbooth/flotilla"
+	mdb "github.com/jbooth/gomdb"
+)
+
+// Every command that commits bumps a counter in the same transaction, so a backup
+// records exactly which writes it holds and nodes can compare their progress
+// without raft's own indexes, which flotilla doesn't expose.  Commands that abort,
+// like replicated reads and rejected writes, aren't counted.  Every replica that's
+// applied the same commands has the same count.
+//
+// key:  appliedKey
+// val:  8 byte uint64 count
+const appliedMetaTable = "_applied"
+
+var appliedKey = []byte("commands")
+
+// CountApplied wraps each command so that committing it also bumps the count
+// returned by AppliedCommands
+func CountApplied(cmds map[string]flotilla.Command) map[string]flotilla.Command {
+	ret := make(map[string]flotilla.Command, len(cmds))
+	for name, cmd := range cmds {
+		ret[name] = countApplied(cmd)
+	}
+	return ret
+}
+
+func countApplied(cmd flotilla.Command) flotilla.Command {
+	return func(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+		// written before the command runs, if it aborts the count goes with it
+		dbi, err := openDBI(txn, appliedMetaTable)
+		if err != nil {
+			txn.Abort()
+			return nil, err
+		}
+		count, err := appliedCount(txn, dbi)
+		if err != nil {
+			txn.Abort()
+			return nil, err
+		}
+		val := make([]byte, 8)
+		binary.LittleEndian.PutUint64(val, count+1)
+		err = txn.Put(dbi, appliedKey, val, uint(0))
+		if err != nil {
+			txn.Abort()
+			return nil, err
+		}
+		return cmd(args, txn)
+	}
+}
+
+// AppliedCommands returns the number of commands committed to the store as seen by txn
+func AppliedCommands(txn *mdb.Txn) (uint64, error) {
+	metaTable := appliedMetaTable
+	dbi, err := txn.DBIOpen(&metaTable, 0)
+	if err == mdb.NotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return appliedCount(txn, dbi)
+}
+
+func appliedCount(txn *mdb.Txn, dbi mdb.DBI) (uint64, error) {
+	val, err := txn.Get(dbi, appliedKey)
+	if err == mdb.NotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(val), nil
+}
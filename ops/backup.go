@@ -0,0 +1,140 @@
+package ops
+
+import (
+	"fmt"
+	mdb "github.com/jbooth/gomdb"
+	"os"
+)
+
+// minimum map size for environments created by CopyEnv
+const minCopyMapSize = 64 * 1024 * 1024
+
+// CopyEnv writes every dbi visible to txn, including system tables, into a new
+// environment at path.  Since entries are copied rather than pages the copy
+// is compacted, free pages in the source aren't carried over.  Use a read
+// transaction to get a consistent copy while writes continue.
+func CopyEnv(txn *mdb.Txn, path string) error {
+	stats, err := DBIStats(txn)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(stats))
+	// size the new env for the data we're copying, with room to grow
+	var dataSize uint64 = 0
+	for name, stat := range stats {
+		names = append(names, name)
+		dataSize += (stat.BranchPages + stat.LeafPages + stat.OverflowPages) * uint64(stat.PSize)
+	}
+	mapSize := dataSize * 2
+	if mapSize < minCopyMapSize {
+		mapSize = minCopyMapSize
+	}
+
+	err = os.MkdirAll(path, 0755)
+	if err != nil {
+		return err
+	}
+	dst, err := mdb.NewEnv()
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	err = dst.SetMaxDBs(mdb.DBI(len(names) + 1024))
+	if err != nil {
+		return err
+	}
+	err = dst.SetMapSize(mapSize)
+	if err != nil {
+		return err
+	}
+	err = dst.Open(path, uint(0), uint(0644))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		err = copyDBI(txn, name, dst)
+		if err != nil {
+			return fmt.Errorf("Error copying %s : %s", name, err)
+		}
+	}
+	return dst.Sync(1)
+}
+
+// entries copied per write transaction by CopyEnv, so that copying a large dbi
+// doesn't run into mdb's limit on dirty pages in one transaction
+var copyBatchEntries = 10000
+
+// copies a single dbi into dst, committing every copyBatchEntries entries
+func copyDBI(txn *mdb.Txn, name string, dst *mdb.Env) error {
+	srcDbi, err := txn.DBIOpen(&name, 0)
+	if err != nil {
+		return err
+	}
+	var dstTxn *mdb.Txn = nil
+	var dstDbi mdb.DBI
+	copied := 0
+	err = forEachEntry(txn, srcDbi, func(k []byte, v []byte) error {
+		if dstTxn != nil && copied%copyBatchEntries == 0 {
+			err := dstTxn.Commit()
+			dstTxn = nil
+			if err != nil {
+				return err
+			}
+		}
+		if dstTxn == nil {
+			var err error
+			dstTxn, dstDbi, err = beginCopy(dst, name)
+			if err != nil {
+				return err
+			}
+		}
+		copied++
+		return dstTxn.Put(dstDbi, k, v, uint(0))
+	})
+	if err == nil && dstTxn == nil {
+		// still create empty dbis
+		dstTxn, _, err = beginCopy(dst, name)
+	}
+	if err != nil {
+		if dstTxn != nil {
+			dstTxn.Abort()
+		}
+		return err
+	}
+	return dstTxn.Commit()
+}
+
+// starts a write transaction on dst with the named dbi open
+func beginCopy(dst *mdb.Env, name string) (*mdb.Txn, mdb.DBI, error) {
+	dstTxn, err := dst.BeginTxn(nil, uint(0))
+	if err != nil {
+		return nil, 0, err
+	}
+	dstDbi, err := dstTxn.DBIOpen(&name, mdb.CREATE)
+	if err != nil {
+		dstTxn.Abort()
+		return nil, 0, err
+	}
+	return dstTxn, dstDbi, nil
+}
+
+// returns mdb's stats for every dbi in the environment, including system tables
+func DBIStats(txn *mdb.Txn) (map[string]*mdb.Stat, error) {
+	names, err := dbiNames(txn)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]*mdb.Stat, len(names))
+	for _, name := range names {
+		dbiName := name
+		dbi, err := txn.DBIOpen(&dbiName, 0)
+		if err != nil {
+			return nil, err
+		}
+		ret[name], err = txn.Stat(dbi)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
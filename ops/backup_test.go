@@ -0,0 +1,108 @@
+package ops
+
+import (
+	"fmt"
+	mdb "github.com/jbooth/gomdb"
+	"testing"
+)
+
+func TestCopyEnv(t *testing.T) {
+	env := testEnv("/tmp/merchDbCopyEnvTest")
+	for i := 0; i < 10; i++ {
+		_, err := runOp(env, PutCols, fmt.Sprintf("row%d", i), "table", "col", fmt.Sprint(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := runOp(env, SetFamily, "table", "fam", `{"Versions": 2}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// several transactions per dbi
+	defer func(batch int) { copyBatchEntries = batch }(copyBatchEntries)
+	copyBatchEntries = 3
+	txn, err := env.BeginTxn(nil, mdb.RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyPath := "/tmp/merchDbCopyEnvTest/copy"
+	err = CopyEnv(txn, copyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcStats, err := DBIStats(txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn.Abort()
+
+	copied, err := mdb.NewEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied.SetMaxDBs(mdb.DBI(1024))
+	err = copied.Open(copyPath, uint(0), uint(0644))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer copied.Close()
+	txn, err = copied.BeginTxn(nil, mdb.RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txn.Abort()
+	dstStats, err := DBIStats(txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dstStats) != len(srcStats) {
+		t.Fatalf("Expected %d dbis in the copy, got %d", len(srcStats), len(dstStats))
+	}
+	for name, stat := range srcStats {
+		if dstStats[name] == nil || dstStats[name].Entries != stat.Entries {
+			t.Fatalf("Expected %d entries in %s, got %+v", stat.Entries, name, dstStats[name])
+		}
+	}
+	encoded, err := ReadRow(txn, "table", []byte("row7"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := DecodeCols(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cols) != 2 || string(cols[1]) != "7" {
+		t.Fatalf("Unexpected copied row %q", cols)
+	}
+}
+
+func TestAppliedCommands(t *testing.T) {
+	env := testEnv("/tmp/merchDbAppliedCommandsTest")
+	counted := CountApplied(Ops)
+	for _, c := range []struct {
+		op   string
+		args []string
+	}{
+		{PUTCOLS, []string{"row", "table", "col", "val"}},
+		{PUTCOLS, []string{"row", "table", "col"}},
+		{GETROW, []string{"row", "table"}},
+		{DELROW, []string{"row", "table"}},
+		{BARRIER, []string{}},
+	} {
+		runOp(env, counted[c.op], c.args...)
+	}
+	txn, err := env.BeginTxn(nil, mdb.RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txn.Abort()
+	applied, err := AppliedCommands(txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the first put and the delete commit
+	if applied != 2 {
+		t.Fatalf("Expected 2 applied commands, got %d", applied)
+	}
+}
@@ -0,0 +1,108 @@
+package ops
+
+import (
+	"encoding/binary"
+	"fmt"
+	mdb "github.com/jbooth/gomdb"
+)
+
+// BatchPutCols applies many PutCols in one txn, for group commit.  Writes that
+// fail validation are skipped and reported without affecting the others, while
+// an error partway through writing aborts the whole batch.
+// args:
+// for each write, a 4 byte little endian arg count followed by that many PutCols args, see BatchArgs
+// outputs: for each write, a 4 byte little endian length followed by its error message, empty on success
+func BatchPutCols(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+	writes, err := splitBatch(args)
+	if err != nil {
+		txn.Abort()
+		return nil, err
+	}
+	errs := make([]error, len(writes))
+	for i, w := range writes {
+		rowKey, tableName, keyVals, ts, err := parseWriteArgs(w)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		t, err := openTable(txn, tableName)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		err = t.validate(txn, rowKey, keyVals, ts, false)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		// can't undo the columns already written, so this fails everyone
+		err = t.putCols(txn, rowKey, keyVals, ts)
+		if err != nil {
+			txn.Abort()
+			return nil, err
+		}
+	}
+	return packBatchResults(errs), commit(txn)
+}
+
+// packs the args for each write into args for BatchPutCols
+func BatchArgs(writes [][][]byte) [][]byte {
+	ret := make([][]byte, 0)
+	for _, w := range writes {
+		count := make([]byte, 4)
+		binary.LittleEndian.PutUint32(count, uint32(len(w)))
+		ret = append(ret, count)
+		ret = append(ret, w...)
+	}
+	return ret
+}
+
+func splitBatch(args [][]byte) ([][][]byte, error) {
+	writes := make([][][]byte, 0)
+	for len(args) > 0 {
+		if len(args[0]) != 4 {
+			return nil, fmt.Errorf("Malformed batch, expected 4 byte arg count, got %d bytes", len(args[0]))
+		}
+		count := int(binary.LittleEndian.Uint32(args[0]))
+		if count > len(args)-1 {
+			return nil, fmt.Errorf("Malformed batch, write has %d args but only %d remain", count, len(args)-1)
+		}
+		writes = append(writes, args[1:1+count])
+		args = args[1+count:]
+	}
+	return writes, nil
+}
+
+func packBatchResults(errs []error) []byte {
+	ret := make([]byte, 0, 4*len(errs))
+	for _, err := range errs {
+		msg := ""
+		if err != nil {
+			msg = err.Error()
+		}
+		ret = binary.LittleEndian.AppendUint32(ret, uint32(len(msg)))
+		ret = append(ret, msg...)
+	}
+	return ret
+}
+
+// unpacks the response from BatchPutCols into an error for each of its n writes, nil
+// for successes.  Only invalid writes fail on their own, so each is an InvalidError.
+func BatchResults(resp []byte, n int) ([]error, error) {
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		if len(resp) < 4 {
+			return nil, fmt.Errorf("Batch response truncated at write %d of %d", i, n)
+		}
+		msgLen := int(binary.LittleEndian.Uint32(resp))
+		resp = resp[4:]
+		if msgLen > len(resp) {
+			return nil, fmt.Errorf("Batch response truncated in error for write %d", i)
+		}
+		if msgLen > 0 {
+			errs[i] = &InvalidError{string(resp[:msgLen])}
+		}
+		resp = resp[msgLen:]
+	}
+	return errs, nil
+}
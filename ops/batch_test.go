@@ -0,0 +1,61 @@
+package ops
+
+import (
+	mdb "github.com/jbooth/gomdb"
+	"testing"
+)
+
+func TestBatchPutCols(t *testing.T) {
+	env := testEnv("/tmp/merchDbBatchTest")
+
+	_, err := runOp(env, SetSchema, "people", `{"Columns": {"age": {"Type": "int64"}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writes := [][][]byte{
+		{[]byte("row1"), []byte("people"), []byte("age"), []byte("31")},
+		// fails validation, shouldn't stop the others
+		{[]byte("row2"), []byte("people"), []byte("age"), []byte("old")},
+		{[]byte("row3"), []byte("_reserved"), []byte("a"), []byte("b")},
+		{[]byte("row4"), []byte("people"), []byte("age"), []byte("40")},
+	}
+	txn, err := env.BeginTxn(nil, uint(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := BatchPutCols(BatchArgs(writes), txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs, err := BatchResults(resp, len(writes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs[0] != nil || errs[1] == nil || errs[2] == nil || errs[3] != nil {
+		t.Fatalf("Expected only the second and third writes to fail, got %v", errs)
+	}
+
+	txn, err = env.BeginTxn(nil, mdb.RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txn.Abort()
+	tbl, err := openTable(txn, "people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for row, expected := range map[string]string{"row1": "31", "row2": "", "row4": "40"} {
+		val, err := tbl.getCol(txn, []byte(row), []byte("age"), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(val) != expected {
+			t.Fatalf("Expected %q for %s, got %q", expected, row, string(val))
+		}
+	}
+
+	_, err = splitBatch([][]byte{{3, 0, 0, 0}, []byte("row1")})
+	if err == nil {
+		t.Fatal("Expected error for batch with too few args")
+	}
+}
@@ -0,0 +1,164 @@
+package ops
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+)
+
+// encoding for a list of columns, which GetCols and GetRow respond with and the
+// wire protocol carries.  Integers are little endian.
+//
+//	1 byte format version, colsVersion
+//	1 byte flags
+//	4 byte number of columns
+//	for each column, 4 byte key length, 4 byte value length, key, value
+//	if flags has colsFlagChecksum, 4 byte CRC-32C of everything before it
+//
+// It's only ever produced and consumed by running code, never stored, so
+// there's no support for reading older versions.
+const colsVersion byte = 1
+
+const colsFlagChecksum byte = 1
+
+// version, flags and count
+const colsHeaderSize = 6
+
+var colsCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// allocates a new []byte to contain the values in cols, with a checksum
+func colsBytes(cols []colKeyVal) ([]byte, error) {
+	return encodeCols(cols, true)
+}
+
+func encodeCols(cols []colKeyVal, checksum bool) ([]byte, error) {
+	if uint64(len(cols)) > math.MaxUint32 {
+		return nil, fmt.Errorf("Can't encode %d columns, the most is %d", len(cols), uint32(math.MaxUint32))
+	}
+	retLength := colsHeaderSize + (8 * len(cols))
+	for _, keyVal := range cols {
+		if uint64(len(keyVal.k)) > math.MaxUint32 || uint64(len(keyVal.v)) > math.MaxUint32 {
+			return nil, fmt.Errorf("Column %q is too large to encode", keyVal.k)
+		}
+		retLength += len(keyVal.k)
+		retLength += len(keyVal.v)
+	}
+	flags := byte(0)
+	if checksum {
+		flags |= colsFlagChecksum
+		retLength += 4
+	}
+	ret := make([]byte, retLength, retLength)
+	ret[0] = colsVersion
+	ret[1] = flags
+	written := 2
+	// write num records
+	binary.LittleEndian.PutUint32(ret[written:], uint32(len(cols)))
+	written += 4
+	// for each record
+	for _, keyVal := range cols {
+		// key length, val length
+		binary.LittleEndian.PutUint32(ret[written:], uint32(len(keyVal.k)))
+		written += 4
+		binary.LittleEndian.PutUint32(ret[written:], uint32(len(keyVal.v)))
+		written += 4
+		// key, val
+		copy(ret[written:], keyVal.k)
+		written += len(keyVal.k)
+		copy(ret[written:], keyVal.v)
+		written += len(keyVal.v)
+	}
+	if checksum {
+		binary.LittleEndian.PutUint32(ret[written:], crc32.Checksum(ret[:written], colsCRC))
+	}
+	return ret, nil
+}
+
+// wraps byte arrays around the columns encoded in, which are slices of it rather
+// than copies.  Returns an error rather than reading past the end of in, and
+// empty input decodes to no columns.
+func bytesCols(in []byte) ([]colKeyVal, error) {
+	if len(in) == 0 {
+		return []colKeyVal{}, nil
+	}
+	if len(in) < colsHeaderSize {
+		return nil, fmt.Errorf("Column encoding of %d bytes is too short for its header", len(in))
+	}
+	if in[0] != colsVersion {
+		return nil, fmt.Errorf("Unknown column encoding version %d, expected %d", in[0], colsVersion)
+	}
+	flags := in[1]
+	if flags&^colsFlagChecksum != 0 {
+		return nil, fmt.Errorf("Unknown column encoding flags %08b", flags)
+	}
+	if flags&colsFlagChecksum != 0 {
+		if len(in) < colsHeaderSize+4 {
+			return nil, fmt.Errorf("Column encoding of %d bytes is too short for its checksum", len(in))
+		}
+		end := len(in) - 4
+		expected := binary.LittleEndian.Uint32(in[end:])
+		if actual := crc32.Checksum(in[:end], colsCRC); actual != expected {
+			return nil, fmt.Errorf("Column encoding checksum mismatch, expected %08x got %08x", expected, actual)
+		}
+		in = in[:end]
+	}
+	read := 2
+	// read length
+	numCols := uint64(binary.LittleEndian.Uint32(in[read:]))
+	read += 4
+	// every column takes at least its two lengths, check before allocating for them
+	if numCols > uint64(len(in)-read)/8 {
+		return nil, fmt.Errorf("Column encoding claims %d columns but only has %d bytes for them", numCols, len(in)-read)
+	}
+	ret := make([]colKeyVal, numCols, numCols)
+	for i := range ret {
+		if len(in)-read < 8 {
+			return nil, fmt.Errorf("Column encoding truncated in the lengths of column %d", i)
+		}
+		keyLen := uint64(binary.LittleEndian.Uint32(in[read:]))
+		read += 4
+		valLen := uint64(binary.LittleEndian.Uint32(in[read:]))
+		read += 4
+		if keyLen+valLen > uint64(len(in)-read) {
+			return nil, fmt.Errorf("Column encoding truncated in column %d, needs %d bytes but has %d", i, keyLen+valLen, len(in)-read)
+		}
+		k := in[read : read+int(keyLen) : read+int(keyLen)]
+		read += int(keyLen)
+		v := in[read : read+int(valLen) : read+int(valLen)]
+		read += int(valLen)
+		ret[i] = colKeyVal{k, v}
+	}
+	if read != len(in) {
+		return nil, fmt.Errorf("Column encoding has %d bytes left over after %d columns", len(in)-read, numCols)
+	}
+	return ret, nil
+}
+
+// EncodeCols packs alternating keys and values, like the column args to PutCols,
+// into the encoding GetCols and GetRow respond with, optionally checksummed
+func EncodeCols(keyVals [][]byte, checksum bool) ([]byte, error) {
+	if len(keyVals)%2 != 0 {
+		return nil, fmt.Errorf("EncodeCols requires alternating keys and values, got %d", len(keyVals))
+	}
+	cols := make([]colKeyVal, len(keyVals)/2)
+	for i := range cols {
+		cols[i] = colKeyVal{keyVals[2*i], keyVals[2*i+1]}
+	}
+	return encodeCols(cols, checksum)
+}
+
+// DecodeCols unpacks the encoding GetCols and GetRow respond with into alternating
+// keys and values, which slice in rather than copying it.  Checksums are verified
+// if present.
+func DecodeCols(in []byte) ([][]byte, error) {
+	cols, err := bytesCols(in)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([][]byte, 0, 2*len(cols))
+	for _, col := range cols {
+		ret = append(ret, col.k, col.v)
+	}
+	return ret, nil
+}
@@ -0,0 +1,132 @@
+package ops
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncodeCols(t *testing.T) {
+	keyVals := [][]byte{[]byte("colOne"), []byte("valOne"), []byte("c2"), []byte(""), []byte(""), []byte("v3")}
+	for _, checksum := range []bool{false, true} {
+		encoded, err := EncodeCols(keyVals, checksum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := DecodeCols(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(decoded) != len(keyVals) {
+			t.Fatalf("Expected %d keys and vals, got %d", len(keyVals), len(decoded))
+		}
+		for i := range keyVals {
+			if string(decoded[i]) != string(keyVals[i]) {
+				t.Fatalf("Mismatch at %d, expected %q got %q", i, keyVals[i], decoded[i])
+			}
+		}
+		// every truncation is an error rather than a panic or a short read
+		for l := 1; l < len(encoded); l++ {
+			_, err = DecodeCols(encoded[:l])
+			if err == nil {
+				t.Fatalf("Expected an error decoding %d of %d bytes", l, len(encoded))
+			}
+		}
+		_, err = DecodeCols(append(encoded, 0))
+		if err == nil {
+			t.Fatal("Expected an error for trailing bytes")
+		}
+	}
+	_, err := EncodeCols(keyVals[:3], false)
+	if err == nil {
+		t.Fatal("Expected an error for a key without a value")
+	}
+	decoded, err := DecodeCols(nil)
+	if err != nil || len(decoded) != 0 {
+		t.Fatalf("Expected no columns from empty input, got %q %v", decoded, err)
+	}
+}
+
+func TestDecodeColsCorrupt(t *testing.T) {
+	encoded, err := EncodeCols([][]byte{[]byte("key"), []byte("value")}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range encoded {
+		corrupt := append([]byte{}, encoded...)
+		corrupt[i] ^= 0x10
+		_, err = DecodeCols(corrupt)
+		if err == nil {
+			t.Fatalf("Expected an error with byte %d flipped", i)
+		}
+	}
+	// a huge count mustn't allocate for columns that aren't there
+	huge := []byte{colsVersion, 0, 0xff, 0xff, 0xff, 0xff}
+	_, err = DecodeCols(huge)
+	if err == nil {
+		t.Fatal("Expected an error for a count past the end of the input")
+	}
+	// lengths that overflow when added
+	overflow := []byte{colsVersion, 0, 1, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	_, err = DecodeCols(overflow)
+	if err == nil {
+		t.Fatal("Expected an error for lengths past the end of the input")
+	}
+	_, err = DecodeCols([]byte{colsVersion + 1, 0, 0, 0, 0, 0})
+	if err == nil {
+		t.Fatal("Expected an error for an unknown version")
+	}
+}
+
+func FuzzDecodeCols(f *testing.F) {
+	for _, keyVals := range [][][]byte{
+		{},
+		{[]byte("k"), []byte("v")},
+		{[]byte(""), []byte(""), []byte("key"), []byte("a longer value")},
+	} {
+		for _, checksum := range []bool{false, true} {
+			encoded, err := EncodeCols(keyVals, checksum)
+			if err != nil {
+				f.Fatal(err)
+			}
+			f.Add(encoded)
+		}
+	}
+	f.Fuzz(func(t *testing.T, in []byte) {
+		decoded, err := DecodeCols(in)
+		if err != nil || len(in) == 0 {
+			return
+		}
+		// anything that decodes is canonical, so encodes back to the same bytes
+		reencoded, err := EncodeCols(decoded, in[1]&colsFlagChecksum != 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(in, reencoded) {
+			t.Fatalf("Decoded %x to %q, which encodes to %x", in, decoded, reencoded)
+		}
+	})
+}
+
+func FuzzEncodeCols(f *testing.F) {
+	f.Add([]byte("key"), []byte("val"), []byte(""), true)
+	f.Add([]byte{}, []byte{0, 1, 2}, []byte("x"), false)
+	f.Fuzz(func(t *testing.T, a []byte, b []byte, c []byte, checksum bool) {
+		keyVals := [][]byte{a, b, c, a, b, c}
+		encoded, err := EncodeCols(keyVals, checksum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := DecodeCols(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(decoded) != len(keyVals) {
+			t.Fatalf("Expected %d keys and vals, got %d", len(keyVals), len(decoded))
+		}
+		for i := range keyVals {
+			if !bytes.Equal(decoded[i], keyVals[i]) {
+				t.Fatalf("Mismatch at %d, expected %q got %q", i, keyVals[i], decoded[i])
+			}
+		}
+	})
+}
@@ -0,0 +1,32 @@
+package ops
+
+import (
+	mdb "github.com/jbooth/gomdb"
+	"sync"
+	"time"
+)
+
+// callbacks timing the commit of the txn an op is applied in, keyed by txn
+var commitWatchers = &sync.Map{}
+
+// WatchCommit calls fn with the start and end of txn's commit if the op applied
+// in it commits.  Call UnwatchCommit once the op has returned.
+func WatchCommit(txn *mdb.Txn, fn func(start time.Time, end time.Time, err error)) {
+	commitWatchers.Store(txn, fn)
+}
+
+func UnwatchCommit(txn *mdb.Txn) {
+	commitWatchers.Delete(txn)
+}
+
+// commits an op's txn, letting any watcher know how long it took
+func commit(txn *mdb.Txn) error {
+	fn, watched := commitWatchers.Load(txn)
+	if !watched {
+		return txn.Commit()
+	}
+	start := time.Now()
+	err := txn.Commit()
+	fn.(func(time.Time, time.Time, error))(start, time.Now(), err)
+	return err
+}
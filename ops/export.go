@@ -0,0 +1,251 @@
+package ops
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	mdb "github.com/jbooth/gomdb"
+	"io"
+	"sort"
+)
+
+// Export format
+//
+// A dump is a stream of json objects, one per line, each an ExportRecord.
+// []byte fields are base64 encoded as usual for encoding/json.
+//
+// The first record has Kind "header" and carries the format version.
+// Each exported table then has one record of Kind "table" carrying its schema,
+// index and family definitions, followed by one record of Kind "col" per stored
+// column value.  Columns in a family with multiple versions get one record per
+// version, oldest first, so that replaying the records in order recreates them.
+// Ts is the write timestamp in unix nanos, or 0 for columns stored without one.
+const ExportVersion = 1
+
+const (
+	EXPORT_HEADER = "header"
+	EXPORT_TABLE  = "table"
+	EXPORT_COL    = "col"
+)
+
+type ExportRecord struct {
+	Kind     string
+	Version  int            `json:",omitempty"`
+	Table    string         `json:",omitempty"`
+	Schema   *Schema        `json:",omitempty"`
+	Indexes  []ExportIndex  `json:",omitempty"`
+	Families []ExportFamily `json:",omitempty"`
+	Row      []byte         `json:",omitempty"`
+	Col      []byte         `json:",omitempty"`
+	Val      []byte         `json:",omitempty"`
+	Ts       int64          `json:",omitempty"`
+}
+
+type ExportIndex struct {
+	Name   string
+	Column string
+}
+
+type ExportFamily struct {
+	Name     string
+	TTL      int64
+	Versions int
+}
+
+// returns the names of all user tables
+func Tables(txn *mdb.Txn) ([]string, error) {
+	names, err := dbiNames(txn)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]string, 0, len(names))
+	for _, name := range names {
+		if !isSystemTable(name) {
+			ret = append(ret, name)
+		}
+	}
+	return ret, nil
+}
+
+// returns the names of every dbi in the environment, including system tables
+func dbiNames(txn *mdb.Txn) ([]string, error) {
+	mainDbi, err := txn.DBIOpen(nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]string, 0)
+	err = forEachEntry(txn, mainDbi, func(k []byte, v []byte) error {
+		ret = append(ret, string(k))
+		return nil
+	})
+	return ret, err
+}
+
+// Export writes a dump of the provided tables, or all tables if tables is nil,
+// as seen by txn.  Use a read transaction to get a consistent snapshot.
+func Export(txn *mdb.Txn, tables []string, w io.Writer) error {
+	if tables == nil {
+		var err error
+		tables, err = Tables(txn)
+		if err != nil {
+			return err
+		}
+	}
+	enc := json.NewEncoder(w)
+	err := enc.Encode(&ExportRecord{Kind: EXPORT_HEADER, Version: ExportVersion})
+	if err != nil {
+		return err
+	}
+	for _, tableName := range tables {
+		err = exportTable(txn, tableName, enc)
+		if err != nil {
+			return fmt.Errorf("Error exporting table %s : %s", tableName, err)
+		}
+	}
+	return nil
+}
+
+func exportTable(txn *mdb.Txn, tableName string, enc *json.Encoder) error {
+	if isSystemTable(tableName) {
+		return fmt.Errorf("Table name %s is reserved", tableName)
+	}
+	dbi, err := txn.DBIOpen(&tableName, 0)
+	if err == mdb.NotFound {
+		return fmt.Errorf("No such table")
+	}
+	if err != nil {
+		return err
+	}
+	schema, err := GetSchema(txn, tableName)
+	if err != nil {
+		return err
+	}
+	indexes, err := tableIndexes(txn, tableName)
+	if err != nil {
+		return err
+	}
+	families, err := tableFamilies(txn, tableName)
+	if err != nil {
+		return err
+	}
+	tableRecord := &ExportRecord{Kind: EXPORT_TABLE, Table: tableName, Schema: schema}
+	for _, idx := range indexes {
+		tableRecord.Indexes = append(tableRecord.Indexes, ExportIndex{idx.Name, idx.Column})
+	}
+	familyNames := make([]string, 0, len(families))
+	for name := range families {
+		familyNames = append(familyNames, name)
+	}
+	sort.Strings(familyNames)
+	for _, name := range familyNames {
+		f := families[name]
+		tableRecord.Families = append(tableRecord.Families, ExportFamily{f.Name, f.TTL, f.Versions})
+	}
+	err = enc.Encode(tableRecord)
+	if err != nil {
+		return err
+	}
+
+	// default storage
+	err = forEachEntry(txn, dbi, func(k []byte, v []byte) error {
+		rcKey := splitRowColKey(k)
+		return enc.Encode(&ExportRecord{Kind: EXPORT_COL, Table: tableName, Row: rcKey.rowKey, Col: rcKey.colKey, Val: v})
+	})
+	if err != nil {
+		return err
+	}
+	// families
+	for _, name := range familyNames {
+		f := families[name]
+		if !f.hasData {
+			continue
+		}
+		err = forEachEntry(txn, f.dbi, func(k []byte, v []byte) error {
+			rcKey := splitRowColKey(k)
+			cells, err := unpackCells(v)
+			if err != nil {
+				return err
+			}
+			for i := len(cells) - 1; i >= 0; i-- {
+				err = enc.Encode(&ExportRecord{Kind: EXPORT_COL, Table: tableName, Row: rcKey.rowKey,
+					Col: joinFamily(f.Name, rcKey.colKey), Val: cells[i].val, Ts: cells[i].ts})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applies fn to every key and value in dbi
+func forEachEntry(txn *mdb.Txn, dbi mdb.DBI, fn func(k []byte, v []byte) error) error {
+	c, err := txn.CursorOpen(dbi)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	k, v, err := c.Get(nil, mdb.FIRST)
+	for err == nil {
+		err = fn(k, v)
+		if err != nil {
+			return err
+		}
+		k, v, err = c.Get(nil, mdb.NEXT)
+	}
+	if err == mdb.NotFound {
+		return nil
+	}
+	return err
+}
+
+// packs cols from an import into args for ImportCols
+func ImportArgs(table string, records []*ExportRecord) [][]byte {
+	args := make([][]byte, 1, 1+(len(records)*4))
+	args[0] = []byte(table)
+	for _, r := range records {
+		ts := make([]byte, 8)
+		binary.LittleEndian.PutUint64(ts, uint64(r.Ts))
+		val := r.Val
+		if val == nil {
+			val = nobytes
+		}
+		args = append(args, r.Row, r.Col, val, ts)
+	}
+	return args
+}
+
+// writes a batch of columns from an export, maintaining indexes and families but
+// skipping schema validation since the rows may not be complete until the whole
+// batch has been loaded
+// args:
+// 0: table name
+// 1-N: row key, col key, col val, 8 byte timestamp, repeated for each column
+func ImportCols(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+	if len(args) < 1 || (len(args)-1)%4 != 0 {
+		txn.Abort()
+		return nil, invalidf("ImportCols requires table and groups of 4 args per column, got %d args", len(args))
+	}
+	t, err := openTable(txn, string(args[0]))
+	if err != nil {
+		txn.Abort()
+		return nil, err
+	}
+	for i := 1; i < len(args); i += 4 {
+		if len(args[i+3]) != 8 {
+			txn.Abort()
+			return nil, invalidf("Invalid timestamp for column %s in row %s", string(args[i+1]), string(args[i]))
+		}
+		ts := int64(binary.LittleEndian.Uint64(args[i+3]))
+		err = t.putCols(txn, args[i], []colKeyVal{colKeyVal{args[i+1], args[i+2]}}, ts)
+		if err != nil {
+			txn.Abort()
+			return nil, err
+		}
+	}
+	return nobytes, commit(txn)
+}
@@ -0,0 +1,118 @@
+package ops
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestExportImport(t *testing.T) {
+	src := testEnv("/tmp/merchDbExportTest/src")
+	_, err := runOp(src, SetSchema, "users", `{"Columns": {"age": {"Type": "int64"}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = runOp(src, SetFamily, "users", "hist", `{"Versions": 3}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = runOp(src, CreateIndex, "users", "byAge", "age")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	writes := [][][]byte{
+		writeArgsAt(now, "row1", "users", "age", "10", "name", "a"),
+		writeArgsAt(now, "row2", "users", "age", "20"),
+		writeArgsAt(now.Add(-time.Second), "row1", "users", "hist:login", "first"),
+		writeArgsAt(now, "row1", "users", "hist:login", "second"),
+		writeArgsAt(now, "row1", "other", "col", "val"),
+	}
+	for _, w := range writes {
+		txn, err := src.BeginTxn(nil, uint(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = PutCols(w, txn)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dump := &bytes.Buffer{}
+	txn, err := src.BeginTxn(nil, uint(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables, err := Tables(txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) != 2 || tables[0] != "other" || tables[1] != "users" {
+		t.Fatalf("Expected tables [other users], got %v", tables)
+	}
+	err = Export(txn, nil, dump)
+	txn.Abort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstDump := dump.String()
+
+	// replay into a fresh env
+	dst := testEnv("/tmp/merchDbExportTest/dst")
+	dec := json.NewDecoder(dump)
+	for {
+		r := &ExportRecord{}
+		err = dec.Decode(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch r.Kind {
+		case EXPORT_TABLE:
+			if r.Schema != nil {
+				schemaBytes, _ := json.Marshal(r.Schema)
+				_, err = runOp(dst, SetSchema, r.Table, string(schemaBytes))
+			}
+			for _, f := range r.Families {
+				settings, _ := json.Marshal(f)
+				_, err = runOp(dst, SetFamily, r.Table, f.Name, string(settings))
+			}
+			for _, idx := range r.Indexes {
+				_, err = runOp(dst, CreateIndex, r.Table, idx.Name, idx.Column)
+			}
+		case EXPORT_COL:
+			txn, err = dst.BeginTxn(nil, uint(0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = ImportCols(ImportArgs(r.Table, []*ExportRecord{r}), txn)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = runOp(dst, BackfillIndex, "users", "byAge", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeys(t, lookup(t, dst, "users", "byAge", "20"), "row2")
+
+	dump.Reset()
+	txn, err = dst.BeginTxn(nil, uint(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Export(txn, nil, dump)
+	txn.Abort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dump.String() != firstDump {
+		t.Fatalf("Expected identical dump after import, got\n%s\nexpected\n%s", dump.String(), firstDump)
+	}
+}
@@ -0,0 +1,398 @@
+package ops
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	mdb "github.com/jbooth/gomdb"
+	"time"
+)
+
+// Columns named like family:qualifier belong to a column family if that family
+// has been declared for the table, otherwise the whole name is a column in the
+// table's default storage.
+//
+// family definitions live in a system table
+// key:  packed rowColKey of (tableName, familyName)
+// val:  json encoded familyDef
+//
+// each family gets its own dbi, named by familyDBIName
+// key:  packed rowColKey of (rowKey, qualifier)
+// val:  packed cells, newest first
+const familyMetaTable = "_families"
+
+// separates family from qualifier in column names
+const familySep = ':'
+
+type familyDef struct {
+	Name string `json:"-"`
+	// seconds after being written that a value expires, 0 for never
+	TTL int64
+	// number of versions to keep for each column, 0 is treated as 1
+	Versions int
+}
+
+// a family along with its dbi in the current transaction
+type family struct {
+	familyDef
+	dbi     mdb.DBI
+	hasData bool
+}
+
+// family names can't contain '.', so the last one always separates table from family
+// and two families can't share a dbi
+func familyDBIName(table string, fam string) string {
+	return systemPrefix + "fam." + table + "." + fam
+}
+
+// splits a column name into family and qualifier, family is nil if the name has no separator
+func splitFamily(col []byte) (fam []byte, qualifier []byte) {
+	sepIdx := bytes.IndexByte(col, familySep)
+	if sepIdx < 0 {
+		return nil, col
+	}
+	return col[:sepIdx], col[sepIdx+1:]
+}
+
+func joinFamily(fam string, qualifier []byte) []byte {
+	ret := make([]byte, 0, len(fam)+1+len(qualifier))
+	ret = append(ret, fam...)
+	ret = append(ret, familySep)
+	return append(ret, qualifier...)
+}
+
+// Timestamp encodes a write time for use as the trailing timestamp arg of write ops.
+// Timestamps are chosen by the node submitting the write so that every replica
+// applies the same TTLs and version ordering.
+func Timestamp(t time.Time) []byte {
+	ret := make([]byte, 8)
+	binary.LittleEndian.PutUint64(ret, uint64(t.UnixNano()))
+	return ret
+}
+
+// a single timestamped version of a value
+type cell struct {
+	ts  int64
+	val []byte
+}
+
+// 8 byte timestamp, 4 byte value length, value bytes, repeated for each version
+func packCells(cells []cell) []byte {
+	retLen := 0
+	for _, c := range cells {
+		retLen += 12 + len(c.val)
+	}
+	ret := make([]byte, retLen)
+	written := 0
+	for _, c := range cells {
+		binary.LittleEndian.PutUint64(ret[written:], uint64(c.ts))
+		written += 8
+		binary.LittleEndian.PutUint32(ret[written:], uint32(len(c.val)))
+		written += 4
+		copy(ret[written:], c.val)
+		written += len(c.val)
+	}
+	return ret
+}
+
+func unpackCells(in []byte) ([]cell, error) {
+	ret := make([]cell, 0, 1)
+	read := 0
+	for read < len(in) {
+		if len(in)-read < 12 {
+			return nil, fmt.Errorf("Truncated cell header at offset %d", read)
+		}
+		ts := int64(binary.LittleEndian.Uint64(in[read:]))
+		read += 8
+		valLen := int(binary.LittleEndian.Uint32(in[read:]))
+		read += 4
+		if len(in)-read < valLen {
+			return nil, fmt.Errorf("Truncated cell value at offset %d", read)
+		}
+		ret = append(ret, cell{ts, in[read : read+valLen]})
+		read += valLen
+	}
+	return ret, nil
+}
+
+// whether a cell written at ts has expired as of now.  Cells written without a
+// timestamp never expire.
+func (f familyDef) expired(ts int64, now int64) bool {
+	return f.TTL > 0 && ts > 0 && now-ts >= f.TTL*int64(time.Second)
+}
+
+// returns the newest live value in a packed cell list, or nil if there isn't one
+func (f familyDef) newest(packed []byte, now int64) ([]byte, error) {
+	cells, err := unpackCells(packed)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range cells {
+		if !f.expired(c.ts, now) {
+			return c.val, nil
+		}
+	}
+	return nil, nil
+}
+
+// loads all family definitions for a table, opening the dbis for any that have data
+func tableFamilies(txn *mdb.Txn, table string) (map[string]*family, error) {
+	metaTable := familyMetaTable
+	metaDbi, err := txn.DBIOpen(&metaTable, 0)
+	if err == mdb.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c, err := txn.CursorOpen(metaDbi)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	ret := make(map[string]*family)
+	err = doForRow(c, []byte(table), func(ckv colKeyVal) error {
+		f := &family{}
+		err := json.Unmarshal(ckv.v, &f.familyDef)
+		if err != nil {
+			return err
+		}
+		f.Name = string(ckv.k)
+		dbiName := familyDBIName(table, f.Name)
+		f.dbi, err = txn.DBIOpen(&dbiName, 0)
+		if err == nil {
+			f.hasData = true
+		} else if err != mdb.NotFound {
+			return err
+		}
+		ret[f.Name] = f
+		return nil
+	})
+	return ret, err
+}
+
+// writes a new version of a column, returning the newest live value it replaced
+func (f *family) put(txn *mdb.Txn, table string, rowKey []byte, qualifier []byte, val []byte, ts int64) ([]byte, error) {
+	if !f.hasData {
+		dbi, err := openDBI(txn, familyDBIName(table, f.Name))
+		if err != nil {
+			return nil, err
+		}
+		f.dbi = dbi
+		f.hasData = true
+	}
+	key := packRowColKey(rowColKey{rowKey, qualifier})
+	var prevVal []byte = nil
+	prevCells := []cell{}
+	packed, err := txn.Get(f.dbi, key)
+	if err == nil {
+		prevCells, err = unpackCells(packed)
+		if err != nil {
+			return nil, err
+		}
+		// indexes track the most recently written value whether or not it has expired
+		if len(prevCells) > 0 {
+			prevVal = prevCells[0].val
+		}
+	} else if err != mdb.NotFound {
+		return nil, err
+	}
+	maxVersions := f.Versions
+	if maxVersions < 1 {
+		maxVersions = 1
+	}
+	cells := make([]cell, 1, maxVersions)
+	cells[0] = cell{ts, val}
+	for _, c := range prevCells {
+		if len(cells) == maxVersions {
+			break
+		}
+		if !f.expired(c.ts, ts) {
+			cells = append(cells, c)
+		}
+	}
+	return prevVal, txn.Put(f.dbi, key, packCells(cells), uint(0))
+}
+
+// returns the newest live value for each column in the family, named family:qualifier
+func (f *family) getRow(txn *mdb.Txn, rowKey []byte, now int64) ([]colKeyVal, error) {
+	ret := make([]colKeyVal, 0)
+	if !f.hasData {
+		return ret, nil
+	}
+	c, err := txn.CursorOpen(f.dbi)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	err = doForRow(c, rowKey, func(ckv colKeyVal) error {
+		val, err := f.newest(ckv.v, now)
+		if err != nil {
+			return err
+		}
+		if val != nil {
+			ret = append(ret, colKeyVal{joinFamily(f.Name, ckv.k), val})
+		}
+		return nil
+	})
+	return ret, err
+}
+
+// returns the newest live value for a single column, nil if none
+func (f *family) get(txn *mdb.Txn, rowKey []byte, qualifier []byte, now int64) ([]byte, error) {
+	if !f.hasData {
+		return nil, nil
+	}
+	packed, err := txn.Get(f.dbi, packRowColKey(rowColKey{rowKey, qualifier}))
+	if err == mdb.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f.newest(packed, now)
+}
+
+// defines or updates the settings for a column family.  Changed settings apply
+// to values as they are next read or written.  Columns already written under the
+// family's name stay in the table's default storage and are hidden by it, so
+// servers check CheckNewFamily first rather than scanning the table here.
+// args:
+// 0: table name
+// 1: family name
+// 2: json encoded familyDef
+func SetFamily(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+	if len(args) != 3 {
+		txn.Abort()
+		return nil, invalidf("SetFamily requires table, family and settings, got %d args", len(args))
+	}
+	table := string(args[0])
+	fam := string(args[1])
+	if len(fam) == 0 || bytes.IndexByte(args[1], familySep) >= 0 || bytes.IndexByte(args[1], '.') >= 0 {
+		txn.Abort()
+		return nil, invalidf("Invalid family name %q, it must be non-empty and can't contain %q or '.'", fam, familySep)
+	}
+	_, err := openTable(txn, table)
+	if err != nil {
+		txn.Abort()
+		return nil, err
+	}
+	def := familyDef{}
+	err = json.Unmarshal(args[2], &def)
+	if err == nil && (def.TTL < 0 || def.Versions < 0) {
+		err = fmt.Errorf("TTL and Versions must not be negative")
+	}
+	if err != nil {
+		txn.Abort()
+		return nil, invalidf("Invalid settings for family %s : %s", fam, err)
+	}
+	metaDbi, err := openDBI(txn, familyMetaTable)
+	if err != nil {
+		txn.Abort()
+		return nil, err
+	}
+	defBytes, err := json.Marshal(def)
+	if err != nil {
+		txn.Abort()
+		return nil, err
+	}
+	err = txn.Put(metaDbi, packRowColKey(rowColKey{args[0], args[1]}), defBytes, uint(0))
+	if err != nil {
+		txn.Abort()
+		return nil, err
+	}
+	return nobytes, commit(txn)
+}
+
+// CheckNewFamily returns an InvalidError if declaring fam on table would hide
+// columns already written to the table's default storage.  Families that are
+// already declared are fine, their settings can be changed freely.  This scans
+// the whole table, so use a read transaction rather than calling it in a command.
+func CheckNewFamily(txn *mdb.Txn, table string, fam string) error {
+	t, err := openExistingTable(txn, table)
+	if err != nil || t == nil {
+		return err
+	}
+	if _, declared := t.families[fam]; declared {
+		return nil
+	}
+	// once declared, reads of fam:qualifier go to the family
+	col, err := firstFamilyCol(txn, t.dbi, fam)
+	if err != nil {
+		return err
+	}
+	if col != nil {
+		return invalidf("Can't declare family %s on table %s, it already has columns named like %s in its default storage", fam, table, string(col))
+	}
+	return nil
+}
+
+// returns the name of the first column in the table's default storage that would
+// belong to fam, nil if there aren't any
+func firstFamilyCol(txn *mdb.Txn, dbi mdb.DBI, fam string) ([]byte, error) {
+	prefix := joinFamily(fam, nobytes)
+	c, err := txn.CursorOpen(dbi)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	k, _, err := c.Get(nil, mdb.FIRST)
+	for err == nil {
+		col := splitRowColKey(k).colKey
+		if bytes.HasPrefix(col, prefix) {
+			return append([]byte{}, col...), nil
+		}
+		k, _, err = c.Get(nil, mdb.NEXT)
+	}
+	if err == mdb.NotFound {
+		return nil, nil
+	}
+	return nil, err
+}
+
+// a stored version of a column in a family
+type Version struct {
+	// UnixNano write time, 0 if written without a timestamp
+	Timestamp int64
+	Value     []byte
+}
+
+// ReadVersions returns the live versions of a column as of now, newest first.
+// Columns outside a family only have one version, with a 0 timestamp.  Returns
+// nothing if the table or column doesn't exist.
+func ReadVersions(txn *mdb.Txn, table string, rowKey []byte, col []byte, now time.Time) ([]Version, error) {
+	t, err := openExistingTable(txn, table)
+	if err != nil || t == nil {
+		return nil, err
+	}
+	ret := make([]Version, 0)
+	f, qualifier := t.family(col)
+	if f == nil {
+		val, err := t.getCol(txn, rowKey, col, now.UnixNano())
+		if val != nil {
+			ret = append(ret, Version{0, val})
+		}
+		return ret, err
+	}
+	if !f.hasData {
+		return ret, nil
+	}
+	packed, err := txn.Get(f.dbi, packRowColKey(rowColKey{rowKey, qualifier}))
+	if err == mdb.NotFound {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cells, err := unpackCells(packed)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range cells {
+		if !f.expired(c.ts, now.UnixNano()) {
+			ret = append(ret, Version{c.ts, c.val})
+		}
+	}
+	return ret, nil
+}
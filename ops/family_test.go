@@ -0,0 +1,200 @@
+package ops
+
+import (
+	"fmt"
+	mdb "github.com/jbooth/gomdb"
+	"testing"
+	"time"
+)
+
+// builds args for a write op with a trailing timestamp
+func writeArgsAt(ts time.Time, args ...string) [][]byte {
+	byteArgs := make([][]byte, 0, len(args)+1)
+	for _, a := range args {
+		byteArgs = append(byteArgs, []byte(a))
+	}
+	return append(byteArgs, Timestamp(ts))
+}
+
+func TestFamilies(t *testing.T) {
+	env := testEnv("/tmp/merchDbFamilyTest")
+	_, err := runOp(env, SetFamily, "events", "hot", `{"TTL": 60}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = runOp(env, SetFamily, "events", "hist", `{"Versions": 2}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = runOp(env, SetFamily, "events", "bad:name", `{}`)
+	if err == nil {
+		t.Fatal("Expected error for family name containing separator")
+	}
+	_, err = runOp(env, CreateIndex, "events", "byStatus", "hist:status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = runOp(env, BackfillIndex, "events", "byStatus", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	writes := [][][]byte{
+		writeArgsAt(now.Add(-2*time.Minute), "row1", "events", "hot:old", "expired"),
+		writeArgsAt(now, "row1", "events", "hot:new", "live"),
+		writeArgsAt(now.Add(-3*time.Second), "row1", "events", "hist:status", "v1"),
+		writeArgsAt(now.Add(-2*time.Second), "row1", "events", "hist:status", "v2"),
+		writeArgsAt(now.Add(-1*time.Second), "row1", "events", "hist:status", "v3"),
+	}
+	for _, w := range writes {
+		txn, err := env.BeginTxn(nil, uint(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = PutCols(w, txn)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	txn, err := env.BeginTxn(nil, uint(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl, err := openTable(txn, "events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := tbl.getRow(txn, []byte("row1"), [][]byte{[]byte("hot")}, now.UnixNano())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cols) != 1 || string(cols[0].k) != "hot:new" || string(cols[0].v) != "live" {
+		t.Fatalf("Expected only hot:new=live, got %v", cols)
+	}
+	val, err := tbl.getCol(txn, []byte("row1"), []byte("hist:status"), now.UnixNano())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "v3" {
+		t.Fatalf("Expected newest version v3, got %s", string(val))
+	}
+	packed, err := txn.Get(tbl.families["hist"].dbi, packRowColKey(rowColKey{[]byte("row1"), []byte("status")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cells, err := unpackCells(packed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells) != 2 || string(cells[1].val) != "v2" {
+		t.Fatalf("Expected 2 versions with v2 second, got %v", cells)
+	}
+	txn.Abort()
+
+	expectKeys(t, lookup(t, env, "events", "byStatus", "v3"), "row1")
+	expectKeys(t, lookup(t, env, "events", "byStatus", "v2"))
+
+	txn, err = env.BeginTxn(nil, mdb.RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for col, expected := range map[string][]string{"hist:status": {"v3", "v2"}, "hot:old": {}, "hot:new": {"live"}, "missing": {}} {
+		versions, err := ReadVersions(txn, "events", []byte("row1"), []byte(col), now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]string, len(versions))
+		for i, v := range versions {
+			got[i] = string(v.Value)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Fatalf("Expected versions %v of %s, got %v", expected, col, got)
+		}
+	}
+	txn.Abort()
+
+	_, err = runOp(env, DelRow, "row1", "events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeys(t, lookup(t, env, "events", "byStatus", "v3"))
+	txn, err = env.BeginTxn(nil, uint(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txn.Abort()
+	tbl, err = openTable(txn, "events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err = tbl.getRow(txn, []byte("row1"), nil, now.UnixNano())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cols) != 0 {
+		t.Fatalf("Expected deleted row to be empty, got %v", cols)
+	}
+}
+
+func TestFamilyExistingCols(t *testing.T) {
+	env := testEnv("/tmp/merchDbFamilyExistingColsTest")
+	_, err := runOp(env, PutCols, "row1", "events", "hist:status", "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNew := func(fam string) error {
+		txn, err := env.BeginTxn(nil, mdb.RDONLY)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer txn.Abort()
+		return CheckNewFamily(txn, "events", fam)
+	}
+	// declaring hist would hide the column written to default storage
+	if err := checkNew("hist"); !IsInvalid(err) {
+		t.Fatalf("Expected error declaring a family over existing columns, got %v", err)
+	}
+	if err := checkNew("his"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = runOp(env, SetFamily, "events", "his", `{"Versions": 2}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = runOp(env, PutCols, "row2", "events", "his:status", "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// and changing the settings of a family that's already declared is fine
+	if err := checkNew("his"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = runOp(env, SetFamily, "events", "his", `{"Versions": 3}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// family a.b on events and family b on events.a would share the dbi _fam.events.a.b
+	for _, name := range []string{"", "a:b", "a.b"} {
+		_, err = runOp(env, SetFamily, "events", name, `{"Versions": 2}`)
+		if !IsInvalid(err) {
+			t.Fatalf("Expected family name %q to be rejected, got %v", name, err)
+		}
+	}
+
+	// rows written before the index exist in both storages, backfill has to find both
+	for _, col := range []string{"hist:status", "his:status"} {
+		index := "by" + col
+		_, err = runOp(env, CreateIndex, "events", index, col)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = runOp(env, BackfillIndex, "events", index, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectKeys(t, lookup(t, env, "events", "byhist:status", "old"), "row1")
+	expectKeys(t, lookup(t, env, "events", "byhis:status", "new"), "row2")
+}
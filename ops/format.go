@@ -0,0 +1,285 @@
+package ops
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	mdb "github.com/jbooth/gomdb"
+)
+
+// Tables written before secondary indexes were added (key format 1) padded every
+// key with 4 zero bytes after the column key, which reads returned as part of the
+// column name.  The current format (2) leaves them off.  Stores in format 1 are
+// migrated with MigrateKeys a table at a time, and each of their tables can be read
+// and written once it's converted.  Tables created during the migration start out
+// in the current format.
+//
+// the store's key format lives in a system table
+// key:  keyFormatKey
+// val:  4 byte uint32 format
+// while migrating, keyFormatProgressKey holds the packed rowColKey of the table
+// being migrated and the last key converted in it, and tableFormatKey marks each
+// table that's in the current format
+const formatMetaTable = "_format"
+
+const KeyFormat uint32 = 2
+
+var (
+	keyFormatKey         = []byte("rowColKeys")
+	keyFormatProgressKey = []byte("rowColKeys.progress")
+	oldKeyPadding        = []byte{0, 0, 0, 0}
+)
+
+var ErrOldKeyFormat = errors.New("This store uses the key format from before secondary indexes and must be migrated, see MigrateKeys")
+
+// keys converted by each MigrateKeys command
+var migrateBatch = 10000
+
+// KeyFormatVersion returns the key format of the store.  Stores without a
+// recorded format are format 1 if they have any tables, otherwise they're new.
+func KeyFormatVersion(txn *mdb.Txn) (uint32, error) {
+	metaTable := formatMetaTable
+	dbi, err := txn.DBIOpen(&metaTable, 0)
+	if err == nil {
+		val, err := txn.Get(dbi, keyFormatKey)
+		if err == nil && len(val) == 4 {
+			return binary.LittleEndian.Uint32(val), nil
+		}
+		if err != nil && err != mdb.NotFound {
+			return 0, err
+		}
+	} else if err != mdb.NotFound {
+		return 0, err
+	}
+	tables, err := Tables(txn)
+	if err != nil {
+		return 0, err
+	}
+	if len(tables) > 0 {
+		return 1, nil
+	}
+	return KeyFormat, nil
+}
+
+// marks a table as being in the current format while the rest of the store isn't
+func tableFormatKey(table string) []byte {
+	return packRowColKey(rowColKey{keyFormatKey, []byte(table)})
+}
+
+// returns ErrOldKeyFormat unless the table is in the current format
+func checkKeyFormat(txn *mdb.Txn, table string) error {
+	version, err := KeyFormatVersion(txn)
+	if err != nil {
+		return err
+	}
+	if version == KeyFormat {
+		return nil
+	}
+	current, err := tableConverted(txn, table)
+	if err != nil {
+		return err
+	}
+	if !current {
+		return ErrOldKeyFormat
+	}
+	return nil
+}
+
+// whether an old store's table has been converted or was created since
+func tableConverted(txn *mdb.Txn, table string) (bool, error) {
+	metaTable := formatMetaTable
+	dbi, err := txn.DBIOpen(&metaTable, 0)
+	if err == mdb.NotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	_, err = txn.Get(dbi, tableFormatKey(table))
+	if err == mdb.NotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// records that a table about to be created is in the current format.  In a new
+// store that records the store's format, so stores created by this version are
+// never mistaken for old ones, and in an old store it marks just the table.
+func markKeyFormat(txn *mdb.Txn, table string) error {
+	version, err := KeyFormatVersion(txn)
+	if err != nil {
+		return err
+	}
+	dbi, err := openDBI(txn, formatMetaTable)
+	if err != nil {
+		return err
+	}
+	if version != KeyFormat {
+		return txn.Put(dbi, tableFormatKey(table), nobytes, uint(0))
+	}
+	_, err = txn.Get(dbi, keyFormatKey)
+	if err != mdb.NotFound {
+		return err
+	}
+	return putKeyFormat(txn, dbi)
+}
+
+func putKeyFormat(txn *mdb.Txn, metaDbi mdb.DBI) error {
+	val := make([]byte, 4)
+	binary.LittleEndian.PutUint32(val, KeyFormat)
+	return txn.Put(metaDbi, keyFormatKey, val, uint(0))
+}
+
+// converts up to migrateBatch keys from format 1 to the current format, picking
+// up where the last call left off, and marks each table as it's finished so it
+// can be used straight away.  Returns an empty response once every table is
+// converted, and "more" until then.  Safe to call on a store that's already
+// current, and to repeat.
+// args: none
+func MigrateKeys(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+	version, err := KeyFormatVersion(txn)
+	if err != nil {
+		txn.Abort()
+		return nil, err
+	}
+	metaDbi, err := openDBI(txn, formatMetaTable)
+	if err != nil {
+		txn.Abort()
+		return nil, err
+	}
+	if version == KeyFormat {
+		_, err = txn.Get(metaDbi, keyFormatKey)
+		if err == mdb.NotFound {
+			err = putKeyFormat(txn, metaDbi)
+		}
+		if err != nil {
+			txn.Abort()
+			return nil, err
+		}
+		return nobytes, commit(txn)
+	}
+	tables, err := Tables(txn)
+	if err != nil {
+		txn.Abort()
+		return nil, err
+	}
+	var startTable, after []byte = nil, nil
+	progress, err := txn.Get(metaDbi, keyFormatProgressKey)
+	if err == nil {
+		rc := splitRowColKey(progress)
+		startTable, after = rc.rowKey, rc.colKey
+	} else if err != mdb.NotFound {
+		txn.Abort()
+		return nil, err
+	}
+	converted := 0
+	for _, table := range tables {
+		if startTable != nil && table < string(startTable) {
+			continue
+		}
+		if startTable == nil || table != string(startTable) {
+			after = nil
+		}
+		done, err := tableConverted(txn, table)
+		if err != nil {
+			txn.Abort()
+			return nil, err
+		}
+		if done {
+			continue
+		}
+		last, n, err := migrateTable(txn, table, after, migrateBatch-converted)
+		if err != nil {
+			txn.Abort()
+			return nil, err
+		}
+		converted += n
+		if converted < migrateBatch {
+			// ran out of keys before the batch did
+			err = txn.Put(metaDbi, tableFormatKey(table), nobytes, uint(0))
+			if err != nil {
+				txn.Abort()
+				return nil, err
+			}
+			continue
+		}
+		err = txn.Put(metaDbi, keyFormatProgressKey, packRowColKey(rowColKey{[]byte(table), last}), uint(0))
+		if err != nil {
+			txn.Abort()
+			return nil, err
+		}
+		return []byte("more"), commit(txn)
+	}
+	// the whole store is current now, so the marks aren't needed
+	for _, key := range append([][]byte{keyFormatProgressKey}, tableKeys(tables)...) {
+		err = txn.Del(metaDbi, key, nil)
+		if err != nil && err != mdb.NotFound {
+			txn.Abort()
+			return nil, err
+		}
+	}
+	err = putKeyFormat(txn, metaDbi)
+	if err != nil {
+		txn.Abort()
+		return nil, err
+	}
+	return nobytes, commit(txn)
+}
+
+func tableKeys(tables []string) [][]byte {
+	ret := make([][]byte, len(tables))
+	for i, table := range tables {
+		ret[i] = tableFormatKey(table)
+	}
+	return ret
+}
+
+// converts up to max keys in table that sort after the old key after, or from
+// the start of the table if it's nil.  Returns the last old key converted and
+// how many were.  A converted key only drops the padding, so it sorts just
+// before the old key and is never seen again by a later call.
+func migrateTable(txn *mdb.Txn, table string, after []byte, max int) ([]byte, int, error) {
+	dbi, err := txn.DBIOpen(&table, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	c, err := txn.CursorOpen(dbi)
+	if err != nil {
+		return nil, 0, err
+	}
+	var k, v []byte
+	if after == nil {
+		k, v, err = c.Get(nil, mdb.FIRST)
+	} else {
+		k, v, err = c.Get(append(append([]byte{}, after...), 0), mdb.SET_RANGE)
+	}
+	oldKeys := make([][]byte, 0)
+	vals := make([][]byte, 0)
+	for err == nil && len(oldKeys) < max {
+		if len(k) < 8 || int(binary.LittleEndian.Uint32(k))+8 > len(k) || !bytes.HasSuffix(k, oldKeyPadding) {
+			c.Close()
+			return nil, 0, errors.New("Key in table " + table + " isn't in the old key format, is the store corrupt?")
+		}
+		oldKeys = append(oldKeys, append([]byte{}, k...))
+		vals = append(vals, append([]byte{}, v...))
+		k, v, err = c.Get(nil, mdb.NEXT)
+	}
+	c.Close()
+	if err != nil && err != mdb.NotFound {
+		return nil, 0, err
+	}
+	for i, old := range oldKeys {
+		err = txn.Del(dbi, old, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		err = txn.Put(dbi, old[:len(old)-len(oldKeyPadding)], vals[i], uint(0))
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	if len(oldKeys) == 0 {
+		return after, 0, nil
+	}
+	return oldKeys[len(oldKeys)-1], len(oldKeys), nil
+}
@@ -0,0 +1,156 @@
+package ops
+
+import (
+	"encoding/binary"
+	"fmt"
+	mdb "github.com/jbooth/gomdb"
+	"testing"
+)
+
+// writes rows the way stores in key format 1 did, with 4 bytes of padding after the column
+func writeOldRows(env *mdb.Env, table string, rows int) {
+	txn, err := env.BeginTxn(nil, uint(0))
+	if err != nil {
+		panic(err)
+	}
+	dbi, err := txn.DBIOpen(&table, mdb.CREATE)
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < rows; i++ {
+		rowKey := []byte(fmt.Sprintf("row%d", i))
+		for _, col := range []string{"a", "b"} {
+			key := make([]byte, 4+len(rowKey)+len(col)+4)
+			binary.LittleEndian.PutUint32(key, uint32(len(rowKey)))
+			copy(key[4:], rowKey)
+			copy(key[4+len(rowKey):], col)
+			err = txn.Put(dbi, key, []byte(col+string(rowKey)), uint(0))
+			if err != nil {
+				panic(err)
+			}
+		}
+	}
+	err = txn.Commit()
+	if err != nil {
+		panic(err)
+	}
+}
+
+func keyFormat(t *testing.T, env *mdb.Env) uint32 {
+	txn, err := env.BeginTxn(nil, mdb.RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txn.Abort()
+	version, err := KeyFormatVersion(txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+func TestMigrateKeys(t *testing.T) {
+	env := testEnv("/tmp/merchDbMigrateKeysTest")
+	writeOldRows(env, "one", 4)
+	writeOldRows(env, "two", 3)
+	if v := keyFormat(t, env); v != 1 {
+		t.Fatalf("Expected a store with unmarked tables to be format 1, got %d", v)
+	}
+	_, err := runOp(env, PutCols, "row0", "one", "c", "x")
+	if err != ErrOldKeyFormat {
+		t.Fatalf("Expected write to an old store to fail with ErrOldKeyFormat, got %v", err)
+	}
+	_, err = runOp(env, GetRow, "row0", "one")
+	if err != ErrOldKeyFormat {
+		t.Fatalf("Expected read from an old store to fail with ErrOldKeyFormat, got %v", err)
+	}
+	// new tables are in the current format from the start
+	_, err = runOp(env, PutCols, "row0", "new", "c", "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := keyFormat(t, env); v != 1 {
+		t.Fatalf("Expected creating a table not to change an old store's format, got %d", v)
+	}
+
+	// small batches so migration stops partway through a table and at the end of one
+	defer func(batch int) { migrateBatch = batch }(migrateBatch)
+	migrateBatch = 4
+	commands := 0
+	for {
+		resp, err := runOp(env, MigrateKeys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		commands++
+		if len(resp) == 0 {
+			break
+		}
+		if commands == 3 {
+			// one is finished and usable while two is still being converted
+			_, err = runOp(env, PutCols, "row9", "one", "c", "x")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = runOp(env, GetRow, "row0", "two")
+			if err != ErrOldKeyFormat {
+				t.Fatalf("Expected reads of an unconverted table to fail with ErrOldKeyFormat, got %v", err)
+			}
+		}
+		if commands > 10 {
+			t.Fatal("MigrateKeys never finished")
+		}
+	}
+	// 14 keys in batches of 4
+	if commands != 4 {
+		t.Fatalf("Expected 4 MigrateKeys commands, took %d", commands)
+	}
+	if v := keyFormat(t, env); v != KeyFormat {
+		t.Fatalf("Expected format %d after migrating, got %d", KeyFormat, v)
+	}
+	encoded, err := runOp(env, GetRow, "row9", "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyVals, err := DecodeCols(encoded); err != nil || fmt.Sprintf("%q", keyVals) != `["c" "x"]` {
+		t.Fatalf("Expected the write made during the migration, got %q %v", keyVals, err)
+	}
+	for table, rows := range map[string]int{"one": 4, "two": 3} {
+		for i := 0; i < rows; i++ {
+			row := fmt.Sprintf("row%d", i)
+			encoded, err := runOp(env, GetRow, row, table)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keyVals, err := DecodeCols(encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := fmt.Sprintf("%q", keyVals)
+			expected := fmt.Sprintf("%q", [][]byte{[]byte("a"), []byte("a" + row), []byte("b"), []byte("b" + row)})
+			if got != expected {
+				t.Fatalf("Table %s row %s : expected %s got %s", table, row, expected, got)
+			}
+		}
+	}
+	// already current, nothing to do
+	resp, err := runOp(env, MigrateKeys)
+	if err != nil || len(resp) != 0 {
+		t.Fatalf("Expected MigrateKeys on a current store to do nothing, got %q %v", resp, err)
+	}
+}
+
+func TestNewStoreKeyFormat(t *testing.T) {
+	env := testEnv("/tmp/merchDbNewStoreKeyFormatTest")
+	if v := keyFormat(t, env); v != KeyFormat {
+		t.Fatalf("Expected an empty store to be format %d, got %d", KeyFormat, v)
+	}
+	_, err := runOp(env, PutCols, "row", "table", "col", "val")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the table's there now, so this only holds if creating it recorded the format
+	if v := keyFormat(t, env); v != KeyFormat {
+		t.Fatalf("Expected a store created by this version to be format %d, got %d", KeyFormat, v)
+	}
+}
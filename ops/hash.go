@@ -5,45 +5,45 @@ import (
 	"encoding/binary"
 	"fmt"
 	mdb "github.com/jbooth/gomdb"
+	"time"
 )
 
 // db format
 
 // key:  4 byte uint32 for rowKey length, n bytes of rowKey, remaining bytes are column key
 // val:  column value
+// this is key format 2, see format.go for format 1 and migrating from it
 
 // args:
 // 0: row key
 // 1: table name
 // 2-N:  col key,val pairs
+// N+1: optional 8 byte write timestamp, see Timestamp()
 
 // outputs: nil, error state
 func PutCols(args [][]byte, txn *mdb.Txn) ([]byte, error) {
-	fmt.Printf("PutCols(args = [%#v], txn = [%#v])\n", args, txn)
-	fmt.Printf("Executing putcols! \n")
-	// key bytes are 4 byte keyLen + keyBytes
-	rowKey := args[0]
-	table := string(args[1])
-	dbi, err := txn.DBIOpen(&table, mdb.CREATE)
+	rowKey, table, keyVals, ts, err := parseWriteArgs(args)
 	if err != nil {
 		txn.Abort()
 		return nil, err
 	}
-	// put our columns
-	keyValBytes := args[2:]
-	if len(keyValBytes)%2 != 0 {
-		return nil, fmt.Errorf("Had odd number of column keyVals on insert to table %s rowKey %s", table, string(rowKey))
+	t, err := openTable(txn, table)
+	if err != nil {
+		txn.Abort()
+		return nil, err
 	}
-	keyVals := make([]colKeyVal, len(keyValBytes)/2, len(keyValBytes)/2)
-	for i := 0; i < int(len(keyValBytes)/2); i++ {
-		keyVals[i] = colKeyVal{keyValBytes[i*2], keyValBytes[(i*2)+1]}
+	err = t.validate(txn, rowKey, keyVals, ts, false)
+	if err != nil {
+		txn.Abort()
+		return nil, err
 	}
-	err = putCols(txn, dbi, rowKey, keyVals)
+	// put our columns
+	err = t.putCols(txn, rowKey, keyVals, ts)
 	if err != nil {
 		txn.Abort()
 		return nil, err
 	}
-	return nobytes, txn.Commit()
+	return nobytes, commit(txn)
 }
 
 // PutRow clears all previously existing columns for the row, in addition to adding the provided columns
@@ -51,53 +51,57 @@ func PutCols(args [][]byte, txn *mdb.Txn) ([]byte, error) {
 // 0: row key
 // 1: table name
 // 2-N:  col key,val pairs
+// N+1: optional 8 byte write timestamp, see Timestamp()
 
 // outputs: nil, error state
 func PutRow(args [][]byte, txn *mdb.Txn) ([]byte, error) {
-	fmt.Printf("PutRow(args = [%#v], txn = [%#v])\n", args, txn)
-	// key bytes are 4 byte keyLen + keyBytes
-	rowKey := args[0]
-	table := string(args[1])
-	dbi, err := txn.DBIOpen(&table, mdb.CREATE)
+	rowKey, table, keyVals, ts, err := parseWriteArgs(args)
 	if err != nil {
+		txn.Abort()
 		return nil, err
 	}
-	// clear all prev columns
-	delRow(txn, dbi, rowKey)
-	// put our columns
-	keyValBytes := args[2:]
-	if len(keyValBytes)%2 != 0 {
-		return nil, fmt.Errorf("Had odd number of column keyVals on insert to table %s rowKey %s", table, string(rowKey))
+	t, err := openTable(txn, table)
+	if err != nil {
+		txn.Abort()
+		return nil, err
 	}
-	keyVals := make([]colKeyVal, len(keyValBytes)/2, len(keyValBytes)/2)
-	for i := 0; i < int(len(keyValBytes)/2); i++ {
-		keyVals[i] = colKeyVal{keyValBytes[i*2], keyValBytes[(i*2)+1]}
+	err = t.validate(txn, rowKey, keyVals, ts, true)
+	if err != nil {
+		txn.Abort()
+		return nil, err
 	}
-	err = putCols(txn, dbi, rowKey, keyVals)
+	// clear all prev columns
+	err = t.delRow(txn, rowKey)
 	if err != nil {
+		txn.Abort()
 		return nil, err
 	}
-	return nobytes, txn.Commit()
+	// put our columns
+	err = t.putCols(txn, rowKey, keyVals, ts)
+	if err != nil {
+		txn.Abort()
+		return nil, err
+	}
+	return nobytes, commit(txn)
 }
 
 // args:
 // 0: rowKey
 // 1: tableName
+// 2-N: optional column families to fetch, the empty string selects columns outside of any family.
+// If no families are provided, fetches the whole row.
 func GetRow(args [][]byte, txn *mdb.Txn) ([]byte, error) {
-	fmt.Printf("GetRow(args = [%#v], txn = [%#v])\n", args, txn)
-	rowKey := args[0]
-	table := string(args[1])
-	fmt.Println("Executing getRow, opening dbi")
-	dbi, err := txn.DBIOpen(&table, mdb.CREATE)
-	if err != nil {
-		return nil, err
+	if len(args) < 2 {
+		txn.Abort()
+		return nil, fmt.Errorf("GetRow requires row key and table name, got %d args", len(args))
 	}
-	retKeyVals, err := getCols(txn, dbi, rowKey, nil)
-	fmt.Printf("Executing getrow for key %s got err %s", string(rowKey), err)
-	if err != nil {
-		return nil, err
+	var familiesWeWant [][]byte = nil
+	if len(args) > 2 {
+		familiesWeWant = args[2:]
 	}
-	return colsBytes(retKeyVals)
+	ret, err := ReadRow(txn, string(args[1]), args[0], familiesWeWant)
+	txn.Abort() // abort since we're not writing, after encoding out of the txn's memory
+	return ret, err
 }
 
 // args:
@@ -105,38 +109,74 @@ func GetRow(args [][]byte, txn *mdb.Txn) ([]byte, error) {
 // 1: tableName
 // 2-N: cols to fetch
 func GetCols(args [][]byte, txn *mdb.Txn) ([]byte, error) {
-	fmt.Printf("GetCols(args = [%#v], txn = [%#v])\n", args, txn)
-	rowKey := args[0]
-	table := string(args[1])
+	if len(args) < 2 {
+		txn.Abort()
+		return nil, fmt.Errorf("GetCols requires row key and table name, got %d args", len(args))
+	}
 	var colsWeWant [][]byte = nil
 	if len(args) > 2 {
 		colsWeWant = args[2:]
 	}
+	ret, err := ReadCols(txn, string(args[1]), args[0], colsWeWant)
+	txn.Abort() // abort since we're not writing, after encoding out of the txn's memory
+	return ret, err
+}
 
-	dbi, err := txn.DBIOpen(&table, mdb.CREATE)
+// ReadRow reads a row as GetRow does, from any txn including a read-only one
+// from flotilla's Read, so a node can serve it from its own copy.  Returns the
+// columns encoded with colsBytes, which is empty if the table doesn't exist.
+func ReadRow(txn *mdb.Txn, table string, rowKey []byte, families [][]byte) ([]byte, error) {
+	t, err := openExistingTable(txn, table)
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		return colsBytes(nil)
+	}
+	retKeyVals, err := t.getRow(txn, rowKey, families, time.Now().UnixNano())
 	if err != nil {
 		return nil, err
 	}
+	return colsBytes(retKeyVals)
+}
 
-	cols, err := getCols(txn, dbi, rowKey, colsWeWant)
+// ReadCols reads columns as GetCols does, see ReadRow
+func ReadCols(txn *mdb.Txn, table string, rowKey []byte, cols [][]byte) ([]byte, error) {
+	t, err := openExistingTable(txn, table)
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		return colsBytes(nil)
+	}
+	retKeyVals, err := t.getCols(txn, rowKey, cols, time.Now().UnixNano())
 	if err != nil {
 		return nil, err
 	}
-	txn.Abort() // abort since we're not writing
-	return colsBytes(cols)
+	return colsBytes(retKeyVals)
 }
 
 // args:
 // 0: rowKey
 // 1: tableName
 func DelRow(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+	if len(args) != 2 {
+		txn.Abort()
+		return nil, invalidf("DelRow requires row key and table name, got %d args", len(args))
+	}
 	rowKey := args[0]
 	table := string(args[1])
-	dbi, err := txn.DBIOpen(&table, mdb.CREATE)
+	t, err := openTable(txn, table)
 	if err != nil {
+		txn.Abort()
+		return nil, err
+	}
+	err = t.delRow(txn, rowKey)
+	if err != nil {
+		txn.Abort()
 		return nil, err
 	}
-	return nobytes, delRow(txn, dbi, rowKey)
+	return nobytes, commit(txn)
 }
 
 func delRow(txn *mdb.Txn, dbi mdb.DBI, rowKey []byte) error {
@@ -150,6 +190,7 @@ func delRow(txn *mdb.Txn, dbi mdb.DBI, rowKey []byte) error {
 	if err != nil {
 		return err
 	}
+	defer c.Close()
 	return doForRow(c, rowKey, func(ckv colKeyVal) error {
 		mdbKey := packRowColKey(rowColKey{rowKey, ckv.k})
 		err = txn.Del(dbi, mdbKey, nil)
@@ -165,6 +206,10 @@ func doForRow(c *mdb.Cursor, rowKey []byte, forCol func(colKeyVal) error) error
 
 	//fmt.Printf("Seeking to key %X\n", seekKey)
 	_, _, err := c.Get(seekKey, mdb.SET_RANGE)
+	if err == mdb.NotFound {
+		// no keys at or after this row
+		return nil
+	}
 	if err != nil {
 		return fmt.Errorf("Error while seeking in doForRow: %s", err)
 	}
@@ -189,19 +234,20 @@ func doForRow(c *mdb.Cursor, rowKey []byte, forCol func(colKeyVal) error) error
 
 		// advance cursor
 		_, _, err = c.Get(nil, mdb.NEXT)
+		if err == mdb.NotFound {
+			// end of table
+			return nil
+		}
 		if err != nil {
 			return fmt.Errorf("Error advancing cursor in doForRow: %s", err)
 		}
 	}
-	// unreachable
-	return nil
 }
 
 func putCols(txn *mdb.Txn, dbi mdb.DBI, rowKey []byte, cols []colKeyVal) error {
 	var err error = nil
 	for _, col := range cols {
 		putKey := packRowColKey(rowColKey{rowKey, col.k})
-		fmt.Printf("Actual put of key %#v val %#v", putKey, col.v)
 		err = txn.Put(dbi, putKey, col.v, uint(0))
 		if err != nil {
 			return err
@@ -211,22 +257,35 @@ func putCols(txn *mdb.Txn, dbi mdb.DBI, rowKey []byte, cols []colKeyVal) error {
 }
 
 // if cols is nil, returns whole row -- otherwise returns only those with colKeys selected in cols
-// returns pairs of (colKey, colVal) with err
+// returns pairs of (colKey, colVal) with err, columns that aren't set are left out
 func getCols(txn *mdb.Txn, dbi mdb.DBI, rowKey []byte, cols [][]byte) ([]colKeyVal, error) {
-	fmt.Printf("getCols(txn = [%#v], dbi = [%#v], rowKey = [%s], cols = [%#v])\n", txn, dbi, string(rowKey), cols)
-	// key bytes are 4 byte keyLen + keyBytes
-	seekKey := make([]byte, len(rowKey)+4, len(rowKey)+4)
-	binary.LittleEndian.PutUint32(seekKey, uint32(len(rowKey)))
-	copy(seekKey[4:], rowKey)
-
-	retSet := make([]colKeyVal, 0, 0)
+	retSet := make([]colKeyVal, 0, len(cols))
+	if cols != nil {
+		// seek straight to each column
+		for _, col := range cols {
+			val, err := txn.Get(dbi, packRowColKey(rowColKey{rowKey, col}))
+			if err == mdb.NotFound {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			retSet = append(retSet, colKeyVal{col, val})
+		}
+		return retSet, nil
+	}
 	c, err := txn.CursorOpen(dbi)
+	if err != nil {
+		return nil, err
+	}
 	defer c.Close()
+	err = doForRow(c, rowKey, func(ckv colKeyVal) error {
+		retSet = append(retSet, ckv)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-
-	// todo use doForCols
 	return retSet, nil
 }
 
@@ -237,7 +296,7 @@ type rowColKey struct {
 
 // packs a rowKey and colKey into a single []byte for an mdb key
 func packRowColKey(in rowColKey) []byte {
-	keyLen := 4 + len(in.rowKey) + 4 + len(in.colKey)
+	keyLen := 4 + len(in.rowKey) + len(in.colKey)
 	mdbKey := make([]byte, keyLen)
 	binary.LittleEndian.PutUint32(mdbKey, uint32(len(in.rowKey)))
 	copy(mdbKey[4:], in.rowKey)
@@ -279,55 +338,3 @@ type colKeyVal struct {
 func (k *colKeyVal) String() string {
 	return string(k.k) + "\t" + string(k.v)
 }
-
-// allocates a new []byte to contain the values in cols,
-// passed in cols are slices of 2 bytes, { (key,val), (key,val), (key, val) }
-func colsBytes(cols []colKeyVal) ([]byte, error) {
-	retLength := 4 + (8 * len(cols))
-	for _, keyVal := range cols {
-		retLength += len(keyVal.k)
-		retLength += len(keyVal.v)
-	}
-	ret := make([]byte, retLength, retLength)
-	written := 0
-	// write num records
-	binary.LittleEndian.PutUint32(ret[written:], uint32(len(cols)))
-	written += 4
-	// for each record
-	for _, keyVal := range cols {
-
-		// key length, val length
-		binary.LittleEndian.PutUint32(ret[written:], uint32(len(keyVal.k)))
-		written += 4
-		binary.LittleEndian.PutUint32(ret[written:], uint32(len(keyVal.v)))
-		written += 4
-		// key, val
-		copy(ret[written:], keyVal.k)
-		written += len(keyVal.k)
-		copy(ret[written:], keyVal.v)
-		written += len(keyVal.v)
-	}
-	return ret, nil
-}
-
-// wraps byte arrays around columns passed to us
-func bytesCols(in []byte) ([]colKeyVal, error) {
-	if in == nil || len(in) == 0 {
-		return []colKeyVal{}, nil
-	}
-	read := 0
-	// read length
-	numCols := binary.LittleEndian.Uint32(in[read:])
-	read += 4
-	ret := make([]colKeyVal, numCols, numCols)
-	for i := 0; i < int(numCols); i++ {
-		keyLen := binary.LittleEndian.Uint32(in[read:])
-		read += 4
-		valLen := binary.LittleEndian.Uint32(in[read:])
-		read += 4
-		k := in[read : read+int(keyLen)]
-		v := in[read : read+int(valLen)]
-		ret[i] = colKeyVal{k, v}
-	}
-	return ret, nil
-}
@@ -64,3 +64,57 @@ func TestDbFunctions(t *testing.T) {
 	})
 	// read both rows
 }
+
+func TestGetCols(t *testing.T) {
+	env := testEnv("/tmp/merchDbGetColsTest")
+	// neighbouring rows, including one whose key is a prefix, mustn't bleed into each other
+	_, err := runOp(env, PutCols, "row", "table", "colOne", "valOne", "colTwo", "valTwo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = runOp(env, PutCols, "row1", "table", "other", "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = runOp(env, PutCols, "ro", "table", "other", "y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectCols := func(name string, encoded []byte, err error, expected ...string) {
+		if err != nil {
+			t.Fatalf("%s : %s", name, err)
+		}
+		keyVals, err := DecodeCols(encoded)
+		if err != nil {
+			t.Fatalf("%s : %s", name, err)
+		}
+		got := make([]string, len(keyVals))
+		for i, kv := range keyVals {
+			got[i] = string(kv)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Fatalf("%s : expected %q got %q", name, expected, got)
+		}
+	}
+
+	// replicated reads run in a write txn, which GetRow and GetCols abort
+	encoded, err := runOp(env, GetCols, "row", "table", "colTwo", "missing")
+	expectCols("GetCols", encoded, err, "colTwo", "valTwo")
+	encoded, err = runOp(env, GetRow, "row", "table")
+	expectCols("GetRow", encoded, err, "colOne", "valOne", "colTwo", "valTwo")
+
+	// local reads run in a read-only txn
+	txn, err := env.BeginTxn(nil, mdb.RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txn.Abort()
+	encoded, err = ReadRow(txn, "table", []byte("row1"), nil)
+	expectCols("ReadRow", encoded, err, "other", "x")
+	encoded, err = ReadCols(txn, "table", []byte("row"), [][]byte{[]byte("colOne")})
+	expectCols("ReadCols", encoded, err, "colOne", "valOne")
+	encoded, err = ReadCols(txn, "table", []byte("absent"), nil)
+	expectCols("absent row", encoded, err)
+	encoded, err = ReadRow(txn, "noSuchTable", []byte("row"), nil)
+	expectCols("absent table", encoded, err)
+}
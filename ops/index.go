@@ -0,0 +1,316 @@
+package ops
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mdb "github.com/jbooth/gomdb"
+	"strings"
+)
+
+// index definitions live in a system table
+// key:  packed rowColKey of (tableName, indexName)
+// val:  json encoded indexDef
+//
+// each index gets its own dbi, named by indexDBIName
+// key:  packed rowColKey of (column value, rowKey)
+// val:  empty
+const indexMetaTable = "_indexes"
+
+// number of rows processed by a single BackfillIndex command
+const backfillChunkRows = 1000
+
+type indexDef struct {
+	Name   string `json:"-"`
+	Column string
+	// false until the backfill of pre-existing rows has completed
+	Ready bool
+}
+
+// index names can't contain '.', so the last one always separates table from index
+// and two indexes can't share a dbi
+func indexDBIName(table string, index string) string {
+	return systemPrefix + "idx." + table + "." + index
+}
+
+func (idx indexDef) dbi(txn *mdb.Txn, table string) (mdb.DBI, error) {
+	return openDBI(txn, indexDBIName(table, idx.Name))
+}
+
+func (idx indexDef) add(txn *mdb.Txn, table string, val []byte, rowKey []byte) error {
+	dbi, err := idx.dbi(txn, table)
+	if err != nil {
+		return err
+	}
+	return txn.Put(dbi, packRowColKey(rowColKey{val, rowKey}), nobytes, uint(0))
+}
+
+func (idx indexDef) remove(txn *mdb.Txn, table string, val []byte, rowKey []byte) error {
+	dbi, err := idx.dbi(txn, table)
+	if err != nil {
+		return err
+	}
+	err = txn.Del(dbi, packRowColKey(rowColKey{val, rowKey}), nil)
+	if err == mdb.NotFound {
+		// row may have been written before the backfill reached it
+		return nil
+	}
+	return err
+}
+
+// loads all index definitions for a table
+func tableIndexes(txn *mdb.Txn, table string) ([]indexDef, error) {
+	metaTable := indexMetaTable
+	dbi, err := txn.DBIOpen(&metaTable, 0)
+	if err == mdb.NotFound {
+		return []indexDef{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c, err := txn.CursorOpen(dbi)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	ret := make([]indexDef, 0)
+	err = doForRow(c, []byte(table), func(ckv colKeyVal) error {
+		idx := indexDef{}
+		err := json.Unmarshal(ckv.v, &idx)
+		if err != nil {
+			return err
+		}
+		idx.Name = string(ckv.k)
+		ret = append(ret, idx)
+		return nil
+	})
+	return ret, err
+}
+
+var ErrNoSuchIndex = errors.New("No such index")
+
+// loads an index definition in a write txn, along with the metadata dbi to update it in
+func getIndex(txn *mdb.Txn, table string, index string) (indexDef, mdb.DBI, error) {
+	dbi, err := openDBI(txn, indexMetaTable)
+	if err != nil {
+		return indexDef{}, dbi, err
+	}
+	idx, err := loadIndex(txn, dbi, table, index)
+	return idx, dbi, err
+}
+
+// like getIndex, but doesn't create the metadata dbi, so it works in read-only txns
+func readIndex(txn *mdb.Txn, table string, index string) (indexDef, error) {
+	metaTable := indexMetaTable
+	dbi, err := txn.DBIOpen(&metaTable, 0)
+	if err == mdb.NotFound {
+		return indexDef{}, fmt.Errorf("%w %s on table %s", ErrNoSuchIndex, index, table)
+	}
+	if err != nil {
+		return indexDef{}, err
+	}
+	return loadIndex(txn, dbi, table, index)
+}
+
+func loadIndex(txn *mdb.Txn, metaDbi mdb.DBI, table string, index string) (indexDef, error) {
+	idx := indexDef{}
+	defBytes, err := txn.Get(metaDbi, packRowColKey(rowColKey{[]byte(table), []byte(index)}))
+	if err == mdb.NotFound {
+		return idx, fmt.Errorf("%w %s on table %s", ErrNoSuchIndex, index, table)
+	}
+	if err != nil {
+		return idx, err
+	}
+	err = json.Unmarshal(defBytes, &idx)
+	idx.Name = index
+	return idx, err
+}
+
+// IndexExists returns whether the index has been created on table, whether or not it's ready
+func IndexExists(txn *mdb.Txn, table string, index string) (bool, error) {
+	_, err := readIndex(txn, table, index)
+	if errors.Is(err, ErrNoSuchIndex) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func putIndex(txn *mdb.Txn, metaDbi mdb.DBI, table string, idx indexDef) error {
+	defBytes, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	return txn.Put(metaDbi, packRowColKey(rowColKey{[]byte(table), []byte(idx.Name)}), defBytes, uint(0))
+}
+
+// defines a new index, writes from this point on will maintain it.
+// Rows written before the index existed are added by BackfillIndex.  Creating an
+// index that already exists on the same column does nothing, so the command can be
+// retried, while redefining it on another column is refused.
+// args:
+// 0: table name
+// 1: index name
+// 2: column name to index
+func CreateIndex(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+	if len(args) != 3 {
+		txn.Abort()
+		return nil, invalidf("CreateIndex requires table, index and column, got %d args", len(args))
+	}
+	table := string(args[0])
+	index := string(args[1])
+	if len(index) == 0 || strings.IndexByte(index, '.') >= 0 {
+		txn.Abort()
+		return nil, invalidf("Invalid index name %q, it must be non-empty and can't contain '.'", index)
+	}
+	if _, err := openTable(txn, table); err != nil {
+		txn.Abort()
+		return nil, err
+	}
+	existing, metaDbi, err := getIndex(txn, table, index)
+	if err == nil && existing.Column == string(args[2]) {
+		txn.Abort()
+		return nobytes, nil
+	}
+	if err == nil {
+		txn.Abort()
+		return nil, invalidf("Index %s already exists on table %s for column %s", index, table, existing.Column)
+	}
+	err = putIndex(txn, metaDbi, table, indexDef{index, string(args[2]), false})
+	if err != nil {
+		txn.Abort()
+		return nil, err
+	}
+	return nobytes, commit(txn)
+}
+
+// indexes up to backfillChunkRows pre-existing rows, starting at the provided row key.
+// Returns the row key to resume from, or an empty response once the index is complete,
+// at which point the index is marked ready for lookups.
+// args:
+// 0: table name
+// 1: index name
+// 2: row key to start from, empty to start at the beginning of the table
+func BackfillIndex(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+	if len(args) != 3 {
+		txn.Abort()
+		return nil, fmt.Errorf("BackfillIndex requires table, index and start row, got %d args", len(args))
+	}
+	table := string(args[0])
+	index := string(args[1])
+	t, err := openTable(txn, table)
+	if err != nil {
+		txn.Abort()
+		return nil, err
+	}
+	idx, metaDbi, err := getIndex(txn, table, index)
+	if err != nil {
+		txn.Abort()
+		return nil, err
+	}
+	// columns in a family are scanned from the family's dbi, where they're keyed by qualifier
+	dbi := t.dbi
+	f, col := t.family([]byte(idx.Column))
+	if f != nil {
+		dbi = f.dbi
+	}
+	var nextRow []byte = nil
+	if f == nil || f.hasData {
+		nextRow, err = backfillChunk(txn, table, idx, dbi, f, col, args[2])
+		if err != nil {
+			txn.Abort()
+			return nil, err
+		}
+	}
+	if nextRow == nil {
+		idx.Ready = true
+		err = putIndex(txn, metaDbi, table, idx)
+		if err != nil {
+			txn.Abort()
+			return nil, err
+		}
+		return nobytes, commit(txn)
+	}
+	return nextRow, commit(txn)
+}
+
+// indexes col in up to backfillChunkRows rows of dbi starting at startRow, returning
+// the row to resume from or nil if it reached the end.  f is the family dbi belongs to,
+// nil for the table's default storage.
+func backfillChunk(txn *mdb.Txn, table string, idx indexDef, dbi mdb.DBI, f *family, col []byte, startRow []byte) ([]byte, error) {
+	c, err := txn.CursorOpen(dbi)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	rowsSeen := 0
+	var lastRow []byte = nil
+	k, v, err := c.Get(packRowColKey(rowColKey{startRow, nobytes}), mdb.SET_RANGE)
+	for err == nil {
+		rcKey := splitRowColKey(k)
+		if lastRow == nil || !bytes.Equal(lastRow, rcKey.rowKey) {
+			if rowsSeen == backfillChunkRows {
+				return append(make([]byte, 0, len(rcKey.rowKey)), rcKey.rowKey...), nil
+			}
+			rowsSeen++
+			lastRow = rcKey.rowKey
+		}
+		if bytes.Equal(rcKey.colKey, col) {
+			val := v
+			if f != nil {
+				// like writes, index the most recently written version whether or not it has expired
+				cells, err := unpackCells(v)
+				if err != nil {
+					return nil, err
+				}
+				val = nil
+				if len(cells) > 0 {
+					val = cells[0].val
+				}
+			}
+			if val != nil {
+				err = idx.add(txn, table, val, rcKey.rowKey)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		k, v, err = c.Get(nil, mdb.NEXT)
+	}
+	if err != nil && err != mdb.NotFound {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// returns the keys of all rows in table where the indexed column equals value
+func LookupIndex(txn *mdb.Txn, table string, index string, value []byte) ([][]byte, error) {
+	idx, err := readIndex(txn, table, index)
+	if err != nil {
+		return nil, err
+	}
+	if !idx.Ready {
+		return nil, fmt.Errorf("Index %s on table %s is still being built", index, table)
+	}
+	ret := make([][]byte, 0)
+	dbiName := indexDBIName(table, index)
+	dbi, err := txn.DBIOpen(&dbiName, 0)
+	if err == mdb.NotFound {
+		// no rows have ever had a value for this column
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c, err := txn.CursorOpen(dbi)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	err = doForRow(c, value, func(ckv colKeyVal) error {
+		ret = append(ret, ckv.k)
+		return nil
+	})
+	return ret, err
+}
@@ -0,0 +1,170 @@
+package ops
+
+import (
+	"errors"
+	mdb "github.com/jbooth/gomdb"
+	"os"
+	"testing"
+)
+
+// opens a fresh mdb env at dbPath for tests
+func testEnv(dbPath string) *mdb.Env {
+	err := os.RemoveAll(dbPath)
+	if err != nil {
+		panic(err)
+	}
+	err = os.MkdirAll(dbPath, 0755)
+	if err != nil {
+		panic(err)
+	}
+	env, err := mdb.NewEnv()
+	if err != nil {
+		panic(err)
+	}
+	env.SetMaxDBs(mdb.DBI(1024))
+	env.SetMaxReaders(1024)
+	err = env.Open(dbPath, mdb.CREATE, uint(0755))
+	if err != nil {
+		panic(err)
+	}
+	return env
+}
+
+// runs a command in a new write txn
+func runOp(env *mdb.Env, op func([][]byte, *mdb.Txn) ([]byte, error), args ...string) ([]byte, error) {
+	txn, err := env.BeginTxn(nil, uint(0))
+	if err != nil {
+		panic(err)
+	}
+	byteArgs := make([][]byte, len(args))
+	for i, a := range args {
+		byteArgs[i] = []byte(a)
+	}
+	return op(byteArgs, txn)
+}
+
+func lookup(t *testing.T, env *mdb.Env, table string, index string, value string) []string {
+	txn, err := env.BeginTxn(nil, mdb.RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txn.Abort()
+	keys, err := LookupIndex(txn, table, index, []byte(value))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret := make([]string, len(keys))
+	for i, k := range keys {
+		ret[i] = string(k)
+	}
+	return ret
+}
+
+func expectKeys(t *testing.T, got []string, expected ...string) {
+	if len(got) != len(expected) {
+		t.Fatalf("Expected keys %v, got %v", expected, got)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Fatalf("Expected keys %v, got %v", expected, got)
+		}
+	}
+}
+
+func TestIndex(t *testing.T) {
+	env := testEnv("/tmp/merchDbIndexTest")
+
+	// lookups in a fresh store don't try to create anything in their read txn
+	txn, err := env.BeginTxn(nil, mdb.RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LookupIndex(txn, "users", "byEmail", []byte("a@b.com"))
+	txn.Abort()
+	if !errors.Is(err, ErrNoSuchIndex) {
+		t.Fatalf("Expected ErrNoSuchIndex before any index exists, got %v", err)
+	}
+
+	// rows written before the index exists
+	_, err = runOp(env, PutCols, "row1", "users", "email", "a@b.com", "name", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = runOp(env, PutCols, "row2", "users", "email", "c@d.com", "name", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = runOp(env, CreateIndex, "users", "byEmail", "email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = runOp(env, CreateIndex, "users", "byEmail", "name")
+	if !IsInvalid(err) {
+		t.Fatalf("Expected error redefining index, got %v", err)
+	}
+	// creating it again as it is changes nothing, so retries are safe
+	_, err = runOp(env, CreateIndex, "users", "byEmail", "email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// index a.b on users and index b on users.a would share the dbi _idx.users.a.b
+	for _, name := range []string{"", "a.b"} {
+		_, err = runOp(env, CreateIndex, "users", name, "name")
+		if !IsInvalid(err) {
+			t.Fatalf("Expected index name %q to be rejected, got %v", name, err)
+		}
+	}
+	// not ready until backfilled
+	txn, _ = env.BeginTxn(nil, mdb.RDONLY)
+	_, err = LookupIndex(txn, "users", "byEmail", []byte("a@b.com"))
+	txn.Abort()
+	if err == nil {
+		t.Fatal("Expected error looking up unbuilt index")
+	}
+	next, err := runOp(env, BackfillIndex, "users", "byEmail", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(next) != 0 {
+		t.Fatalf("Expected backfill to finish in one chunk, got resume key %s", string(next))
+	}
+	expectKeys(t, lookup(t, env, "users", "byEmail", "a@b.com"), "row1")
+
+	// writes after the index exists maintain it
+	_, err = runOp(env, PutCols, "row3", "users", "email", "a@b.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeys(t, lookup(t, env, "users", "byEmail", "a@b.com"), "row1", "row3")
+	_, err = runOp(env, PutCols, "row1", "users", "email", "e@f.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeys(t, lookup(t, env, "users", "byEmail", "a@b.com"), "row3")
+	expectKeys(t, lookup(t, env, "users", "byEmail", "e@f.com"), "row1")
+	_, err = runOp(env, PutRow, "row3", "users", "name", "noEmail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeys(t, lookup(t, env, "users", "byEmail", "a@b.com"))
+	_, err = runOp(env, DelRow, "row2", "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeys(t, lookup(t, env, "users", "byEmail", "c@d.com"))
+
+	// the last value for a column given twice wins, and only it is indexed
+	_, err = runOp(env, PutCols, "row4", "users", "email", "g@h.com", "email", "i@j.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeys(t, lookup(t, env, "users", "byEmail", "g@h.com"))
+	expectKeys(t, lookup(t, env, "users", "byEmail", "i@j.com"), "row4")
+	_, err = runOp(env, PutCols, "row4", "users", "email", "k@l.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectKeys(t, lookup(t, env, "users", "byEmail", "i@j.com"))
+	expectKeys(t, lookup(t, env, "users", "byEmail", "k@l.com"), "row4")
+}
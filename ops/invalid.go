@@ -0,0 +1,27 @@
+package ops
+
+import (
+	"errors"
+	"fmt"
+)
+
+// InvalidError is returned for commands that are rejected because of what they ask
+// for, like a write that doesn't fit its table's schema, as opposed to ones that
+// failed to apply.  Servers answer these with a 400.
+type InvalidError struct {
+	Msg string
+}
+
+func (e *InvalidError) Error() string {
+	return e.Msg
+}
+
+func invalidf(format string, args ...interface{}) error {
+	return &InvalidError{fmt.Sprintf(format, args...)}
+}
+
+// IsInvalid returns whether err is, or wraps, an InvalidError
+func IsInvalid(err error) bool {
+	var invalid *InvalidError
+	return errors.As(err, &invalid)
+}
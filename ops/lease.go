@@ -0,0 +1,102 @@
+package ops
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	mdb "github.com/jbooth/gomdb"
+)
+
+// flotilla.DefaultOpsDB doesn't say which node is raft's leader, so nodes take turns
+// holding a lease through raft instead, and the holder acts as the leader for
+// forwarding and status.  Only nodes that can commit through raft can take or renew
+// it, so a node cut off from the majority loses it once it expires.
+//
+// the current lease lives in a system table
+// key:  leaseKey
+// val:  json encoded Lease
+const leaseMetaTable = "_lease"
+
+var leaseKey = []byte("leader")
+
+type Lease struct {
+	// flotilla address of the node holding the lease
+	Holder string
+	// UnixNano time the lease runs out, by the holder's clock
+	Expires int64
+	// bumped every time the lease changes hands
+	Epoch uint64
+}
+
+// takes or renews the leader lease, unless another node holds one that hasn't
+// expired as of the requesting node's clock.  Responds with the json encoded
+// lease after the command, whoever holds it.
+// args:
+// 0: flotilla address of the requesting node
+// 1: 8 byte time of the request, from Timestamp()
+// 2: 8 byte duration of the lease in nanoseconds
+func AcquireLease(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+	if len(args) != 3 || len(args[1]) != 8 || len(args[2]) != 8 {
+		txn.Abort()
+		return nil, fmt.Errorf("AcquireLease requires holder, 8 byte time and 8 byte duration")
+	}
+	holder := string(args[0])
+	now := int64(binary.LittleEndian.Uint64(args[1]))
+	ttl := int64(binary.LittleEndian.Uint64(args[2]))
+	dbi, err := openDBI(txn, leaseMetaTable)
+	if err != nil {
+		txn.Abort()
+		return nil, err
+	}
+	lease, err := getLease(txn, dbi)
+	if err != nil {
+		txn.Abort()
+		return nil, err
+	}
+	if lease.Holder != holder && now < lease.Expires {
+		txn.Abort()
+		return json.Marshal(lease)
+	}
+	if lease.Holder != holder {
+		lease.Epoch++
+		lease.Holder = holder
+	}
+	lease.Expires = now + ttl
+	leaseBytes, err := json.Marshal(lease)
+	if err != nil {
+		txn.Abort()
+		return nil, err
+	}
+	err = txn.Put(dbi, leaseKey, leaseBytes, uint(0))
+	if err != nil {
+		txn.Abort()
+		return nil, err
+	}
+	return leaseBytes, commit(txn)
+}
+
+// ReadLease returns the current leader lease, with an empty holder if there's never been one
+func ReadLease(txn *mdb.Txn) (*Lease, error) {
+	metaTable := leaseMetaTable
+	dbi, err := txn.DBIOpen(&metaTable, 0)
+	if err == mdb.NotFound {
+		return &Lease{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return getLease(txn, dbi)
+}
+
+func getLease(txn *mdb.Txn, dbi mdb.DBI) (*Lease, error) {
+	lease := &Lease{}
+	leaseBytes, err := txn.Get(dbi, leaseKey)
+	if err == mdb.NotFound {
+		return lease, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(leaseBytes, lease)
+	return lease, err
+}
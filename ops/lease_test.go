@@ -0,0 +1,63 @@
+package ops
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	mdb "github.com/jbooth/gomdb"
+	"testing"
+	"time"
+)
+
+func TestAcquireLease(t *testing.T) {
+	env := testEnv("/tmp/merchDbLeaseTest")
+	start := time.Unix(1000, 0)
+	ttl := make([]byte, 8)
+	binary.LittleEndian.PutUint64(ttl, uint64(3*time.Second))
+	acquire := func(holder string, at time.Time) *Lease {
+		txn, err := env.BeginTxn(nil, uint(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := AcquireLease([][]byte{[]byte(holder), Timestamp(at), ttl}, txn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lease := &Lease{}
+		err = json.Unmarshal(resp, lease)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return lease
+	}
+	for _, c := range []struct {
+		holder    string
+		at        time.Time
+		expHolder string
+		expEpoch  uint64
+	}{
+		{"a:1", start, "a:1", 1},
+		// b can't take it until it runs out
+		{"b:1", start.Add(time.Second), "a:1", 1},
+		// renewing keeps the epoch
+		{"a:1", start.Add(2 * time.Second), "a:1", 1},
+		{"b:1", start.Add(4 * time.Second), "a:1", 1},
+		{"b:1", start.Add(5 * time.Second), "b:1", 2},
+	} {
+		lease := acquire(c.holder, c.at)
+		if lease.Holder != c.expHolder || lease.Epoch != c.expEpoch {
+			t.Fatalf("%s at %s : expected %s in epoch %d, got %+v", c.holder, c.at, c.expHolder, c.expEpoch, lease)
+		}
+	}
+	txn, err := env.BeginTxn(nil, mdb.RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txn.Abort()
+	lease, err := ReadLease(txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.Holder != "b:1" || lease.Expires != start.Add(8*time.Second).UnixNano() {
+		t.Fatalf("Unexpected lease %+v", lease)
+	}
+}
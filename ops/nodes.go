@@ -0,0 +1,78 @@
+package ops
+
+import (
+	"fmt"
+	mdb "github.com/jbooth/gomdb"
+)
+
+// web addresses for each node, so any node can send clients to the leader
+// key:  flotilla address, as reported by raft
+// val:  web address
+const nodeMetaTable = "_nodes"
+
+// records the web address for a node, an empty web address removes the node
+// args:
+// 0: flotilla address
+// 1: web address
+func RegisterNode(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+	if len(args) != 2 {
+		txn.Abort()
+		return nil, fmt.Errorf("RegisterNode requires flotilla and web addresses, got %d args", len(args))
+	}
+	dbi, err := openDBI(txn, nodeMetaTable)
+	if err != nil {
+		txn.Abort()
+		return nil, err
+	}
+	if len(args[1]) == 0 {
+		err = txn.Del(dbi, args[0], nil)
+		if err == mdb.NotFound {
+			err = nil
+		}
+	} else {
+		err = txn.Put(dbi, args[0], args[1], uint(0))
+	}
+	if err != nil {
+		txn.Abort()
+		return nil, err
+	}
+	return nobytes, commit(txn)
+}
+
+// returns the web address of every registered node, keyed by flotilla address
+func Nodes(txn *mdb.Txn) (map[string]string, error) {
+	ret := make(map[string]string)
+	metaTable := nodeMetaTable
+	dbi, err := txn.DBIOpen(&metaTable, 0)
+	if err == mdb.NotFound {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = forEachEntry(txn, dbi, func(k []byte, v []byte) error {
+		ret[string(k)] = string(v)
+		return nil
+	})
+	return ret, err
+}
+
+// returns the registered web address for a node's flotilla address
+func NodeWebAddr(txn *mdb.Txn, flotillaAddr string) (string, error) {
+	metaTable := nodeMetaTable
+	dbi, err := txn.DBIOpen(&metaTable, 0)
+	if err == mdb.NotFound {
+		return "", fmt.Errorf("No web address registered for node %s", flotillaAddr)
+	}
+	if err != nil {
+		return "", err
+	}
+	webAddr, err := txn.Get(dbi, []byte(flotillaAddr))
+	if err == mdb.NotFound {
+		return "", fmt.Errorf("No web address registered for node %s", flotillaAddr)
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(webAddr), nil
+}
@@ -20,11 +20,58 @@ var (
 	PUTROW  string = "PutRow"
 	DELROW  string = "DelRow"
 
+	CREATEINDEX   string = "CreateIndex"
+	BACKFILLINDEX string = "BackfillIndex"
+	SETSCHEMA     string = "SetSchema"
+	SETFAMILY     string = "SetFamily"
+	IMPORTCOLS    string = "ImportCols"
+	BARRIER       string = "Barrier"
+	REGISTERNODE  string = "RegisterNode"
+	SETACL        string = "SetACL"
+	BATCHPUTCOLS  string = "BatchPutCols"
+	MIGRATEKEYS   string = "MigrateKeys"
+	ACQUIRELEASE  string = "AcquireLease"
+
 	Ops map[string]flotilla.Command = map[string]flotilla.Command{
 		GETCOLS: GetCols,
 		PUTCOLS: PutCols,
 		GETROW:  GetRow,
 		PUTROW:  PutRow,
 		DELROW:  DelRow,
+
+		CREATEINDEX:   CreateIndex,
+		BACKFILLINDEX: BackfillIndex,
+		SETSCHEMA:     SetSchema,
+		SETFAMILY:     SetFamily,
+		IMPORTCOLS:    ImportCols,
+		BARRIER:       Barrier,
+		REGISTERNODE:  RegisterNode,
+		SETACL:        SetACL,
+		BATCHPUTCOLS:  BatchPutCols,
+		MIGRATEKEYS:   MigrateKeys,
+		ACQUIRELEASE:  AcquireLease,
+	}
+
+	// position of the table name in each op's args, for ops that have one
+	tableArgs map[string]int = map[string]int{
+		GETCOLS:       1,
+		PUTCOLS:       1,
+		GETROW:        1,
+		PUTROW:        1,
+		DELROW:        1,
+		CREATEINDEX:   0,
+		BACKFILLINDEX: 0,
+		SETSCHEMA:     0,
+		SETFAMILY:     0,
+		IMPORTCOLS:    0,
 	}
 )
+
+// returns the table an op's args refer to, or the empty string if it doesn't refer to one
+func OpTable(op string, args [][]byte) string {
+	idx, ok := tableArgs[op]
+	if !ok || idx >= len(args) {
+		return ""
+	}
+	return string(args[idx])
+}
@@ -0,0 +1,48 @@
+package ops
+
+import (
+	mdb "github.com/jbooth/gomdb"
+	"testing"
+	"time"
+)
+
+// every op has to commit or abort its txn, even for args it rejects, or the next
+// write blocks forever
+func TestOpsFinishTxn(t *testing.T) {
+	env := testEnv("/tmp/merchDbOpsFinishTxnTest")
+	badArgs := [][][]byte{
+		{},
+		{[]byte("x")},
+		{[]byte("x"), []byte("_acls")},
+		{[]byte("_acls"), []byte("x"), []byte("y")},
+	}
+	for name, op := range Ops {
+		for _, args := range badArgs {
+			txn, err := env.BeginTxn(nil, uint(0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						t.Fatalf("%s panicked with %d args : %v", name, len(args), r)
+					}
+				}()
+				op(args, txn)
+			}()
+			began := make(chan *mdb.Txn, 1)
+			go func() {
+				next, _ := env.BeginTxn(nil, uint(0))
+				began <- next
+			}()
+			select {
+			case next := <-began:
+				if next != nil {
+					next.Abort()
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("%s left its txn open with %d args", name, len(args))
+			}
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package ops
+
+import (
+	"encoding/json"
+	"fmt"
+	mdb "github.com/jbooth/gomdb"
+	"strconv"
+	"unicode/utf8"
+)
+
+// schemas live in a system table
+// key:  table name
+// val:  json encoded Schema
+const schemaMetaTable = "_schemas"
+
+type ColType string
+
+const (
+	STRING  ColType = "string"
+	INT64   ColType = "int64"
+	FLOAT64 ColType = "float64"
+	BOOL    ColType = "bool"
+	BYTES   ColType = "bytes"
+	JSON    ColType = "json"
+)
+
+type ColumnSchema struct {
+	Type     ColType
+	Required bool
+	// max size of the value in bytes, 0 for unlimited
+	MaxSize int
+}
+
+// optional per-table schema, tables without one accept any column as raw bytes
+type Schema struct {
+	Columns map[string]ColumnSchema
+	// if true, columns not declared in Columns are rejected
+	Strict bool
+}
+
+// checks that every declared column has a known type
+func (s *Schema) check() error {
+	for name, col := range s.Columns {
+		switch col.Type {
+		case STRING, INT64, FLOAT64, BOOL, BYTES, JSON:
+		default:
+			return fmt.Errorf("Column %s has unknown type %s", name, col.Type)
+		}
+		if col.MaxSize < 0 {
+			return fmt.Errorf("Column %s has negative MaxSize %d", name, col.MaxSize)
+		}
+	}
+	return nil
+}
+
+// checks a single column value against the schema
+func (s *Schema) validateCol(col []byte, val []byte) error {
+	colSchema, ok := s.Columns[string(col)]
+	if !ok {
+		if s.Strict {
+			return fmt.Errorf("Column %s is not declared in the schema", string(col))
+		}
+		return nil
+	}
+	if colSchema.MaxSize > 0 && len(val) > colSchema.MaxSize {
+		return fmt.Errorf("Value for column %s is %d bytes, max is %d", string(col), len(val), colSchema.MaxSize)
+	}
+	var err error = nil
+	switch colSchema.Type {
+	case STRING:
+		if !utf8.Valid(val) {
+			err = fmt.Errorf("not valid utf8")
+		}
+	case INT64:
+		_, err = strconv.ParseInt(string(val), 10, 64)
+	case FLOAT64:
+		_, err = strconv.ParseFloat(string(val), 64)
+	case BOOL:
+		_, err = strconv.ParseBool(string(val))
+	case JSON:
+		if !json.Valid(val) {
+			err = fmt.Errorf("not valid json")
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Value for column %s is not a valid %s : %s", string(col), colSchema.Type, err)
+	}
+	return nil
+}
+
+// Render converts a stored column value into a value that encoding/json will render
+// according to the column's declared type.  Undeclared columns and values that
+// don't parse render as strings.  Safe to call on a nil schema.
+func (s *Schema) Render(col string, val []byte) interface{} {
+	if s == nil {
+		return string(val)
+	}
+	switch s.Columns[col].Type {
+	case INT64:
+		if i, err := strconv.ParseInt(string(val), 10, 64); err == nil {
+			return i
+		}
+	case FLOAT64:
+		if f, err := strconv.ParseFloat(string(val), 64); err == nil {
+			return f
+		}
+	case BOOL:
+		if b, err := strconv.ParseBool(string(val)); err == nil {
+			return b
+		}
+	case JSON:
+		if json.Valid(val) {
+			return json.RawMessage(val)
+		}
+	case BYTES:
+		// base64 encoded by encoding/json
+		return val
+	}
+	return string(val)
+}
+
+// loads the schema for a table, returns nil if the table doesn't have one
+func GetSchema(txn *mdb.Txn, table string) (*Schema, error) {
+	metaTable := schemaMetaTable
+	dbi, err := txn.DBIOpen(&metaTable, 0)
+	if err == mdb.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	schemaBytes, err := txn.Get(dbi, []byte(table))
+	if err == mdb.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &Schema{}
+	err = json.Unmarshal(schemaBytes, s)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// sets or replaces the schema for a table.  Only applies to subsequent writes,
+// existing data is not revalidated.
+// args:
+// 0: table name
+// 1: json encoded Schema, or empty to remove the table's schema
+func SetSchema(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+	if len(args) != 2 {
+		txn.Abort()
+		return nil, invalidf("SetSchema requires table and schema, got %d args", len(args))
+	}
+	table := string(args[0])
+	if isSystemTable(table) {
+		txn.Abort()
+		return nil, invalidf("Table name %s is reserved", table)
+	}
+	dbi, err := openDBI(txn, schemaMetaTable)
+	if err != nil {
+		txn.Abort()
+		return nil, err
+	}
+	if len(args[1]) == 0 {
+		err = txn.Del(dbi, args[0], nil)
+		if err != nil && err != mdb.NotFound {
+			txn.Abort()
+			return nil, err
+		}
+		return nobytes, commit(txn)
+	}
+	s := &Schema{}
+	err = json.Unmarshal(args[1], s)
+	if err == nil {
+		err = s.check()
+	}
+	if err != nil {
+		txn.Abort()
+		return nil, invalidf("Invalid schema for table %s : %s", table, err)
+	}
+	err = txn.Put(dbi, args[0], args[1], uint(0))
+	if err != nil {
+		txn.Abort()
+		return nil, err
+	}
+	return nobytes, commit(txn)
+}
@@ -0,0 +1,94 @@
+package ops
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSchema(t *testing.T) {
+	env := testEnv("/tmp/merchDbSchemaTest")
+	schema := `{"Columns": {
+		"age": {"Type": "int64", "Required": true},
+		"score": {"Type": "float64"},
+		"active": {"Type": "bool"},
+		"meta": {"Type": "json"},
+		"name": {"Type": "string", "MaxSize": 5}
+	}}`
+	_, err := runOp(env, SetSchema, "people", `{"Columns": {"age": {"Type": "int32"}}}`)
+	if err == nil {
+		t.Fatal("Expected error setting schema with unknown type")
+	}
+	_, err = runOp(env, SetSchema, "people", schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	badWrites := [][]string{
+		{"row1", "people", "name", "bob"},                     // missing required age
+		{"row1", "people", "age", "ten"},                      // not an int
+		{"row1", "people", "age", "10", "name", "robert"},     // name too long
+		{"row1", "people", "age", "10", "active", "maybe"},    // not a bool
+		{"row1", "people", "age", "10", "meta", "{not json"},  // not json
+		{"row1", "people", "age", "10", "score", "1.5points"}, // not a float
+	}
+	for _, w := range badWrites {
+		_, err = runOp(env, PutCols, w...)
+		if err == nil {
+			t.Fatalf("Expected error for write %v", w)
+		}
+	}
+	_, err = runOp(env, PutCols, "row1", "people", "age", "10", "score", "1.5", "meta", `{"a":1}`, "extra", "ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// age already present in the row
+	_, err = runOp(env, PutCols, "row1", "people", "active", "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// but PutRow replaces the whole row
+	_, err = runOp(env, PutRow, "row1", "people", "active", "true")
+	if err == nil {
+		t.Fatal("Expected error replacing row without required column")
+	}
+
+	// strict schemas reject undeclared columns
+	_, err = runOp(env, SetSchema, "strict", `{"Columns": {"a": {"Type": "string"}}, "Strict": true}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = runOp(env, PutCols, "row1", "strict", "b", "val")
+	if err == nil {
+		t.Fatal("Expected error writing undeclared column to strict table")
+	}
+
+	// rendering
+	txn, err := env.BeginTxn(nil, uint(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := GetSchema(txn, "people")
+	txn.Abort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rendered := map[string]interface{}{
+		"age":    s.Render("age", []byte("10")),
+		"score":  s.Render("score", []byte("1.5")),
+		"active": s.Render("active", []byte("true")),
+		"meta":   s.Render("meta", []byte(`{"a":1}`)),
+		"extra":  s.Render("extra", []byte("ok")),
+	}
+	out, err := json.Marshal(rendered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"active":true,"age":10,"extra":"ok","meta":{"a":1},"score":1.5}`
+	if string(out) != expected {
+		t.Fatalf("Expected %s, got %s", expected, string(out))
+	}
+	var noSchema *Schema = nil
+	if noSchema.Render("age", []byte("10")) != "10" {
+		t.Fatal("Expected nil schema to render strings")
+	}
+}
@@ -0,0 +1,349 @@
+package ops
+
+import (
+	"encoding/binary"
+	mdb "github.com/jbooth/gomdb"
+	"strings"
+)
+
+// table names starting with this prefix are reserved for merchdb's own metadata
+const systemPrefix = "_"
+
+func isSystemTable(name string) bool {
+	return strings.HasPrefix(name, systemPrefix)
+}
+
+// opens the named dbi, only passing mdb.CREATE if it doesn't exist yet so that
+// read transactions can open existing metadata tables
+func openDBI(txn *mdb.Txn, name string) (mdb.DBI, error) {
+	dbi, err := txn.DBIOpen(&name, 0)
+	if err == mdb.NotFound {
+		return txn.DBIOpen(&name, mdb.CREATE)
+	}
+	return dbi, err
+}
+
+// a user table as seen from within a single transaction, along with the metadata
+// we need to keep derived data consistent when writing to it
+type table struct {
+	name     string
+	dbi      mdb.DBI
+	schema   *Schema
+	indexes  []indexDef
+	families map[string]*family
+}
+
+// opens the named user table and loads its metadata, creating the table if needed
+func openTable(txn *mdb.Txn, name string) (*table, error) {
+	if isSystemTable(name) {
+		return nil, invalidf("Table name %s is reserved, names starting with %s are for internal use", name, systemPrefix)
+	}
+	_, err := txn.DBIOpen(&name, 0)
+	if err == mdb.NotFound {
+		// has to be recorded before the table exists, see markKeyFormat
+		err = markKeyFormat(txn, name)
+	} else if err == nil {
+		err = checkKeyFormat(txn, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	dbi, err := openDBI(txn, name)
+	if err != nil {
+		return nil, err
+	}
+	return loadTable(txn, name, dbi)
+}
+
+// like openTable, but returns nil if the table doesn't exist rather than creating
+// it, so it works in read-only txns
+func openExistingTable(txn *mdb.Txn, name string) (*table, error) {
+	if isSystemTable(name) {
+		return nil, invalidf("Table name %s is reserved, names starting with %s are for internal use", name, systemPrefix)
+	}
+	dbi, err := txn.DBIOpen(&name, 0)
+	if err == mdb.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = checkKeyFormat(txn, name)
+	if err != nil {
+		return nil, err
+	}
+	return loadTable(txn, name, dbi)
+}
+
+// reads the metadata for a table that's been opened
+func loadTable(txn *mdb.Txn, name string, dbi mdb.DBI) (*table, error) {
+	schema, err := GetSchema(txn, name)
+	if err != nil {
+		return nil, err
+	}
+	indexes, err := tableIndexes(txn, name)
+	if err != nil {
+		return nil, err
+	}
+	families, err := tableFamilies(txn, name)
+	if err != nil {
+		return nil, err
+	}
+	return &table{name, dbi, schema, indexes, families}, nil
+}
+
+// returns the family a column belongs to along with its qualifier,
+// or nil and the full column name if it's in the default storage
+func (t *table) family(col []byte) (*family, []byte) {
+	fam, qualifier := splitFamily(col)
+	if fam == nil {
+		return nil, col
+	}
+	f, ok := t.families[string(fam)]
+	if !ok {
+		return nil, col
+	}
+	return f, qualifier
+}
+
+// checks cols against the table's schema before writing them.
+// if replacing is true, cols will be the entire row, otherwise they're merged with
+// the existing row when checking for required columns
+func (t *table) validate(txn *mdb.Txn, rowKey []byte, cols []colKeyVal, ts int64, replacing bool) error {
+	if t.schema == nil {
+		return nil
+	}
+	for _, col := range cols {
+		err := t.schema.validateCol(col.k, col.v)
+		if err != nil {
+			return invalidf("Invalid write to table %s rowKey %s : %s", t.name, string(rowKey), err)
+		}
+	}
+	for colName, colSchema := range t.schema.Columns {
+		if !colSchema.Required {
+			continue
+		}
+		present := false
+		for _, col := range cols {
+			if string(col.k) == colName {
+				present = true
+				break
+			}
+		}
+		if !present && !replacing {
+			val, err := t.getCol(txn, rowKey, []byte(colName), ts)
+			if err != nil {
+				return err
+			}
+			present = val != nil
+		}
+		if !present {
+			return invalidf("Invalid write to table %s rowKey %s : missing required column %s", t.name, string(rowKey), colName)
+		}
+	}
+	return nil
+}
+
+// puts the provided columns written at ts, updating any indexes on them
+func (t *table) putCols(txn *mdb.Txn, rowKey []byte, cols []colKeyVal, ts int64) error {
+	defaultCols := make([]colKeyVal, 0, len(cols))
+	for _, col := range cols {
+		var prev []byte = nil
+		var err error = nil
+		f, qualifier := t.family(col.k)
+		if f == nil {
+			defaultCols = append(defaultCols, col)
+			if len(t.indexes) > 0 {
+				prev, err = txn.Get(t.dbi, packRowColKey(rowColKey{rowKey, col.k}))
+				if err == mdb.NotFound {
+					prev, err = nil, nil
+				}
+			}
+		} else {
+			prev, err = f.put(txn, t.name, rowKey, qualifier, col.v, ts)
+		}
+		if err != nil {
+			return err
+		}
+		err = t.reindex(txn, rowKey, col.k, prev, col.v)
+		if err != nil {
+			return err
+		}
+	}
+	return putCols(txn, t.dbi, rowKey, defaultCols)
+}
+
+// moves the row from prev to val in any indexes on col, either may be nil
+func (t *table) reindex(txn *mdb.Txn, rowKey []byte, col []byte, prev []byte, val []byte) error {
+	for _, idx := range t.indexes {
+		if idx.Column != string(col) {
+			continue
+		}
+		if prev != nil {
+			err := idx.remove(txn, t.name, prev, rowKey)
+			if err != nil {
+				return err
+			}
+		}
+		if val != nil {
+			err := idx.add(txn, t.name, val, rowKey)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deletes all columns for the row in every family, removing them from any indexes
+func (t *table) delRow(txn *mdb.Txn, rowKey []byte) error {
+	if len(t.indexes) > 0 {
+		c, err := txn.CursorOpen(t.dbi)
+		if err != nil {
+			return err
+		}
+		err = doForRow(c, rowKey, func(ckv colKeyVal) error {
+			return t.reindex(txn, rowKey, ckv.k, ckv.v, nil)
+		})
+		c.Close()
+		if err != nil {
+			return err
+		}
+	}
+	for _, f := range t.families {
+		if !f.hasData {
+			continue
+		}
+		if len(t.indexes) > 0 {
+			// index entries are for the newest live value as of the last write,
+			// so don't filter by TTL here
+			famCols, err := f.getRow(txn, rowKey, 0)
+			if err != nil {
+				return err
+			}
+			for _, col := range famCols {
+				err = t.reindex(txn, rowKey, col.k, col.v, nil)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		err := delRow(txn, f.dbi, rowKey)
+		if err != nil {
+			return err
+		}
+	}
+	return delRow(txn, t.dbi, rowKey)
+}
+
+// returns the newest live value of a single column as of now, nil if it isn't set
+func (t *table) getCol(txn *mdb.Txn, rowKey []byte, col []byte, now int64) ([]byte, error) {
+	f, qualifier := t.family(col)
+	if f != nil {
+		return f.get(txn, rowKey, qualifier, now)
+	}
+	val, err := txn.Get(t.dbi, packRowColKey(rowColKey{rowKey, col}))
+	if err == mdb.NotFound {
+		return nil, nil
+	}
+	return val, err
+}
+
+// returns the columns in the row belonging to the provided families, where the
+// empty family name selects the default storage.  If families is nil, returns all columns.
+func (t *table) getRow(txn *mdb.Txn, rowKey []byte, families [][]byte, now int64) ([]colKeyVal, error) {
+	ret := make([]colKeyVal, 0)
+	if families == nil || matchesAny(nobytes, families) {
+		defaultCols, err := getCols(txn, t.dbi, rowKey, nil)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, defaultCols...)
+	}
+	for name, f := range t.families {
+		if families != nil && !matchesAny([]byte(name), families) {
+			continue
+		}
+		famCols, err := f.getRow(txn, rowKey, now)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, famCols...)
+	}
+	return ret, nil
+}
+
+// returns the selected columns from the row, or all of them if cols is nil
+func (t *table) getCols(txn *mdb.Txn, rowKey []byte, cols [][]byte, now int64) ([]colKeyVal, error) {
+	if cols == nil {
+		return t.getRow(txn, rowKey, nil, now)
+	}
+	defaultCols := make([][]byte, 0, len(cols))
+	ret := make([]colKeyVal, 0, len(cols))
+	for _, col := range cols {
+		f, qualifier := t.family(col)
+		if f == nil {
+			defaultCols = append(defaultCols, col)
+			continue
+		}
+		val, err := f.get(txn, rowKey, qualifier, now)
+		if err != nil {
+			return nil, err
+		}
+		if val != nil {
+			ret = append(ret, colKeyVal{col, val})
+		}
+	}
+	if len(defaultCols) > 0 {
+		fromDefault, err := getCols(txn, t.dbi, rowKey, defaultCols)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, fromDefault...)
+	}
+	return ret, nil
+}
+
+// splits the args to PutCols and PutRow into row key, table, columns and write timestamp
+// args:
+// 0: row key
+// 1: table name
+// 2-N: col key,val pairs
+// N+1: optional 8 byte timestamp from Timestamp(), 0 if not provided
+func parseWriteArgs(args [][]byte) (rowKey []byte, table string, cols []colKeyVal, ts int64, err error) {
+	if len(args) < 2 {
+		return nil, "", nil, 0, invalidf("Write requires row key and table name, got %d args", len(args))
+	}
+	rowKey = args[0]
+	table = string(args[1])
+	keyValBytes := args[2:]
+	if len(keyValBytes)%2 != 0 {
+		tsBytes := keyValBytes[len(keyValBytes)-1]
+		if len(tsBytes) != 8 {
+			return nil, "", nil, 0, invalidf("Had odd number of column keyVals on insert to table %s rowKey %s", table, string(rowKey))
+		}
+		ts = int64(binary.LittleEndian.Uint64(tsBytes))
+		keyValBytes = keyValBytes[:len(keyValBytes)-1]
+	}
+	// a column named twice keeps its last value, writing both would leave an index
+	// entry for the first behind
+	cols = make([]colKeyVal, 0, len(keyValBytes)/2)
+	seen := make(map[string]int, len(keyValBytes)/2)
+	for i := 0; i < int(len(keyValBytes)/2); i++ {
+		col := colKeyVal{keyValBytes[i*2], keyValBytes[(i*2)+1]}
+		if prev, ok := seen[string(col.k)]; ok {
+			cols[prev] = col
+			continue
+		}
+		seen[string(col.k)] = len(cols)
+		cols = append(cols, col)
+	}
+	return rowKey, table, cols, ts, nil
+}
+
+// does nothing, once a Barrier command has returned on a node that node has
+// applied every command committed before it
+func Barrier(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+	txn.Abort()
+	return nobytes, nil
+}
@@ -0,0 +1,68 @@
+package merchdb
+
+import (
+	"encoding/json"
+	ops "github.com/jbooth/merchdb/ops"
+	"net"
+	"net/http"
+	"sort"
+)
+
+// url is formatted like /admin/peers
+// lists the flotilla addresses of the cluster's members along with the current leader
+func (s *Server) HandlePeers(w http.ResponseWriter, r *http.Request) {
+	peers, err := s.Peers()
+	response := &PeersResponse{Ok: true, Peers: peers}
+	if err != nil {
+		response.Ok = false
+		response.Err = err.Error()
+	}
+	if l, ok := s.flotilla.(leaderer); ok {
+		if leader := l.Leader(); leader != nil {
+			response.Leader = leader.String()
+		}
+	}
+	w.Header().Add("Content-Type", "application-json")
+	enc := json.NewEncoder(w)
+	err = enc.Encode(response)
+	if err != nil {
+		s.reqLog(r).Error("Error encoding response", "err", err)
+	}
+}
+
+// returns the current raft configuration if our flotilla reports it, otherwise
+// every node that's registered its web address, which all nodes agree on.  Until
+// any have, returns the peers we were started with.
+func (s *Server) Peers() ([]string, error) {
+	if lister, ok := s.flotilla.(peerLister); ok {
+		return lister.Peers()
+	}
+	txn, err := s.flotilla.Read()
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := ops.Nodes(txn)
+	txn.Abort()
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) == 0 {
+		s.peersLock.RLock()
+		defer s.peersLock.RUnlock()
+		return append(make([]string, 0, len(s.peers)), s.peers...), nil
+	}
+	ret := make([]string, 0, len(nodes))
+	for addr := range nodes {
+		ret = append(ret, addr)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// raft reports resolved addresses, so nodes are registered under the same form
+func resolvedAddr(addr string) string {
+	if resolved, err := net.ResolveTCPAddr("tcp", addr); err == nil {
+		return resolved.String()
+	}
+	return addr
+}
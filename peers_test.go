@@ -0,0 +1,44 @@
+package merchdb
+
+import (
+	"context"
+	"fmt"
+	ops "github.com/jbooth/merchdb/ops"
+	"sync"
+	"testing"
+)
+
+// without a flotilla that lists its configuration, peers come from the node registry
+func TestPeersFromRegistry(t *testing.T) {
+	s := &Server{
+		flotilla:  newLocalDB(t, "/tmp/merchdbPeersRegistryTest"),
+		peers:     []string{"localhost:1103"},
+		peersLock: &sync.RWMutex{},
+		lg:        defaultLogger(),
+		metrics:   newServerMetrics(),
+		tracing:   newServerTracer(nil),
+		closed:    make(chan struct{}),
+	}
+	defer s.flotilla.Close()
+	peers, err := s.Peers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(peers) != "[localhost:1103]" {
+		t.Fatalf("Expected the configured peers before any have registered, got %v", peers)
+	}
+	// registered by each node as it starts
+	for _, node := range []string{"127.0.0.1:1104 127.0.0.1:8002", "127.0.0.1:1103 127.0.0.1:8001"} {
+		result := s.command(context.Background(), ops.REGISTERNODE, byteArgs(node))
+		if result.Err != nil {
+			t.Fatal(result.Err)
+		}
+	}
+	peers, err = s.Peers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(peers) != "[127.0.0.1:1103 127.0.0.1:1104]" {
+		t.Fatalf("Unexpected peers %v", peers)
+	}
+}
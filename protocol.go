@@ -1,13 +1,93 @@
 package merchdb
 
+import (
+	ops "github.com/jbooth/merchdb/ops"
+)
+
 type WriteResponse struct {
 	Ok  bool
-	Err error
+	Err string
 }
 
 type ReadResponse struct {
+	Ok  bool
+	Err string
+	Key string
+	// values are rendered according to the table's schema, or as strings if it has none
+	Cols map[string]interface{}
+}
+
+// versions of a column from /getVersions, newest first
+type VersionsResponse struct {
+	Ok       bool
+	Err      string
+	Key      string
+	Col      string
+	Versions []VersionResponse
+}
+
+type VersionResponse struct {
+	// UnixNano write time, 0 if written without one
+	Timestamp int64
+	Value     interface{}
+}
+
+type LookupResponse struct {
 	Ok   bool
-	Err  error
-	Key  string
-	Cols map[string]string
+	Err  string
+	Keys []string
+}
+
+type SchemaResponse struct {
+	Ok     bool
+	Err    string
+	Schema *ops.Schema
+}
+
+// streamed by /admin/import after each batch of columns is replicated, and once more when finished
+type ImportProgress struct {
+	Ok     bool
+	Err    string
+	Done   bool
+	Tables int
+	Cols   int
+}
+
+type ACLResponse struct {
+	Ok   bool
+	Err  string
+	ACLs []ops.ACLEntry
+}
+
+type PeersResponse struct {
+	Ok    bool
+	Err   string
+	Peers []string
+	// flotilla address of raft's leader, empty if unknown
+	Leader string
+}
+
+type StatusResponse struct {
+	Ok bool
+	// leader, follower or candidate if our flotilla reports raft's state, otherwise unknown
+	Role   string
+	Term   uint64
+	Leader string
+	// registered web address of the leader, empty if unknown
+	LeaderWebAddr string
+	CommitIndex   uint64
+	AppliedIndex  uint64
+	// commands this node has applied, see ops.AppliedCommands.  Unlike the raft
+	// indexes it's always reported, and matches the leader's once caught up.
+	AppliedCommands uint64
+	Peers           []string
+	WebAddr         string
+	FlotillaAddr    string
+	DataDirBytes    int64
+	// flotilla address of the node holding an unexpired leader lease, which writes
+	// are forwarded to, empty if none or this node doesn't hold leases
+	LeaseHolder string
+	// how many times the lease has changed hands
+	LeaseEpoch uint64
+	Err        string
 }
@@ -0,0 +1,50 @@
+package merchdb
+
+import (
+	"net"
+	"strconv"
+)
+
+// flotilla.DefaultOpsDB doesn't expose raft's internal state.  Flotilla builds
+// (or wrappers around them) that do can implement these interfaces, and the
+// admin and status endpoints will use them when available.
+
+// raft stats as reported by hashicorp/raft, keys include
+// "state", "term", "commit_index", "applied_index", "last_log_index" and "num_peers"
+type raftStatser interface {
+	Stats() map[string]string
+}
+
+// leadership as seen by this node
+type leaderer interface {
+	IsLeader() bool
+	// nil if there is no known leader
+	Leader() net.Addr
+}
+
+// current raft configuration
+type peerLister interface {
+	Peers() ([]string, error)
+}
+
+// returns raft's stats, or nil if our flotilla doesn't report them
+func (s *Server) raftStats() map[string]string {
+	statser, ok := s.flotilla.(raftStatser)
+	if !ok {
+		return nil
+	}
+	return statser.Stats()
+}
+
+// returns a numeric raft stat, ok is false if it isn't available
+func (s *Server) raftStat(name string) (val uint64, ok bool) {
+	stats := s.raftStats()
+	if stats == nil {
+		return 0, false
+	}
+	val, err := strconv.ParseUint(stats[name], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return val, true
+}
@@ -0,0 +1,270 @@
+package merchdb
+
+import (
+	"encoding/json"
+	"fmt"
+	ops "github.com/jbooth/merchdb/ops"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// idle buckets are dropped this often, once they've refilled
+const rateLimitSweepInterval = time.Minute
+
+// RateLimit is a token bucket refilling at Rate requests per second, up to
+// Burst, which is at least 1.  A zero Rate means unlimited.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+func (limit RateLimit) burst() float64 {
+	if limit.Burst < 1 {
+		return 1
+	}
+	return float64(limit.Burst)
+}
+
+// separate budgets for reading and writing
+type RateLimits struct {
+	Read  RateLimit
+	Write RateLimit
+}
+
+// RateLimitConfig sets budgets per client and per table.  Clients are the
+// authenticated principal, or the remote IP without authentication.  Each
+// request spends from its client's budget and from every table it touches.
+type RateLimitConfig struct {
+	// for clients and tables without their own entry
+	DefaultClient RateLimits
+	DefaultTable  RateLimits
+	Clients       map[string]RateLimits
+	Tables        map[string]RateLimits
+}
+
+// WithRateLimits limits requests per client and table, answering requests
+// over budget with a 429.  Limits can be changed at runtime through
+// /admin/rateLimits, and are per node.
+func WithRateLimits(cfg RateLimitConfig) Option {
+	return func(c *config) {
+		c.rateLimits = &cfg
+	}
+}
+
+type bucketKey struct {
+	table bool
+	name  string
+	write bool
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refills for the time since it was last used, capped at limit's burst
+func (b *bucket) refill(limit RateLimit, now time.Time) {
+	b.tokens = math.Min(limit.burst(), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+}
+
+type rateLimiter struct {
+	lock      *sync.Mutex
+	cfg       RateLimitConfig
+	buckets   map[bucketKey]*bucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(cfg RateLimitConfig) *rateLimiter {
+	return &rateLimiter{&sync.Mutex{}, cfg, make(map[bucketKey]*bucket), time.Now()}
+}
+
+func (l *rateLimiter) limit(k bucketKey) RateLimit {
+	overrides, limits := l.cfg.Clients, l.cfg.DefaultClient
+	if k.table {
+		overrides, limits = l.cfg.Tables, l.cfg.DefaultTable
+	}
+	if override, ok := overrides[k.name]; ok {
+		limits = override
+	}
+	if k.write {
+		return limits.Write
+	}
+	return limits.Read
+}
+
+// spends a token from each key's bucket if they all have one, otherwise spends
+// nothing and returns how long until they would
+func (l *rateLimiter) take(keys []bucketKey, now time.Time) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.sweep(now)
+	var wait time.Duration
+	toSpend := make([]*bucket, 0, len(keys))
+	for _, k := range keys {
+		limit := l.limit(k)
+		if limit.Rate <= 0 {
+			continue
+		}
+		b, ok := l.buckets[k]
+		if !ok {
+			b = &bucket{limit.burst(), now}
+			l.buckets[k] = b
+		}
+		b.refill(limit, now)
+		if b.tokens < 1 {
+			w := time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+			if w > wait {
+				wait = w
+			}
+		}
+		toSpend = append(toSpend, b)
+	}
+	if wait > 0 {
+		return false, wait
+	}
+	for _, b := range toSpend {
+		b.tokens--
+	}
+	return true, 0
+}
+
+// drops buckets that have refilled, they're no different from new ones
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for k, b := range l.buckets {
+		limit := l.limit(k)
+		b.refill(limit, now)
+		if limit.Rate <= 0 || b.tokens >= limit.burst() {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+func (l *rateLimiter) config() RateLimitConfig {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.cfg
+}
+
+// replaces the limits, existing buckets keep their tokens up to the new bursts
+func (l *rateLimiter) setConfig(cfg RateLimitConfig) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.cfg = cfg
+	now := time.Now()
+	for k, b := range l.buckets {
+		b.refill(l.limit(k), now)
+	}
+}
+
+// who a request is charged to.  Requests a follower proxied to us come from the
+// follower's address, but carry the client's in X-Forwarded-For, which we use if the
+// request really is from another node.  Authenticated requests carry the client's
+// credentials through the proxy, so they're charged to the same principal either way.
+func (s *Server) rateLimitClient(r *http.Request) string {
+	if principal := caller(r); principal != "" {
+		return principal
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	if r.Header.Get(ForwardedHeader) != "" && s.isNodeHost(host) {
+		// the proxy appends the address it saw, anything before that came from the client
+		forwardedFor := r.Header.Values("X-Forwarded-For")
+		if len(forwardedFor) > 0 {
+			hops := strings.Split(forwardedFor[len(forwardedFor)-1], ",")
+			if client := strings.TrimSpace(hops[len(hops)-1]); client != "" {
+				return client
+			}
+		}
+	}
+	return host
+}
+
+// whether host is the address of a node in the registry
+func (s *Server) isNodeHost(host string) bool {
+	txn, err := s.flotilla.Read()
+	if err != nil {
+		return false
+	}
+	nodes, err := ops.Nodes(txn)
+	txn.Abort()
+	if err != nil {
+		return false
+	}
+	for flotillaAddr, webAddr := range nodes {
+		for _, addr := range []string{flotillaAddr, webAddr} {
+			if nodeHost, _, err := net.SplitHostPort(addr); err == nil && nodeHost == host {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// the buckets a request spends from
+func rateLimitKeys(client string, tables []string, write bool) []bucketKey {
+	keys := []bucketKey{{false, client, write}}
+	for _, table := range tables {
+		keys = append(keys, bucketKey{true, table, write})
+	}
+	return keys
+}
+
+// wraps a handler so that requests over their client's or tables' budgets get a 429.
+// Reads spend from read budgets, writes and admin requests from write budgets.
+func (s *Server) rateLimited(need ops.Perm, tables requestTables, h http.HandlerFunc) http.HandlerFunc {
+	if s.limiter == nil || need == ops.PERM_NONE {
+		return h
+	}
+	write := need > ops.PERM_READ
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := s.rateLimitClient(r)
+		ok, wait := s.limiter.take(rateLimitKeys(client, tables(r), write), time.Now())
+		if !ok {
+			s.reqLog(r).Info("Rate limited request", "client", client, "retryAfter", wait)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(fmt.Sprintf("Rate limit exceeded, retry after %s", wait)))
+			return
+		}
+		h(w, r)
+	}
+}
+
+// url is /admin/rateLimits, GET returns this node's RateLimitConfig as JSON and
+// PUT or POST replaces it with the one in the body
+func (s *Server) HandleRateLimits(w http.ResponseWriter, r *http.Request) {
+	if s.limiter == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("Rate limiting isn't enabled on this node"))
+		return
+	}
+	if r.Method == "PUT" || r.Method == "POST" {
+		cfg := RateLimitConfig{}
+		err := json.NewDecoder(r.Body).Decode(&cfg)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		s.limiter.setConfig(cfg)
+		s.reqLog(r).Info("Changed rate limits", "caller", caller(r))
+	}
+	w.Header().Add("Content-Type", "application-json")
+	enc := json.NewEncoder(w)
+	err := enc.Encode(s.limiter.config())
+	if err != nil {
+		s.reqLog(r).Error("Error encoding response", "err", err)
+	}
+}
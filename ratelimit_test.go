@@ -0,0 +1,124 @@
+package merchdb
+
+import (
+	"context"
+	ops "github.com/jbooth/merchdb/ops"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(RateLimitConfig{
+		DefaultClient: RateLimits{Read: RateLimit{Rate: 10, Burst: 2}},
+		Tables:        map[string]RateLimits{"hot": {Write: RateLimit{Rate: 1, Burst: 1}}},
+	})
+	now := time.Now()
+	read := []bucketKey{{false, "alice", false}, {true, "hot", false}}
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.take(read, now); !ok {
+			t.Fatalf("Read %d should fit in the burst", i)
+		}
+	}
+	ok, wait := l.take(read, now)
+	if ok || wait != 100*time.Millisecond {
+		t.Fatalf("Expected to wait 100ms for a read, got %t %s", ok, wait)
+	}
+	if ok, _ := l.take(read, now.Add(100*time.Millisecond)); !ok {
+		t.Fatal("Expected a read after refilling")
+	}
+	// other clients have their own budget
+	if ok, _ := l.take([]bucketKey{{false, "bob", false}}, now); !ok {
+		t.Fatal("Bob shouldn't be limited by alice's reads")
+	}
+
+	// writes are unlimited per client but limited on the hot table
+	write := []bucketKey{{false, "alice", true}, {true, "hot", true}}
+	if ok, _ := l.take(write, now); !ok {
+		t.Fatal("First write should fit")
+	}
+	if ok, wait := l.take(write, now); ok || wait != time.Second {
+		t.Fatalf("Expected to wait 1s for a write to hot, got %t %s", ok, wait)
+	}
+	if ok, _ := l.take([]bucketKey{{false, "alice", true}, {true, "cold", true}}, now); !ok {
+		t.Fatal("Writes to other tables shouldn't be limited")
+	}
+
+	// raising the limit takes effect on existing buckets
+	l.setConfig(RateLimitConfig{Tables: map[string]RateLimits{"hot": {Write: RateLimit{Rate: 1000, Burst: 10}}}})
+	if ok, _ := l.take(write, now.Add(10*time.Millisecond)); !ok {
+		t.Fatal("Expected a write after raising the limit")
+	}
+}
+
+func TestRateLimitedHandler(t *testing.T) {
+	s := &Server{lg: defaultLogger(), limiter: newRateLimiter(RateLimitConfig{
+		DefaultTable: RateLimits{Write: RateLimit{Rate: 0.5, Burst: 1}},
+	})}
+	rt := newRouter()
+	rt.handle("/putCols/{table}/{row}", s.rateLimited(ops.PERM_WRITE, pathTable, func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest("GET", "/putCols/t1/r1?c=v", nil))
+		return w
+	}
+	if w := serve(); w.Code != 200 {
+		t.Fatalf("Expected first write to pass, got %d", w.Code)
+	}
+	w := serve()
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "2" {
+		t.Fatalf("Expected 429 with Retry-After 2, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+// writes proxied by a follower are charged to the client that sent them
+func TestRateLimitProxied(t *testing.T) {
+	db := newLocalDB(t, "/tmp/merchdbRateLimitProxiedTest")
+	defer db.Close()
+	s := &Server{
+		flotilla: db,
+		lg:       defaultLogger(),
+		metrics:  newServerMetrics(),
+		tracing:  newServerTracer(nil),
+		closed:   make(chan struct{}),
+		limiter: newRateLimiter(RateLimitConfig{
+			DefaultClient: RateLimits{Write: RateLimit{Rate: 0.5, Burst: 1}},
+		}),
+	}
+	result := s.command(context.Background(), ops.REGISTERNODE, byteArgs("10.0.0.2:1103 10.0.0.2:8001"))
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	rt := newRouter()
+	rt.handle("/putCols/{table}/{row}", s.rateLimited(ops.PERM_WRITE, pathTable, func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(remote string, forwardedFor string) int {
+		r := httptest.NewRequest("GET", "/putCols/t1/r1?c=v", nil)
+		r.RemoteAddr = remote
+		if forwardedFor != "" {
+			r.Header.Set(ForwardedHeader, "10.0.0.2:1103")
+			r.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, r)
+		return w.Code
+	}
+	for _, c := range []struct {
+		remote       string
+		forwardedFor string
+		code         int
+	}{
+		{"10.0.0.2:5000", "1.1.1.1", 200},
+		// a different client through the same follower has its own budget
+		{"10.0.0.2:5001", "2.2.2.2", 200},
+		{"10.0.0.2:5002", "9.9.9.9, 1.1.1.1", 429},
+		{"1.1.1.1:5000", "", 429},
+		// only nodes are believed
+		{"3.3.3.3:5000", "4.4.4.4", 200},
+		{"3.3.3.3:5000", "5.5.5.5", 429},
+	} {
+		if code := serve(c.remote, c.forwardedFor); code != c.code {
+			t.Fatalf("From %s for %q : expected %d, got %d", c.remote, c.forwardedFor, c.code, code)
+		}
+	}
+}
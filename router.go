@@ -0,0 +1,133 @@
+package merchdb
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// routes requests by path segment, like /putCols/{table}/{row}.  Each segment
+// is unescaped on its own, so keys can contain slashes as %2F.  Paths that don't
+// match a route, including ones for a known endpoint with missing or extra
+// segments, get a 404, and empty params or bad escapes a 400.
+type router struct {
+	routes []*route
+}
+
+type route struct {
+	pattern string
+	// static segments to match, or param names in braces
+	segments []string
+	handler  http.HandlerFunc
+}
+
+type pathParamsKey struct{}
+
+func newRouter() *router {
+	return &router{make([]*route, 0)}
+}
+
+// registers h for pattern, which starts with static segments and may end with
+// params like {table}
+func (rt *router) handle(pattern string, h http.HandlerFunc) {
+	rt.routes = append(rt.routes, &route{pattern, strings.Split(strings.TrimPrefix(pattern, "/"), "/"), h})
+}
+
+// the static part of a pattern, which names it in metrics and logs
+func routeName(pattern string) string {
+	if idx := strings.Index(pattern, "{"); idx >= 0 {
+		return pattern[:idx]
+	}
+	return pattern
+}
+
+func isParam(segment string) bool {
+	return strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+}
+
+// splits an escaped path into unescaped segments, without the leading slash
+func splitPath(escapedPath string) ([]string, error) {
+	segments := strings.Split(strings.TrimPrefix(escapedPath, "/"), "/")
+	for i, seg := range segments {
+		unescaped, err := url.PathUnescape(seg)
+		if err != nil {
+			return nil, fmt.Errorf("Bad escape in path segment %q : %s", seg, err)
+		}
+		segments[i] = unescaped
+	}
+	return segments, nil
+}
+
+// whether the path has the route's shape, with every static segment matching
+func (rt *route) matches(segments []string) bool {
+	if len(segments) != len(rt.segments) {
+		return false
+	}
+	for i, seg := range rt.segments {
+		if !isParam(seg) && segments[i] != seg {
+			return false
+		}
+	}
+	return true
+}
+
+// returns the route's params from segments, or an error saying what's wrong with them
+func (rt *route) params(segments []string) (map[string]string, error) {
+	params := make(map[string]string)
+	for i, seg := range rt.segments {
+		if !isParam(seg) {
+			continue
+		}
+		name := strings.Trim(seg, "{}")
+		if segments[i] == "" {
+			return nil, fmt.Errorf("Missing %s in path, expected a path like %s", name, rt.pattern)
+		}
+		params[name] = segments[i]
+	}
+	return params, nil
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments, err := splitPath(r.URL.EscapedPath())
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	// so handlers can rely on r.URL.Query, which drops what it can't parse
+	_, err = url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		badRequest(w, fmt.Errorf("Malformed query : %s", err))
+		return
+	}
+	var matched *route
+	for _, candidate := range rt.routes {
+		if candidate.matches(segments) {
+			matched = candidate
+			break
+		}
+	}
+	if matched == nil {
+		http.NotFound(w, r)
+		return
+	}
+	params, err := matched.params(segments)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	matched.handler(w, r.WithContext(context.WithValue(r.Context(), pathParamsKey{}, params)))
+}
+
+// returns a param from the request's route, the empty string if it has none by that name
+func pathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(pathParamsKey{}).(map[string]string)
+	return params[name]
+}
+
+// responds with a 400 for requests we can't make sense of
+func badRequest(w http.ResponseWriter, err error) {
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write([]byte(err.Error()))
+}
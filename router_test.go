@@ -0,0 +1,92 @@
+package merchdb
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	rt := newRouter()
+	for _, pattern := range []string{"/getRow/{table}/{row}", "/lookup/{table}/{index}/{value}", "/admin/export", "/health"} {
+		pattern := pattern
+		rt.handle(pattern, func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s table=%s row=%s value=%s", routeName(pattern), pathParam(r, "table"), pathParam(r, "row"), pathParam(r, "value"))
+		})
+	}
+	cases := []struct {
+		url    string
+		status int
+		body   string
+	}{
+		{"/getRow/t1/r1", 200, "/getRow/ table=t1 row=r1 value="},
+		{"/getRow/t1/a%2Fb", 200, "/getRow/ table=t1 row=a/b value="},
+		{"/getRow/t%20x/r%3F1?family=a&family=b", 200, "/getRow/ table=t x row=r?1 value="},
+		{"/lookup/t1/byName/x%2Fy%2Fz", 200, "/lookup/ table=t1 row= value=x/y/z"},
+		{"/admin/export?table=a&table=b", 200, "/admin/export table= row= value="},
+		{"/health", 200, "/health table= row= value="},
+		{"/getRow/t1", 404, ""},
+		{"/getRow/t1/", 400, ""},
+		{"/getRow//r1", 400, ""},
+		{"/getRow/t1/a/b", 404, ""},
+		{"/getRow/t1/r1?col=%zz", 400, ""},
+		{"/health/extra", 404, ""},
+		{"/nothing/here", 404, ""},
+		{"/", 404, ""},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest("GET", c.url, nil))
+		if w.Code != c.status {
+			t.Errorf("%s : expected %d got %d %s", c.url, c.status, w.Code, w.Body.String())
+			continue
+		}
+		if c.body != "" && w.Body.String() != c.body {
+			t.Errorf("%s : expected %q got %q", c.url, c.body, w.Body.String())
+		}
+	}
+}
+
+func TestParseColumns(t *testing.T) {
+	cases := []struct {
+		url   string
+		vals  bool
+		args  string
+		isErr bool
+	}{
+		{"/putCols/t1/r1?b=2&a=1", true, "[r1 t1 a 1 b 2]", false},
+		{"/putCols/t1/r%2F1?fam%3Aq=x%26y", true, "[r/1 t1 fam:q x&y]", false},
+		{"/putCols/t1/r1", true, "[r1 t1]", false},
+		{"/putCols/t1/r1?a=1&a=2", true, "", true},
+		{"/putCols/t1/r1?=1", true, "", true},
+		{"/getCols/t1/r1?b&a=ignored", false, "[r1 t1 a b]", false},
+		{"/getCols/t1/r1?a&a", false, "[r1 t1 a]", false},
+		{"/getCols/t1/r1", false, "[r1 t1]", false},
+	}
+	for _, c := range cases {
+		var got [][]byte
+		var err error
+		rt := newRouter()
+		rt.handle("/putCols/{table}/{row}", func(w http.ResponseWriter, r *http.Request) {
+			got, err = parseTableRowColVals(r)
+		})
+		rt.handle("/getCols/{table}/{row}", func(w http.ResponseWriter, r *http.Request) {
+			got, err = parseTableRowColNames(r)
+		})
+		rt.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", c.url, nil))
+		if c.isErr {
+			if err == nil {
+				t.Errorf("%s : expected an error, got %q", c.url, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s : %s", c.url, err)
+			continue
+		}
+		if fmt.Sprintf("%s", got) != c.args {
+			t.Errorf("%s : expected %s got %s", c.url, c.args, got)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package merchdb
+
+import (
+	"encoding/json"
+	ops "github.com/jbooth/merchdb/ops"
+	"io/ioutil"
+	"net/http"
+)
+
+// url is formatted like /setSchema/tableName, with the json encoded ops.Schema as the request body.
+// An empty body removes the table's schema.
+func (s *Server) HandleSetSchema(w http.ResponseWriter, r *http.Request) {
+	schemaBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		returnErr(w, err)
+		return
+	}
+	result := s.command(r.Context(), ops.SETSCHEMA, [][]byte{[]byte(pathParam(r, "table")), schemaBytes})
+	response := &WriteResponse{true, ""}
+	if result.Err != nil {
+		response.Ok = false
+		response.Err = result.Err.Error()
+	}
+	w.Header().Add("Content-Type", "application-json")
+	writeCommandStatus(w, result.Err)
+	enc := json.NewEncoder(w)
+	err = enc.Encode(response)
+	if err != nil {
+		s.reqLog(r).Error("Error encoding response", "err", err)
+	}
+}
+
+// url is formatted like /getSchema/tableName
+func (s *Server) HandleGetSchema(w http.ResponseWriter, r *http.Request) {
+	schema, err := s.tableSchema(pathParam(r, "table"))
+	response := &SchemaResponse{true, "", schema}
+	if err != nil {
+		response.Ok = false
+		response.Err = err.Error()
+	}
+	w.Header().Add("Content-Type", "application-json")
+	enc := json.NewEncoder(w)
+	err = enc.Encode(response)
+	if err != nil {
+		s.reqLog(r).Error("Error encoding response", "err", err)
+	}
+}
@@ -1,327 +1,571 @@
 package merchdb
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/jbooth/flotilla"
-	mdb "github.com/jbooth/gomdb"
 	ops "github.com/jbooth/merchdb/ops"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
-	"os"
-	"strings"
+	"net/url"
+	"sort"
+	"sync"
 	"time"
 )
 
 type Server struct {
-	flotilla   flotilla.DefaultOpsDB
-	http       *http.Server
-	httpListen net.Listener
-	lg         *log.Logger
+	flotilla     flotilla.DefaultOpsDB
+	http         *http.Server
+	httpListen   net.Listener
+	lg           *slog.Logger
+	flotillaAddr string
+	dataDir      string
+	peers        []string
+	peersLock    *sync.RWMutex
+	readyLock    *sync.Mutex
+	lastReady    time.Time
+	closed       chan struct{}
+	closeOnce    *sync.Once
+	maxBodyBytes int64
+	// holds a token for each command waiting on raft, nil for no limit
+	inflight       chan struct{}
+	commandTimeout time.Duration
+	metrics        *serverMetrics
+	tracing        *serverTracer
+	oplog          *opLog
+	tlsState       *tlsState
+	limiter        *rateLimiter
+	batcher        *writeBatcher
+	wire           *wireServer
+	// web address registered for other nodes to use, empty if they can't reach us
+	advertiseAddr string
+	leaseTTL      time.Duration
+	// guards migrating, which is set while this node converts an old store's keys
+	migrateLock *sync.Mutex
+	migrating   bool
+	config
 }
 
-func NewServer(webAddr string, flotillaAddr string, dataDir string, flotillaPeers []string) (*Server, error) {
-	lg := log.New(os.Stderr, "MerchDB:\t", log.LstdFlags)
+// starts a server with the default ServerConfig
+func NewServer(webAddr string, flotillaAddr string, dataDir string, flotillaPeers []string, opts ...Option) (*Server, error) {
+	sc := DefaultServerConfig()
+	sc.WebAddr = webAddr
+	sc.FlotillaAddr = flotillaAddr
+	sc.DataDir = dataDir
+	sc.Peers = flotillaPeers
+	return NewServerWithConfig(sc, opts...)
+}
+
+func NewServerWithConfig(sc ServerConfig, opts ...Option) (*Server, error) {
+	webAddr, flotillaAddr, dataDir, flotillaPeers := sc.WebAddr, sc.FlotillaAddr, sc.DataDir, sc.Peers
+	cfg := config{}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	lg := cfg.logger
+	if lg == nil {
+		lg = defaultLogger()
+	}
+	var tlsSt *tlsState
+	if cfg.tls != nil {
+		var err error
+		tlsSt, err = newTLSState(*cfg.tls)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// bind before starting flotilla, so a bad web address doesn't leave it running
+	httpListen := cfg.listener
+	if httpListen == nil {
+		var err error
+		httpListen, err = listenWeb(webAddr)
+		if err != nil {
+			return nil, err
+		}
+	} else if webAddr == "" {
+		webAddr = httpListen.Addr().String()
+	}
+	var wireListen net.Listener
+	if sc.WireAddr != "" {
+		var err error
+		wireListen, err = listenWeb(sc.WireAddr)
+		if err != nil {
+			httpListen.Close()
+			return nil, err
+		}
+	}
 	// start flotilla
 	// peers []string, dataDir string, bindAddr string, ops map[string]Command
-	f, err := flotilla.NewDefaultDB(flotillaPeers, dataDir, flotillaAddr, ops.Ops)
+	m := newServerMetrics()
+	tr := newServerTracer(cfg.exporter)
+	ol := newOpLog(lg)
+	f, err := flotilla.NewDefaultDB(flotillaPeers, dataDir, flotillaAddr, m.instrumentOps(ol.logOps(tr.traceOps(ops.CountApplied(ops.Ops)))))
 	if err != nil {
+		httpListen.Close()
+		if wireListen != nil {
+			wireListen.Close()
+		}
 		return nil, err
 	}
 	// register http methods
-	mux := http.NewServeMux()
+	rt := newRouter()
 
 	// start http server
 	h := &http.Server{}
-	h.ErrorLog = lg
+	h.ErrorLog = slog.NewLogLogger(lg.Handler(), slog.LevelError)
 	h.Addr = webAddr
-	h.Handler = mux
-	h.ReadTimeout = 1 * time.Second
-	h.WriteTimeout = 1 * time.Second
+	h.ReadTimeout = sc.ReadTimeout
+	h.ReadHeaderTimeout = sc.ReadHeaderTimeout
+	h.WriteTimeout = sc.WriteTimeout
+	h.IdleTimeout = sc.IdleTimeout
+	h.MaxHeaderBytes = sc.MaxHeaderBytes
+
+	s := &Server{
+		flotilla:       f,
+		http:           h,
+		httpListen:     httpListen,
+		lg:             lg,
+		flotillaAddr:   flotillaAddr,
+		advertiseAddr:  advertiseAddr(sc.AdvertiseAddr, webAddr, flotillaAddr),
+		leaseTTL:       sc.LeaderLease,
+		dataDir:        dataDir,
+		peers:          flotillaPeers,
+		peersLock:      &sync.RWMutex{},
+		readyLock:      &sync.Mutex{},
+		migrateLock:    &sync.Mutex{},
+		closed:         make(chan struct{}),
+		closeOnce:      &sync.Once{},
+		maxBodyBytes:   sc.MaxBodyBytes,
+		commandTimeout: sc.CommandTimeout,
+		metrics:        m,
+		tracing:        tr,
+		oplog:          ol,
+		tlsState:       tlsSt,
+		config:         cfg,
+	}
+	if sc.MaxInflightCommands > 0 {
+		s.inflight = make(chan struct{}, sc.MaxInflightCommands)
+	}
+	if sc.WriteBatchWindow > 0 {
+		s.batcher = newWriteBatcher(s, sc.WriteBatchWindow, sc.MaxWriteBatch)
+		go s.batcher.run()
+	}
+	if cfg.rateLimits != nil {
+		s.limiter = newRateLimiter(*cfg.rateLimits)
+	}
 
-	httpAddr, err := net.ResolveTCPAddr("tcp4", webAddr)
-	if err != nil {
-		return nil, fmt.Errorf("Couldn't resolve webAddr %s : %s", webAddr, err)
+	// every handler is counted and timed under its registered pattern, and checked against
+	// the rate limits and ACLs for the tables it touches
+	handle := func(pattern string, need ops.Perm, tables requestTables, h http.HandlerFunc) {
+		rt.handle(pattern, s.instrumented(routeName(pattern), s.rateLimited(need, tables, s.requires(need, tables, h))))
 	}
-	httpListen, err := net.ListenTCP("tcp4", httpAddr)
-	if err != nil {
-		return nil, fmt.Errorf("Couldn't bind  to httpAddr %s", httpAddr, err)
+	handle("/putCols/{table}/{row}", ops.PERM_WRITE, pathTable, s.leaderOnly(s.HandlePutCols))
+	handle("/putRow/{table}/{row}", ops.PERM_WRITE, pathTable, s.leaderOnly(s.HandlePutRow))
+	handle("/getRow/{table}/{row}", ops.PERM_READ, pathTable, s.HandleGetRow)
+	handle("/getRowFast/{table}/{row}", ops.PERM_READ, pathTable, s.HandleGetRowFast)
+	handle("/getCols/{table}/{row}", ops.PERM_READ, pathTable, s.HandleGetCols)
+	handle("/getColsFast/{table}/{row}", ops.PERM_READ, pathTable, s.HandleGetColsFast)
+	handle("/delRow/{table}/{row}", ops.PERM_WRITE, pathTable, s.leaderOnly(s.HandleDelRow))
+	handle("/createIndex/{table}/{index}", ops.PERM_ADMIN, pathTable, s.leaderOnly(s.HandleCreateIndex))
+	handle("/backfillIndex/{table}/{index}", ops.PERM_ADMIN, pathTable, s.leaderOnly(s.HandleBackfillIndex))
+	handle("/lookup/{table}/{index}/{value}", ops.PERM_READ, pathTable, s.HandleLookup)
+	handle("/setSchema/{table}", ops.PERM_ADMIN, pathTable, s.leaderOnly(s.HandleSetSchema))
+	handle("/getSchema/{table}", ops.PERM_READ, pathTable, s.HandleGetSchema)
+	handle("/setFamily/{table}/{family}", ops.PERM_ADMIN, pathTable, s.leaderOnly(s.HandleSetFamily))
+	handle("/getVersions/{table}/{row}/{col}", ops.PERM_READ, pathTable, s.HandleGetVersions)
+	handle("/admin/export", ops.PERM_READ, exportTables, s.HandleExport)
+	handle("/admin/import", ops.PERM_ADMIN, clusterWide, s.leaderOnly(s.HandleImport))
+	handle("/admin/backup", ops.PERM_ADMIN, clusterWide, s.HandleBackup)
+	handle("/admin/migrateKeys", ops.PERM_ADMIN, clusterWide, s.leaderOnly(s.HandleMigrateKeys))
+	handle("/admin/peers", ops.PERM_NONE, clusterWide, s.HandlePeers)
+	handle("/admin/setACL", ops.PERM_ADMIN, clusterWide, s.leaderOnly(s.HandleSetACL))
+	handle("/admin/acls", ops.PERM_ADMIN, clusterWide, s.HandleACLs)
+	handle("/admin/rateLimits", ops.PERM_ADMIN, clusterWide, s.HandleRateLimits)
+	handle("/health", ops.PERM_NONE, clusterWide, s.HandleHealth)
+	handle("/ready", ops.PERM_NONE, clusterWide, s.HandleReady)
+	handle("/status", ops.PERM_NONE, clusterWide, s.HandleStatus)
+	handle("/metrics", ops.PERM_NONE, clusterWide, s.HandleMetrics)
+	s.registerStorageMetrics()
+	h.Handler = s.limitBody(s.authenticated(rt))
+	if s.tlsState != nil {
+		s.httpListen = s.tlsListener(httpListen)
 	}
-	s := &Server{f, h, httpListen, lg}
 
-	mux.HandleFunc("/putCols/", s.HandlePutCols)
-	mux.HandleFunc("/putRow/", s.HandlePutRow)
-	mux.HandleFunc("/getRow/", s.HandleGetRow)
-	mux.HandleFunc("/delRow/", s.HandleDelRow)
+	if wireListen != nil {
+		s.serveWire(wireListen)
+	}
 
+	go s.registerNode()
+	if _, ok := s.leadership().(*leaseLeader); ok {
+		go s.holdLease()
+	}
+	go s.migrateKeys()
 	go func(s *Server) {
 
-		err := s.http.Serve(httpListen)
+		err := s.http.Serve(s.httpListen)
 
+		select {
+		case <-s.closed:
+			// closed or shutting down, serve errors are expected
+			return
+		default:
+		}
 		if err != nil {
 			_ = s.flotilla.Close()
 			_ = s.httpListen.Close()
-			s.lg.Printf("Error serving http addr %s  : %s", s.http.Addr, err)
+			s.lg.Error("Error serving http", "addr", s.http.Addr, "err", err)
 		}
 	}(s)
 	return s, nil
 
 }
 
+// closes the server immediately, cutting off any requests in flight
 func (s *Server) Close() error {
-	s.httpListen.Close()
+	if !s.markClosed() {
+		return nil
+	}
+	s.http.Close()
+	s.closeWire()
 	return s.flotilla.Close()
 }
 
-// parses a url formatted like ../tableName/rowKey?col1=val1&col2=val2 into a [][]byte that our flotilla ops will work with
-func parseTableRowColVals(r *http.Request) [][]byte {
-	// last element of resource path is rowKey
-	pathSplits := strings.Split(r.URL.Path, "/")
-	tableName := []byte(pathSplits[len(pathSplits)-2])
-	rowKey := []byte(pathSplits[len(pathSplits)-1])
-
-	// url params are columns
-	numCols := len(r.Form)
-	// args for flotilla are rowKey [colKey, colVal]...
-	flotillaArgs := make([][]byte, (numCols*2)+2)
-	flotillaArgs[0] = rowKey
-	flotillaArgs[1] = tableName
-	i := 1
-	for k, v := range r.Form {
-		flotillaArgs[i] = []byte(k)
-		i++
-		flotillaArgs[i] = []byte(v[0])
-		i++
-	}
-	return flotillaArgs
+// stops accepting requests and waits for those in flight to finish before
+// closing flotilla.  If ctx is done first, the remaining requests are cut off
+// and ctx's error returned once flotilla is closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if !s.markClosed() {
+		return nil
+	}
+	err := s.http.Shutdown(ctx)
+	if err != nil {
+		s.lg.Warn("Requests still in flight at shutdown deadline, closing them", "err", err)
+		s.http.Close()
+	}
+	wireErr := s.shutdownWire(ctx)
+	if err == nil {
+		err = wireErr
+	}
+	flotillaErr := s.flotilla.Close()
+	if err != nil {
+		return err
+	}
+	return flotillaErr
+}
+
+// returns false if we were already closed
+func (s *Server) markClosed() bool {
+	first := false
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		first = true
+	})
+	return first
 }
 
-// parses a url formatted like ../tableName/rowKey?col1=whatev&col2=whatever into a [][]byte that our flotilla ops will work with,
-// ignores valuse (intended for getCols requests)
-func parseTableRowColNames(r *http.Request) [][]byte {
-	// last element of resource path is rowKey
-	pathSplits := strings.Split(r.URL.Path, "/")
-	tableName := []byte(pathSplits[len(pathSplits)-2])
-	rowKey := []byte(pathSplits[len(pathSplits)-1])
-
-	// url params are columns
-	numCols := len(r.Form)
-	// args for flotilla are rowKey [colKey, colVal]...
-	flotillaArgs := make([][]byte, numCols+2)
-	flotillaArgs[0] = rowKey
-	flotillaArgs[1] = tableName
-	i := 1
-	for k, _ := range r.Form {
-		flotillaArgs[i] = []byte(k)
-		i++
-	}
-	return flotillaArgs
+// admin endpoints that stream whole tables in or out, which can take longer and
+// send more than any other request
+var streamingPaths = map[string]bool{
+	"/admin/import": true,
+	"/admin/export": true,
+	"/admin/backup": true,
 }
 
-// only parses table name and row key, ignoring any CGI params
+// caps request bodies at the configured size, reads past it fail.  Streaming
+// endpoints are exempt, and have the server's read and write timeouts lifted.
+func (s *Server) limitBody(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if streamingPaths[r.URL.Path] {
+			rc := http.NewResponseController(w)
+			// not every ResponseWriter supports deadlines, like httptest's
+			rc.SetReadDeadline(time.Time{})
+			rc.SetWriteDeadline(time.Time{})
+			h.ServeHTTP(w, r)
+			return
+		}
+		if s.maxBodyBytes <= 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength > s.maxBodyBytes {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, s.maxBodyBytes)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// parses a url formatted like ../tableName/rowKey?col1=val1&col2=val2 into a [][]byte that our flotilla ops will work with.
+// A column given more than once, like ?a=1&a=2, is an error rather than picking one of its values.
+func parseTableRowColVals(r *http.Request) ([][]byte, error) {
+	params := r.URL.Query()
+	// args for flotilla are rowKey, tableName, [colKey, colVal]...
+	flotillaArgs := make([][]byte, 0, (len(params)*2)+2)
+	flotillaArgs = append(flotillaArgs, parseTableRowKey(r)...)
+	for _, col := range sortedParams(params) {
+		if col == "" {
+			return nil, fmt.Errorf("Column names can't be empty")
+		}
+		vals := params[col]
+		if len(vals) > 1 {
+			return nil, fmt.Errorf("Column %s given %d values, expected one", col, len(vals))
+		}
+		flotillaArgs = append(flotillaArgs, []byte(col), []byte(vals[0]))
+	}
+	return flotillaArgs, nil
+}
+
+// parses a url formatted like ../tableName/rowKey?col1&col2 into a [][]byte that our flotilla ops will work with,
+// ignores values (intended for getCols requests)
+func parseTableRowColNames(r *http.Request) ([][]byte, error) {
+	params := r.URL.Query()
+	// args for flotilla are rowKey, tableName, [colKey]...
+	flotillaArgs := make([][]byte, 0, len(params)+2)
+	flotillaArgs = append(flotillaArgs, parseTableRowKey(r)...)
+	for _, col := range sortedParams(params) {
+		if col == "" {
+			return nil, fmt.Errorf("Column names can't be empty")
+		}
+		flotillaArgs = append(flotillaArgs, []byte(col))
+	}
+	return flotillaArgs, nil
+}
+
+// param names in order, so the same url always makes the same command
+func sortedParams(params url.Values) []string {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// only parses table name and row key from the route, ignoring any CGI params
 func parseTableRowKey(r *http.Request) [][]byte {
-	pathSplits := strings.Split(r.URL.Path, "/")
-	tableName := []byte(pathSplits[len(pathSplits)-2])
-	rowKey := []byte(pathSplits[len(pathSplits)-1])
-	return [][]byte{rowKey, tableName}
+	return [][]byte{[]byte(pathParam(r, "row")), []byte(pathParam(r, "table"))}
 }
 
-// url is formatted like /tableName/rowKey?col1=val1&col2=val2
+// url is formatted like /putCols/tableName/rowKey?col1=val1&col2=val2
+// Each column can only be given once, repeating one gets a 400.
 func (s *Server) HandlePutCols(w http.ResponseWriter, r *http.Request) {
-	flotillaArgs := parseTableRowColVals(r)
-	result := <-s.flotilla.Command(ops.PUTCOLS, flotillaArgs)
-	response := &WriteResponse{true, nil}
+	flotillaArgs, err := parseTableRowColVals(r)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	// stamp the write here so every replica applies the same family TTLs
+	flotillaArgs = append(flotillaArgs, ops.Timestamp(time.Now()))
+	result := s.putCols(r.Context(), flotillaArgs)
+	response := &WriteResponse{true, ""}
 	if result.Err != nil {
 		response.Ok = false
-		response.Err = result.Err
+		response.Err = result.Err.Error()
 	}
 	w.Header().Add("Content-Type", "application-json")
+	writeCommandStatus(w, result.Err)
 	enc := json.NewEncoder(w)
-	err := enc.Encode(response)
+	err = enc.Encode(response)
 	if err != nil {
-		s.lg.Printf(err.Error())
+		s.reqLog(r).Error("Error encoding response", "err", err)
 	}
 
 }
 
+// url is formatted like /getCols/tableName/rowKey?col1&col2, read through raft
 func (s *Server) HandleGetCols(w http.ResponseWriter, r *http.Request) {
-	flotillaArgs := parseTableRowColNames(r)
-	result := <-s.flotilla.Command(ops.GETCOLS, flotillaArgs)
-	response := &ReadResponse{}
-
-	if result.Err != nil {
-		response.Ok = false
-		response.Err = result.Err
-	} else {
-		resultCols, err := bytesCols(result.Response)
-		if err != nil {
-			response.Ok = false
-			response.Err = err
-		} else {
-			response.Ok = true
-			response.Key = string(flotillaArgs[0])
-			response.Cols = make(map[string]string)
-			for _, keyVal := range resultCols {
-				response.Cols[string(keyVal.k)] = string(keyVal.v)
-			}
-		}
+	flotillaArgs, err := parseTableRowColNames(r)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	schema, err := s.tableSchema(string(flotillaArgs[1]))
+	if err != nil {
+		returnErr(w, err)
+		return
 	}
+	result := s.command(r.Context(), ops.GETCOLS, flotillaArgs)
+	response := colsResponse(flotillaArgs[0], schema, result.Response, result.Err)
 	w.Header().Add("Content-Type", "application-json")
+	writeCommandStatus(w, result.Err)
 	enc := json.NewEncoder(w)
-	err := enc.Encode(response)
+	err = enc.Encode(response)
 	if err != nil {
-		s.lg.Printf(err.Error())
+		s.reqLog(r).Error("Error encoding response", "err", err)
 	}
 }
 
+// like HandleGetCols, but reads from this node's copy without going through raft,
+// so it may not see the latest writes
 func (s *Server) HandleGetColsFast(w http.ResponseWriter, r *http.Request) {
-
-	flotillaArgs := parseTableRowColNames(r)
-	txn, err := s.flotilla.Read()
+	flotillaArgs, err := parseTableRowColNames(r)
 	if err != nil {
-		returnErr(w, err)
+		badRequest(w, err)
 		return
 	}
 	// rowKey is args[0], tableName is args[1]
 	rowKey := flotillaArgs[0]
 	tableName := string(flotillaArgs[1])
-	colNames := flotillaArgs[2:]
-	dbi, err := txn.DBIOpen(&tableName, mdb.CREATE)
+	var colNames [][]byte = nil
+	if len(flotillaArgs) > 2 {
+		colNames = flotillaArgs[2:]
+	}
+	txn, err := s.flotilla.Read()
 	if err != nil {
 		returnErr(w, err)
 		return
 	}
-	results, err := getCols(txn, dbi, rowKey, colNames)
-
-	response := &ReadResponse{}
+	defer txn.Abort()
+	schema, err := ops.GetSchema(txn, tableName)
 	if err != nil {
-		response.Ok = false
-		response.Err = err
+		returnErr(w, err)
 		return
-	} else {
-		response.Key = string(rowKey)
-		response.Ok = true
-		response.Cols = make(map[string]string)
-		for _, keyVal := range results {
-			response.Cols[string(keyVal.k)] = string(keyVal.v)
-		}
 	}
+	results, err := ops.ReadCols(txn, tableName, rowKey, colNames)
+	response := colsResponse(rowKey, schema, results, err)
 
 	w.Header().Add("Content-Type", "application-json")
 	enc := json.NewEncoder(w)
 	err = enc.Encode(response)
 	if err != nil {
-		s.lg.Printf(err.Error())
+		s.reqLog(r).Error("Error encoding response", "err", err)
 	}
-	return
 }
 
 func (s *Server) HandlePutRow(w http.ResponseWriter, r *http.Request) {
-	flotillaArgs := parseTableRowColVals(r)
-	result := <-s.flotilla.Command(ops.PUTROW, flotillaArgs)
-	response := &WriteResponse{true, nil}
+	flotillaArgs, err := parseTableRowColVals(r)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	// stamp the write here so every replica applies the same family TTLs
+	flotillaArgs = append(flotillaArgs, ops.Timestamp(time.Now()))
+	result := s.command(r.Context(), ops.PUTROW, flotillaArgs)
+	response := &WriteResponse{true, ""}
 	if result.Err != nil {
 		response.Ok = false
-		response.Err = result.Err
+		response.Err = result.Err.Error()
 	}
 	w.Header().Add("Content-Type", "application-json")
+	writeCommandStatus(w, result.Err)
 	enc := json.NewEncoder(w)
-	err := enc.Encode(response)
+	err = enc.Encode(response)
 	if err != nil {
-		s.lg.Printf(err.Error())
+		s.reqLog(r).Error("Error encoding response", "err", err)
 	}
 }
 
+// url is formatted like /getRow/tableName/rowKey, optionally with family=f params, read through raft
 func (s *Server) HandleGetRow(w http.ResponseWriter, r *http.Request) {
 
 	flotillaArgs := parseTableRowKey(r)
-	result := <-s.flotilla.Command(ops.GETROW, flotillaArgs)
-	response := &ReadResponse{}
-
-	if result.Err != nil {
-		response.Ok = false
-		response.Err = result.Err
-	} else {
-		resultCols, err := bytesCols(result.Response)
-		if err != nil {
-			s.lg.Printf("Error in getRow: %s", err)
-			response.Ok = false
-			response.Err = err
-		} else {
-			response.Ok = true
-			response.Key = string(flotillaArgs[0])
-			response.Cols = make(map[string]string)
-			for _, keyVal := range resultCols {
-				response.Cols[string(keyVal.k)] = string(keyVal.v)
-			}
-		}
+	// optionally restrict to some column families, family= selects columns outside of any family
+	for _, family := range r.URL.Query()["family"] {
+		flotillaArgs = append(flotillaArgs, []byte(family))
+	}
+	schema, err := s.tableSchema(string(flotillaArgs[1]))
+	if err != nil {
+		returnErr(w, err)
+		return
+	}
+	result := s.command(r.Context(), ops.GETROW, flotillaArgs)
+	response := colsResponse(flotillaArgs[0], schema, result.Response, result.Err)
+	if result.Err == nil && !response.Ok {
+		s.reqLog(r).Error("Error in getRow", "err", response.Err)
 	}
 	w.Header().Add("Content-Type", "application-json")
+	writeCommandStatus(w, result.Err)
 	enc := json.NewEncoder(w)
-	err := enc.Encode(response)
+	err = enc.Encode(response)
 	if err != nil {
-		s.lg.Printf(err.Error())
+		s.reqLog(r).Error("Error encoding response", "err", err)
 	}
-
-	return
 }
 
+// like HandleGetRow, but reads from this node's copy without going through raft,
+// so it may not see the latest writes
 func (s *Server) HandleGetRowFast(w http.ResponseWriter, r *http.Request) {
 
 	flotillaArgs := parseTableRowKey(r)
-	txn, err := s.flotilla.Read()
-	if err != nil {
-		returnErr(w, err)
-		return
-	}
 	// rowKey is args[0], tableName is args[1]
 	rowKey := flotillaArgs[0]
 	tableName := string(flotillaArgs[1])
-	dbi, err := txn.DBIOpen(&tableName, mdb.CREATE)
+	var families [][]byte = nil
+	for _, family := range r.URL.Query()["family"] {
+		families = append(families, []byte(family))
+	}
+	txn, err := s.flotilla.Read()
 	if err != nil {
 		returnErr(w, err)
 		return
 	}
-	results, err := getCols(txn, dbi, rowKey, nil)
-
-	response := &ReadResponse{}
+	defer txn.Abort()
+	schema, err := ops.GetSchema(txn, tableName)
 	if err != nil {
-		response.Ok = false
-		response.Err = err
+		returnErr(w, err)
 		return
-	} else {
-		response.Key = string(rowKey)
-		response.Ok = true
-		response.Cols = make(map[string]string)
-		for _, keyVal := range results {
-			response.Cols[string(keyVal.k)] = string(keyVal.v)
-		}
 	}
+	results, err := ops.ReadRow(txn, tableName, rowKey, families)
+	response := colsResponse(rowKey, schema, results, err)
 
 	w.Header().Add("Content-Type", "application-json")
 	enc := json.NewEncoder(w)
 	err = enc.Encode(response)
 	if err != nil {
-		s.lg.Printf(err.Error())
+		s.reqLog(r).Error("Error encoding response", "err", err)
 	}
-	return
+}
+
+// decodes columns from GetCols or GetRow into a response, rendered with the table's schema
+func colsResponse(rowKey []byte, schema *ops.Schema, encoded []byte, err error) *ReadResponse {
+	response := &ReadResponse{}
+	if err == nil {
+		var keyVals [][]byte
+		keyVals, err = ops.DecodeCols(encoded)
+		if err == nil {
+			response.Ok = true
+			response.Key = string(rowKey)
+			response.Cols = make(map[string]interface{})
+			for i := 0; i < len(keyVals); i += 2 {
+				col := string(keyVals[i])
+				response.Cols[col] = schema.Render(col, keyVals[i+1])
+			}
+			return response
+		}
+	}
+	response.Ok = false
+	response.Err = err.Error()
+	return response
 }
 
 func (s *Server) HandleDelRow(w http.ResponseWriter, r *http.Request) {
 	flotillaArgs := parseTableRowKey(r)
-	result := <-s.flotilla.Command(ops.DELROW, flotillaArgs)
-	response := &WriteResponse{true, nil}
+	result := s.command(r.Context(), ops.DELROW, flotillaArgs)
+	response := &WriteResponse{true, ""}
 	if result.Err != nil {
 		response.Ok = false
-		response.Err = result.Err
+		response.Err = result.Err.Error()
 	}
 	w.Header().Add("Content-Type", "application-json")
+	writeCommandStatus(w, result.Err)
 	enc := json.NewEncoder(w)
 	err := enc.Encode(response)
 	if err != nil {
-		s.lg.Printf(err.Error())
+		s.reqLog(r).Error("Error encoding response", "err", err)
+	}
+}
+
+// loads the schema for a table from our local copy of the database, nil if it has none
+func (s *Server) tableSchema(table string) (*ops.Schema, error) {
+	txn, err := s.flotilla.Read()
+	if err != nil {
+		return nil, err
 	}
+	defer txn.Abort()
+	return ops.GetSchema(txn, table)
 }
 
 func returnErr(w http.ResponseWriter, err error) {
@@ -1,74 +1,307 @@
 package merchdb
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	ops "github.com/jbooth/merchdb/ops"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
-func TestMerchDB(t *testing.T) {
-	os.RemoveAll("/tmp/merchdbTest")
-	os.MkdirAll("/tmp/merchdbTest", os.FileMode(0777))
+func TestReadPaths(t *testing.T) {
+	s := &Server{
+		flotilla: newLocalDB(t, "/tmp/merchdbReadPathsTest"),
+		lg:       defaultLogger(),
+		metrics:  newServerMetrics(),
+		tracing:  newServerTracer(nil),
+		closed:   make(chan struct{}),
+	}
+	defer s.flotilla.Close()
+	result := s.command(context.Background(), ops.PUTCOLS, [][]byte{[]byte("row1"), []byte("table1"), []byte("col1"), []byte("val1"), []byte("col2"), []byte("val2")})
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
 
-	homeDirs := []string{"/tmp/merchdbTest/1", "/tmp/merchdbTest/2", "/tmp/merchdbTest/3"}
-	webAddrs := []string{"localhost:8001", "localhost:8002", "localhost:8003"}
-	flotAddrs := []string{"localhost:1101", "localhost:1102", "localhost:1103"}
+	rt := newRouter()
+	rt.handle("/getRow/{table}/{row}", s.HandleGetRow)
+	rt.handle("/getRowFast/{table}/{row}", s.HandleGetRowFast)
+	rt.handle("/getCols/{table}/{row}", s.HandleGetCols)
+	rt.handle("/getColsFast/{table}/{row}", s.HandleGetColsFast)
+	read := func(url string) *ReadResponse {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		if w.Code != 200 {
+			t.Fatalf("%s returned %d : %s", url, w.Code, w.Body.String())
+		}
+		response := &ReadResponse{}
+		err := json.NewDecoder(w.Body).Decode(response)
+		if err != nil {
+			t.Fatalf("%s : %s", url, err)
+		}
+		return response
+	}
+	for _, url := range []string{"/getRow/table1/row1", "/getRowFast/table1/row1"} {
+		response := read(url)
+		if !response.Ok || response.Key != "row1" || len(response.Cols) != 2 || response.Cols["col2"] != "val2" {
+			t.Fatalf("Unexpected response from %s : %+v", url, response)
+		}
+		response = read(strings.Replace(url, "row1", "badrow", 1))
+		if !response.Ok || len(response.Cols) != 0 {
+			t.Fatalf("Expected no columns for a missing row from %s : %+v", url, response)
+		}
+	}
+	for _, url := range []string{"/getCols/table1/row1?col2&missing", "/getColsFast/table1/row1?col2&missing"} {
+		response := read(url)
+		if !response.Ok || len(response.Cols) != 1 || response.Cols["col2"] != "val2" {
+			t.Fatalf("Unexpected response from %s : %+v", url, response)
+		}
+	}
+}
 
-	dbs := make([]*Server, 3)
-	waitingUp := make([]chan error, 3)
-	for i := 0; i < 3; i++ {
-		waitingUp[i] = make(chan error)
+// writes the op rejects come back as a 400 with the reason in the response
+func TestInvalidWrites(t *testing.T) {
+	s := &Server{
+		flotilla: newLocalDB(t, "/tmp/merchdbInvalidWritesTest"),
+		lg:       defaultLogger(),
+		metrics:  newServerMetrics(),
+		tracing:  newServerTracer(nil),
+		closed:   make(chan struct{}),
+	}
+	defer s.flotilla.Close()
+	result := s.command(context.Background(), ops.SETSCHEMA, [][]byte{[]byte("table1"), []byte(`{"Columns":{"n":{"Type":"int64","Required":true}}}`)})
+	if result.Err != nil {
+		t.Fatal(result.Err)
 	}
 
-	// start'em
-	for i := 0; i < 3; i++ {
-		go func(j int) {
-			fmt.Printf("Starting db %d\n", j)
-			var err error
-			err = os.MkdirAll(homeDirs[j], os.FileMode(0777))
-			if err != nil {
-				panic(err)
-			}
-			dbs[j], err = NewServer(webAddrs[j], flotAddrs[j], homeDirs[j], flotAddrs)
-			fmt.Printf("Pushing err to chan for %d\n", j)
-			waitingUp[j] <- err
-			fmt.Printf("Sent err to chan for %d\n", j)
-		}(i)
+	rt := newRouter()
+	rt.handle("/putCols/{table}/{row}", s.HandlePutCols)
+	rt.handle("/putRow/{table}/{row}", s.HandlePutRow)
+	for _, c := range []struct {
+		url    string
+		code   int
+		expErr string
+	}{
+		{"/putCols/table1/row1?n=5", 200, ""},
+		{"/putCols/table1/row1?n=five", 400, "not a valid int64"},
+		{"/putRow/table1/row1?other=1", 400, "missing required column n"},
+		{"/putCols/_acls/row1?n=5", 400, "reserved"},
+	} {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest("GET", c.url, nil))
+		response := &WriteResponse{}
+		err := json.NewDecoder(w.Body).Decode(response)
+		if err != nil {
+			t.Fatalf("%s : %s", c.url, err)
+		}
+		if w.Code != c.code || response.Ok != (c.expErr == "") || !strings.Contains(response.Err, c.expErr) {
+			t.Fatalf("Expected %d %q from %s, got %d %+v", c.code, c.expErr, c.url, w.Code, response)
+		}
+	}
+}
+
+func TestServerConfig(t *testing.T) {
+	dataDir := "/tmp/merchdbServerConfigTest"
+	os.RemoveAll(dataDir)
+	reserved, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
 	}
+	flotillaAddr := reserved.Addr().String()
+	reserved.Close()
+	sc := DefaultServerConfig()
+	sc.WebAddr = "127.0.0.1:0"
+	sc.FlotillaAddr = flotillaAddr
+	sc.DataDir = dataDir
+	sc.Peers = []string{flotillaAddr}
+	sc.ReadTimeout = 3 * time.Second
+	sc.WriteTimeout = 4 * time.Second
+	sc.IdleTimeout = 5 * time.Second
+	sc.MaxHeaderBytes = 4096
+	sc.MaxBodyBytes = 16
+	s, err := NewServerWithConfig(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	h := s.http
+	if h.ReadTimeout != sc.ReadTimeout || h.ReadHeaderTimeout != sc.ReadHeaderTimeout || h.WriteTimeout != sc.WriteTimeout ||
+		h.IdleTimeout != sc.IdleTimeout || h.MaxHeaderBytes != sc.MaxHeaderBytes || s.maxBodyBytes != sc.MaxBodyBytes {
+		t.Fatalf("Expected the http server configured from %+v, got %+v", sc, h)
+	}
+	url := "http://" + s.httpListen.Addr().String() + "/putRow/t/r"
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewReader(make([]byte, 100)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected a 413 for a body over MaxBodyBytes, got %d", resp.StatusCode)
+	}
+}
 
-	// wait all up
-	for i := 0; i < 3; i++ {
-		fmt.Printf("Waiting on server %d\n", i)
-		err := <-waitingUp[i]
+// imports, exports and backups run past the body and time limits other requests get
+func TestStreamingLimits(t *testing.T) {
+	s := &Server{maxBodyBytes: 16}
+	limit := 100 * time.Millisecond
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
 		if err != nil {
-			fmt.Printf("Error starting server %d : %s", i, err)
-			panic(err)
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
 		}
+		time.Sleep(2 * limit)
+		w.Write([]byte(fmt.Sprintf("read %d", len(body))))
 	}
+	hs := httptest.NewUnstartedServer(s.limitBody(http.HandlerFunc(slow)))
+	hs.Config.ReadTimeout = limit
+	hs.Config.WriteTimeout = limit
+	hs.Start()
+	defer hs.Close()
 
-	fmt.Printf("All servers up\n")
+	post := func(path string, size int) (string, error) {
+		// send half the body, then the rest once the read timeout's passed
+		r, pw := io.Pipe()
+		go func() {
+			pw.Write(make([]byte, size/2))
+			time.Sleep(2 * limit)
+			pw.Write(make([]byte, size-size/2))
+			pw.Close()
+		}()
+		resp, err := http.Post(hs.URL+path, "application/octet-stream", r)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return fmt.Sprintf("%d %s", resp.StatusCode, body), err
+	}
+	for _, path := range []string{"/admin/import", "/admin/export", "/admin/backup"} {
+		got, err := post(path, 100)
+		if err != nil || got != "200 read 100" {
+			t.Fatalf("Expected %s to run past the limits, got %q %v", path, got, err)
+		}
+	}
+	got, err := post("/putRow/t/r", 10)
+	if err == nil && got == "200 read 10" {
+		t.Fatalf("Expected a slow write to time out")
+	}
+	resp, err := http.Post(hs.URL+"/putRow/t/r", "application/octet-stream", bytes.NewReader(make([]byte, 100)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected a 413 for a body over the limit, got %d", resp.StatusCode)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	started := make(chan struct{}, 2)
+	s := &Server{
+		flotilla:  newLocalDB(t, "/tmp/merchdbShutdownTest"),
+		http:      &http.Server{},
+		lg:        defaultLogger(),
+		closed:    make(chan struct{}),
+		closeOnce: &sync.Once{},
+	}
+	s.http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		io.Copy(io.Discard, r.Body)
+		w.Write([]byte("done"))
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.http.Serve(l)
+	url := "http://" + l.Addr().String() + "/admin/import"
+
+	// a request that's in flight until we finish its body
+	body, bodyW := io.Pipe()
+	responses := make(chan string, 1)
+	go func() {
+		resp, err := http.Post(url, "application/octet-stream", body)
+		if err != nil {
+			responses <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		responses <- string(b)
+	}()
+	bodyW.Write([]byte("some"))
+	<-started
 
-	//	// test some column PUTs and a get
-	//	http.Get("http://localhost:8001/putCols/table1/row1?col1=val1&col2=val2")
-	//	http.Get("http://localhost:8002/putCols/table1/row1?col3=val3&col4=val4")
-	//
-	//	row,err := http.Get("http://localHost:8003/getRow/table1/row1")
-	//	if err != nil {
-	//		t.Fatal(err)
-	//	}
-	//	fmt.Print(row)
-	//
-	//	// test get of bad key
-	//	row,err = http.Get("http://localHost:8003/getRow/table1/badrow")
-	//	if err != nil {
-	//		t.Fatal(err)
-	//	}
-	//	fmt.Print(row)
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned with a request in flight : %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	bodyW.Close()
+	if got := <-responses; got != "done" {
+		t.Fatalf("Expected the request in flight to finish, got %q", got)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatalf("Shutdown : %s", err)
+	}
+	if _, err := http.Get(url); err == nil {
+		t.Fatalf("Expected requests to fail after shutdown")
+	}
+	if s.Shutdown(context.Background()) != nil || s.Close() != nil {
+		t.Fatalf("Expected closing again to do nothing")
+	}
+}
 
-	// shut'em down
-	for i := 0; i < 3; i++ {
-		fmt.Printf("Killing server %d\n", i)
-		dbs[i].Close()
+// a request that doesn't finish by the deadline is cut off
+func TestShutdownDeadline(t *testing.T) {
+	s := &Server{
+		flotilla:  newLocalDB(t, "/tmp/merchdbShutdownDeadlineTest"),
+		http:      &http.Server{},
+		lg:        defaultLogger(),
+		closed:    make(chan struct{}),
+		closeOnce: &sync.Once{},
+	}
+	started := make(chan struct{})
+	s.http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		io.Copy(io.Discard, r.Body)
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
 	}
+	go s.http.Serve(l)
+	body, bodyW := io.Pipe()
+	failed := make(chan error, 1)
+	go func() {
+		resp, err := http.Post("http://"+l.Addr().String()+"/admin/import", "application/octet-stream", body)
+		if err == nil {
+			resp.Body.Close()
+		}
+		failed <- err
+	}()
+	bodyW.Write([]byte("some"))
+	<-started
 
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = s.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected the deadline's error, got %v", err)
+	}
+	bodyW.Close()
+	if err := <-failed; err == nil {
+		t.Fatalf("Expected the request in flight to be cut off")
+	}
 }
@@ -0,0 +1,149 @@
+package merchdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	ops "github.com/jbooth/merchdb/ops"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// how long /ready waits for a barrier command to come back through raft
+const readyTimeout = 2 * time.Second
+
+// a successful barrier is reused for this long, so frequent load balancer checks
+// don't each add an entry to the raft log
+const readyCacheTime = 1 * time.Second
+
+// url is /health
+// liveness check, ok as long as we're serving http and can open a read transaction
+func (s *Server) HandleHealth(w http.ResponseWriter, r *http.Request) {
+	txn, err := s.flotilla.Read()
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	txn.Abort()
+	w.Write([]byte("ok"))
+}
+
+// url is /ready
+// readiness check, ok if there's a leader and we've applied everything it's committed
+func (s *Server) HandleReady(w http.ResponseWriter, r *http.Request) {
+	err := s.Ready()
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// Ready returns nil if the cluster has a leader and this node is caught up with it.
+// Checks by sending a barrier command through raft, which only returns once it's been
+// committed and applied locally along with everything before it.
+func (s *Server) Ready() error {
+	if l, ok := s.flotilla.(leaderer); ok && l.Leader() == nil {
+		return fmt.Errorf("No leader")
+	}
+	s.readyLock.Lock()
+	defer s.readyLock.Unlock()
+	if time.Since(s.lastReady) < readyCacheTime {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), readyTimeout)
+	defer cancel()
+	result := s.command(ctx, ops.BARRIER, [][]byte{})
+	if result.Err == ErrCommandTimeout {
+		return fmt.Errorf("Timed out after %s waiting to catch up", readyTimeout)
+	}
+	if result.Err != nil {
+		return result.Err
+	}
+	s.lastReady = time.Now()
+	return nil
+}
+
+// url is /status
+func (s *Server) HandleStatus(w http.ResponseWriter, r *http.Request) {
+	status := s.Status()
+	w.Header().Add("Content-Type", "application-json")
+	enc := json.NewEncoder(w)
+	err := enc.Encode(status)
+	if err != nil {
+		s.reqLog(r).Error("Error encoding response", "err", err)
+	}
+}
+
+// Status reports this node's view of the cluster.  Raft fields are only filled in
+// if our flotilla exposes them, and the lease fields only if we hold leases.
+func (s *Server) Status() *StatusResponse {
+	status := &StatusResponse{Ok: true, Role: "unknown", WebAddr: s.http.Addr, FlotillaAddr: s.flotillaAddr}
+	if l, ok := s.flotilla.(leaderer); ok {
+		if l.IsLeader() {
+			status.Role = "leader"
+		} else {
+			status.Role = "follower"
+		}
+		if leader := l.Leader(); leader != nil {
+			status.Leader = leader.String()
+			status.LeaderWebAddr, _ = s.leaderWebAddr(l)
+		}
+	}
+	if stats := s.raftStats(); stats != nil {
+		if state, ok := stats["state"]; ok {
+			status.Role = state
+		}
+		status.Term, _ = s.raftStat("term")
+		status.CommitIndex, _ = s.raftStat("commit_index")
+		status.AppliedIndex, _ = s.raftStat("applied_index")
+	}
+	if l, ok := s.leadership().(*leaseLeader); ok {
+		if holder := l.Leader(); holder != nil {
+			status.LeaseHolder = holder.String()
+		}
+		status.LeaseEpoch, _ = s.leaseEpoch()
+	}
+	var err error
+	status.Peers, err = s.Peers()
+	if err == nil {
+		status.DataDirBytes, err = dirSize(s.dataDir)
+	}
+	if err == nil {
+		status.AppliedCommands, err = s.appliedCommands()
+	}
+	if err != nil {
+		status.Ok = false
+		status.Err = err.Error()
+	}
+	return status
+}
+
+// the number of commands applied to our local copy of the database
+func (s *Server) appliedCommands() (uint64, error) {
+	txn, err := s.flotilla.Read()
+	if err != nil {
+		return 0, err
+	}
+	defer txn.Abort()
+	return ops.AppliedCommands(txn)
+}
+
+// total size of the regular files under dir
+func dirSize(dir string) (int64, error) {
+	var size int64 = 0
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
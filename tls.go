@@ -0,0 +1,153 @@
+package merchdb
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// how often to check whether the cert, key or CA files have changed
+const tlsReloadInterval = 5 * time.Second
+
+// TLSConfig configures TLS for the web API.  Files are reloaded when they
+// change, so certs can be rotated without a restart.
+//
+// This doesn't cover flotilla's replication traffic, which binds its own
+// plain TCP listener, so run that over a trusted network or a tunnel.
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// PEM bundle used to verify client certs, and the leader's cert when
+	// proxying writes to it.  System roots are used if empty.
+	CAFile string
+	// require clients to present a cert signed by CAFile
+	RequireClientCert bool
+}
+
+// WithTLS serves the web API over TLS
+func WithTLS(cfg TLSConfig) Option {
+	return func(c *config) {
+		c.tls = &cfg
+	}
+}
+
+// the current cert and CA pool, reloaded when the files change
+type tlsState struct {
+	cfg       TLSConfig
+	lock      *sync.Mutex
+	cert      *tls.Certificate
+	pool      *x509.CertPool
+	transport *http.Transport
+	// mod times of the files as of the last load
+	modTimes  [3]time.Time
+	lastCheck time.Time
+}
+
+func newTLSState(cfg TLSConfig) (*tlsState, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, fmt.Errorf("TLS requires a cert and key file")
+	}
+	if cfg.RequireClientCert && cfg.CAFile == "" {
+		return nil, fmt.Errorf("Requiring client certs requires a CA file to verify them")
+	}
+	t := &tlsState{cfg: cfg, lock: &sync.Mutex{}}
+	_, err := t.reloadIfChanged(true)
+	return t, err
+}
+
+// reloads everything if any of the files have a new mod time, returns whether it did
+func (t *tlsState) reloadIfChanged(force bool) (bool, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !force && time.Since(t.lastCheck) < tlsReloadInterval {
+		return false, nil
+	}
+	t.lastCheck = time.Now()
+	var modTimes [3]time.Time
+	for i, path := range []string{t.cfg.CertFile, t.cfg.KeyFile, t.cfg.CAFile} {
+		if path == "" {
+			continue
+		}
+		st, err := os.Stat(path)
+		if err != nil {
+			return false, err
+		}
+		modTimes[i] = st.ModTime()
+	}
+	if !force && modTimes == t.modTimes {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(t.cfg.CertFile, t.cfg.KeyFile)
+	if err != nil {
+		return false, fmt.Errorf("Couldn't load TLS cert %s : %s", t.cfg.CertFile, err)
+	}
+	var pool *x509.CertPool
+	if t.cfg.CAFile != "" {
+		pem, err := os.ReadFile(t.cfg.CAFile)
+		if err != nil {
+			return false, err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return false, fmt.Errorf("No certs found in CA file %s", t.cfg.CAFile)
+		}
+	}
+	t.cert = &cert
+	t.pool = pool
+	t.modTimes = modTimes
+	if t.transport != nil {
+		t.transport.CloseIdleConnections()
+	}
+	// present our cert to the leader too, in case it requires client certs
+	t.transport = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      pool,
+		},
+	}
+	return true, nil
+}
+
+// server side config for each handshake, picking up any reloaded files
+func (s *Server) tlsConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	reloaded, err := s.tlsState.reloadIfChanged(false)
+	if err != nil {
+		// keep serving the last good cert
+		s.lg.Error("Error reloading TLS files", "err", err)
+	} else if reloaded {
+		s.lg.Info("Reloaded TLS files", "cert", s.tlsState.cfg.CertFile)
+	}
+	t := s.tlsState
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{*t.cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if t.cfg.RequireClientCert {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		cfg.ClientCAs = t.pool
+	}
+	return cfg, nil
+}
+
+// wraps the web listener to terminate TLS
+func (s *Server) tlsListener(l net.Listener) net.Listener {
+	return tls.NewListener(l, &tls.Config{GetConfigForClient: s.tlsConfigForClient})
+}
+
+// transport for proxying writes to the leader, nil for the default when we're not using TLS
+func (s *Server) proxyTransport() http.RoundTripper {
+	if s.tlsState == nil {
+		return nil
+	}
+	s.tlsState.lock.Lock()
+	defer s.tlsState.lock.Unlock()
+	return s.tlsState.transport
+}
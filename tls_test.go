@@ -0,0 +1,95 @@
+package merchdb
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+)
+
+// writes a self-signed cert and key for cn to dir
+func writeTestCert(t *testing.T, dir string, cn string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	for path, data := range map[string][]byte{dir + "/cert.pem": certPem, dir + "/key.pem": keyPem, dir + "/ca.pem": certPem} {
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	dir := "/tmp/merchdbTLSTest"
+	os.RemoveAll(dir)
+	os.MkdirAll(dir, 0755)
+	writeTestCert(t, dir, "first")
+
+	_, err := newTLSState(TLSConfig{CertFile: dir + "/cert.pem", KeyFile: dir + "/key.pem", RequireClientCert: true})
+	if err == nil {
+		t.Fatal("Expected error requiring client certs without a CA")
+	}
+	st, err := newTLSState(TLSConfig{CertFile: dir + "/cert.pem", KeyFile: dir + "/key.pem", CAFile: dir + "/ca.pem", RequireClientCert: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{lg: defaultLogger(), tlsState: st}
+	commonName := func() string {
+		cfg, err := s.tlsConfigForClient(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(cfg.Certificates[0].Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert.Subject.CommonName
+	}
+	if cn := commonName(); cn != "first" {
+		t.Fatalf("Expected first cert, got %s", cn)
+	}
+
+	// rotate, making sure the mod time moves even on coarse filesystems
+	writeTestCert(t, dir, "second")
+	later := time.Now().Add(time.Minute)
+	for _, f := range []string{"/cert.pem", "/key.pem", "/ca.pem"} {
+		os.Chtimes(dir+f, later, later)
+	}
+	if cn := commonName(); cn != "first" {
+		t.Fatalf("Reloaded before the check interval, got %s", cn)
+	}
+	st.lastCheck = time.Time{}
+	if cn := commonName(); cn != "second" {
+		t.Fatalf("Expected rotated cert, got %s", cn)
+	}
+	cfg, _ := s.tlsConfigForClient(nil)
+	if cfg.ClientCAs == nil {
+		t.Fatal("Expected client CAs when requiring client certs")
+	}
+}
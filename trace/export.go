@@ -0,0 +1,92 @@
+package trace
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// one line of WriterExporter output
+type SpanRecord struct {
+	Name     string            `json:"name"`
+	TraceID  string            `json:"traceId"`
+	SpanID   string            `json:"spanId"`
+	ParentID string            `json:"parentId,omitempty"`
+	Start    time.Time         `json:"start"`
+	End      time.Time         `json:"end"`
+	Duration time.Duration     `json:"durationNanos"`
+	Attrs    map[string]string `json:"attrs,omitempty"`
+	Err      string            `json:"err,omitempty"`
+}
+
+func record(s *Span) SpanRecord {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	r := SpanRecord{
+		Name:     s.Name,
+		TraceID:  s.Context.TraceID.String(),
+		SpanID:   s.Context.SpanID.String(),
+		Start:    s.Start,
+		End:      s.End,
+		Duration: s.End.Sub(s.Start),
+		Attrs:    make(map[string]string, len(s.Attrs)),
+		Err:      s.Err,
+	}
+	if s.Parent != (SpanID{}) {
+		r.ParentID = s.Parent.String()
+	}
+	for k, v := range s.Attrs {
+		r.Attrs[k] = v
+	}
+	return r
+}
+
+// WriterExporter writes each finished span as a line of JSON, for local use
+type WriterExporter struct {
+	lock *sync.Mutex
+	enc  *json.Encoder
+	c    io.Closer
+	// first write error, later spans are dropped
+	err error
+}
+
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{&sync.Mutex{}, json.NewEncoder(w), nil, nil}
+}
+
+// appends spans to the file at path, creating it if necessary
+func NewFileExporter(path string) (*WriterExporter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	e := NewWriterExporter(f)
+	e.c = f
+	return e, nil
+}
+
+func (e *WriterExporter) Export(s *Span) {
+	r := record(s)
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.err == nil {
+		e.err = e.enc.Encode(r)
+	}
+}
+
+// returns the first error writing spans, if any
+func (e *WriterExporter) Err() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.err
+}
+
+// closes the underlying file, for exporters from NewFileExporter
+func (e *WriterExporter) Close() error {
+	if e.c == nil {
+		return nil
+	}
+	return e.c.Close()
+}
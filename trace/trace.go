@@ -0,0 +1,211 @@
+// Package trace implements spans with W3C trace context propagation and a
+// pluggable exporter, without pulling in a tracing client library.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// header carrying trace context between processes, see https://www.w3.org/TR/trace-context/
+const TraceparentHeader = "traceparent"
+
+type TraceID [16]byte
+
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+
+func (s SpanID) String() string { return hex.EncodeToString(s[:]) }
+
+// identifies a span and the trace it belongs to
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// the zero SpanContext is invalid, as are all-zero ids in a traceparent header
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// formats as a traceparent header value
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// parses a version 00 traceparent header value
+func ParseTraceparent(h string) (SpanContext, error) {
+	sc := SpanContext{}
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) != 4 || parts[0] != "00" {
+		return sc, fmt.Errorf("Malformed traceparent %q", h)
+	}
+	if err := decodeHex(sc.TraceID[:], parts[1]); err != nil {
+		return sc, fmt.Errorf("Bad trace id in traceparent %q : %s", h, err)
+	}
+	if err := decodeHex(sc.SpanID[:], parts[2]); err != nil {
+		return sc, fmt.Errorf("Bad span id in traceparent %q : %s", h, err)
+	}
+	flags := []byte{0}
+	if err := decodeHex(flags, parts[3]); err != nil {
+		return sc, fmt.Errorf("Bad flags in traceparent %q : %s", h, err)
+	}
+	sc.Sampled = flags[0]&1 == 1
+	if !sc.IsValid() {
+		return sc, fmt.Errorf("Zero id in traceparent %q", h)
+	}
+	return sc, nil
+}
+
+func decodeHex(dst []byte, s string) error {
+	if len(s) != hex.EncodedLen(len(dst)) || strings.ToLower(s) != s {
+		return fmt.Errorf("expected %d lowercase hex chars, got %q", hex.EncodedLen(len(dst)), s)
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err
+}
+
+// Exporter receives spans as they finish.  Export is called concurrently.
+type Exporter interface {
+	Export(span *Span)
+}
+
+// A Span times one unit of work.  A nil *Span is valid and does nothing, which
+// is what a Tracer without an exporter hands out.
+type Span struct {
+	Name    string
+	Context SpanContext
+	// zero for root spans
+	Parent SpanID
+	Start  time.Time
+	End    time.Time
+	Attrs  map[string]string
+	Err    string
+	lock   *sync.Mutex
+	tracer *Tracer
+}
+
+func (s *Span) SetAttr(key string, val string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	s.Attrs[key] = val
+	s.lock.Unlock()
+}
+
+// records err on the span, nil errors are ignored
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.lock.Lock()
+	s.Err = err.Error()
+	s.lock.Unlock()
+}
+
+// ends the span and exports it if it's sampled
+func (s *Span) Finish() {
+	s.FinishAt(time.Now())
+}
+
+// ends the span at the given time, for work that was timed elsewhere
+func (s *Span) FinishAt(end time.Time) {
+	if s == nil {
+		return
+	}
+	s.End = end
+	if s.Context.Sampled {
+		s.tracer.exporter.Export(s)
+	}
+}
+
+// returns the span's context, or the zero context for a nil span
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.Context
+}
+
+// Tracer starts spans and hands finished ones to its exporter.  A nil *Tracer
+// is valid and only returns nil spans.
+type Tracer struct {
+	exporter Exporter
+}
+
+// returns a tracer that exports to exp, or nil if exp is nil
+func NewTracer(exp Exporter) *Tracer {
+	if exp == nil {
+		return nil
+	}
+	return &Tracer{exp}
+}
+
+type spanKey struct{}
+
+type remoteKey struct{}
+
+// returns the span started in ctx, if any
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// sets a parent from another process, for the next span started in ctx
+func WithRemoteParent(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// starts a span as a child of the span or remote parent in ctx, or a new root if there's neither
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	parent := FromContext(ctx).SpanContext()
+	if !parent.IsValid() {
+		parent, _ = ctx.Value(remoteKey{}).(SpanContext)
+	}
+	s := t.StartAt(parent, name, time.Now())
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// starts a span with an explicit parent and start time, parent may be the zero context for a new root
+func (t *Tracer) StartAt(parent SpanContext, name string, start time.Time) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{
+		Name:   name,
+		Start:  start,
+		Attrs:  make(map[string]string),
+		lock:   &sync.Mutex{},
+		tracer: t,
+	}
+	if parent.IsValid() {
+		s.Context.TraceID = parent.TraceID
+		s.Context.Sampled = parent.Sampled
+		s.Parent = parent.SpanID
+	} else {
+		randomID(s.Context.TraceID[:])
+		s.Context.Sampled = true
+	}
+	randomID(s.Context.SpanID[:])
+	return s
+}
+
+func randomID(b []byte) {
+	// crypto/rand doesn't fail on supported platforms, and a collision only muddles a trace
+	_, _ = rand.Read(b)
+}
@@ -0,0 +1,95 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestTraceparent(t *testing.T) {
+	h := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceparent(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sc.Sampled || sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" {
+		t.Fatalf("Parsed %s wrong : %#v", h, sc)
+	}
+	if sc.Traceparent() != h {
+		t.Fatalf("Round trip of %s gave %s", h, sc.Traceparent())
+	}
+
+	for _, bad := range []string{
+		"",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-zz",
+	} {
+		_, err := ParseTraceparent(bad)
+		if err == nil {
+			t.Fatalf("Expected error parsing %q", bad)
+		}
+	}
+}
+
+func TestSpans(t *testing.T) {
+	out := &bytes.Buffer{}
+	tracer := NewTracer(NewWriterExporter(out))
+
+	remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, root := tracer.Start(WithRemoteParent(context.Background(), remote), "http")
+	_, child := tracer.Start(ctx, "command")
+	child.SetAttr("op", "PutCols")
+	child.SetError(fmt.Errorf("boom"))
+	child.Finish()
+	root.Finish()
+
+	// unsampled traces aren't exported
+	unsampled := remote
+	unsampled.Sampled = false
+	_, dropped := tracer.Start(WithRemoteParent(context.Background(), unsampled), "dropped")
+	dropped.Finish()
+
+	dec := json.NewDecoder(out)
+	records := make([]SpanRecord, 0)
+	for dec.More() {
+		r := SpanRecord{}
+		if err := dec.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 spans, got %#v", records)
+	}
+	c, p := records[0], records[1]
+	if c.Name != "command" || p.Name != "http" {
+		t.Fatalf("Spans out of order : %#v", records)
+	}
+	if p.TraceID != remote.TraceID.String() || c.TraceID != p.TraceID {
+		t.Fatalf("Spans didn't join remote trace : %#v", records)
+	}
+	if p.ParentID != remote.SpanID.String() || c.ParentID != p.SpanID {
+		t.Fatalf("Wrong parents : %#v", records)
+	}
+	if c.Attrs["op"] != "PutCols" || c.Err != "boom" {
+		t.Fatalf("Lost attrs or error : %#v", c)
+	}
+}
+
+func TestNilTracer(t *testing.T) {
+	tracer := NewTracer(nil)
+	ctx, span := tracer.Start(context.Background(), "noop")
+	span.SetAttr("k", "v")
+	span.SetError(fmt.Errorf("ignored"))
+	span.Finish()
+	if FromContext(ctx) != nil || span.SpanContext().IsValid() {
+		t.Fatalf("Nil tracer should hand out nil spans")
+	}
+}
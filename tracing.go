@@ -0,0 +1,159 @@
+package merchdb
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/jbooth/flotilla"
+	mdb "github.com/jbooth/gomdb"
+	ops "github.com/jbooth/merchdb/ops"
+	"github.com/jbooth/merchdb/trace"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// WithTraceExporter turns on tracing, sending spans for HTTP requests, command
+// submission, op execution and commit to exp.  Incoming traceparent headers
+// are honored, so spans join the caller's trace.
+func WithTraceExporter(exp trace.Exporter) Option {
+	return func(c *config) {
+		c.exporter = exp
+	}
+}
+
+// Ops run inside flotilla without a context, so commands submitted here leave
+// their span context keyed by op and args for the local apply to pick up.
+// Applies on other nodes, or that find nothing pending, start their own trace.
+type serverTracer struct {
+	tracer  *trace.Tracer
+	lock    *sync.Mutex
+	pending map[string][]trace.SpanContext
+}
+
+func newServerTracer(exp trace.Exporter) *serverTracer {
+	return &serverTracer{trace.NewTracer(exp), &sync.Mutex{}, make(map[string][]trace.SpanContext)}
+}
+
+func commandKey(op string, args [][]byte) string {
+	key := make([]byte, 0, 64)
+	key = append(key, op...)
+	for _, a := range args {
+		key = binary.LittleEndian.AppendUint32(key, uint32(len(a)))
+		key = append(key, a...)
+	}
+	return string(key)
+}
+
+func (t *serverTracer) expect(key string, sc trace.SpanContext) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.pending[key] = append(t.pending[key], sc)
+}
+
+// takes the oldest span context waiting on key, or the zero context if there's none
+func (t *serverTracer) claim(key string) trace.SpanContext {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	waiting := t.pending[key]
+	if len(waiting) == 0 {
+		return trace.SpanContext{}
+	}
+	t.forgetLocked(key, waiting[0])
+	return waiting[0]
+}
+
+// drops sc from key's waiters, if the apply never claimed it
+func (t *serverTracer) forget(key string, sc trace.SpanContext) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.forgetLocked(key, sc)
+}
+
+func (t *serverTracer) forgetLocked(key string, sc trace.SpanContext) {
+	waiting := t.pending[key]
+	for i, w := range waiting {
+		if w == sc {
+			waiting = append(waiting[:i], waiting[i+1:]...)
+			break
+		}
+	}
+	if len(waiting) == 0 {
+		delete(t.pending, key)
+	} else {
+		t.pending[key] = waiting
+	}
+}
+
+// wraps each op so that applying it and committing its txn are traced
+func (t *serverTracer) traceOps(cmds map[string]flotilla.Command) map[string]flotilla.Command {
+	if t.tracer == nil {
+		return cmds
+	}
+	ret := make(map[string]flotilla.Command, len(cmds))
+	for name, cmd := range cmds {
+		ret[name] = t.traceOp(name, cmd)
+	}
+	return ret
+}
+
+func (t *serverTracer) traceOp(name string, cmd flotilla.Command) flotilla.Command {
+	return func(args [][]byte, txn *mdb.Txn) ([]byte, error) {
+		parent := t.claim(commandKey(name, args))
+		span := t.tracer.StartAt(parent, "op "+name, time.Now())
+		setOpAttrs(span, name, args)
+		ops.WatchCommit(txn, func(start time.Time, end time.Time, err error) {
+			commitSpan := t.tracer.StartAt(span.SpanContext(), "commit", start)
+			commitSpan.SetError(err)
+			commitSpan.FinishAt(end)
+		})
+		ret, err := cmd(args, txn)
+		ops.UnwatchCommit(txn)
+		span.SetError(err)
+		span.Finish()
+		return ret, err
+	}
+}
+
+func setOpAttrs(span *trace.Span, op string, args [][]byte) {
+	span.SetAttr("op", op)
+	if table := ops.OpTable(op, args); table != "" {
+		span.SetAttr("table", table)
+	}
+}
+
+// starts the span for an HTTP request, joining the caller's trace if it sent a traceparent
+func (s *Server) startRequestSpan(r *http.Request, handler string) (*http.Request, *trace.Span) {
+	if s.tracing.tracer == nil {
+		return r, nil
+	}
+	ctx := r.Context()
+	if sc, err := trace.ParseTraceparent(r.Header.Get(trace.TraceparentHeader)); err == nil {
+		ctx = trace.WithRemoteParent(ctx, sc)
+	}
+	ctx, span := s.tracing.tracer.Start(ctx, "http "+handler)
+	span.SetAttr("method", r.Method)
+	span.SetAttr("path", r.URL.Path)
+	return r.WithContext(ctx), span
+}
+
+func finishRequestSpan(span *trace.Span, status int) {
+	span.SetAttr("status", strconv.Itoa(status))
+	if status >= http.StatusInternalServerError {
+		span.SetError(fmt.Errorf("%d %s", status, http.StatusText(status)))
+	}
+	span.Finish()
+}
+
+// starts the span for submitting a command, which the local apply of it will be a child of
+func (s *Server) startCommandSpan(ctx context.Context, op string, args [][]byte) (*trace.Span, func()) {
+	_, span := s.tracing.tracer.Start(ctx, "command "+op)
+	if span == nil {
+		return nil, func() {}
+	}
+	setOpAttrs(span, op, args)
+	key := commandKey(op, args)
+	s.tracing.expect(key, span.SpanContext())
+	return span, func() { s.tracing.forget(key, span.SpanContext()) }
+}
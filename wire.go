@@ -0,0 +1,376 @@
+package merchdb
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/jbooth/flotilla"
+	ops "github.com/jbooth/merchdb/ops"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The wire protocol is a binary alternative to the web API for clients that
+// care about throughput.  Every frame, in either direction, is
+//
+//	4 byte length of the rest of the frame
+//	8 byte request id, echoed back in the response
+//	1 byte op code for requests, or status for responses
+//	body
+//
+// with integers little endian.  Request bodies are in the ops.EncodeCols
+// encoding, the first key and value being the table and row key and the rest
+// being columns as for the matching web endpoint.  Responses to reads carry the
+// columns in the same encoding, and errors carry a message.  Requests on a
+// connection are handled concurrently and may be answered out of order, so
+// clients can pipeline them and match responses by id.
+const (
+	WIRE_PUTCOLS byte = iota + 1
+	WIRE_GETCOLS
+	WIRE_PUTROW
+	WIRE_GETROW
+	WIRE_DELROW
+	// columns are HTTP headers to authenticate the connection with, as though
+	// they were on a GET to wireAuthPath with an empty body
+	WIRE_AUTH
+)
+
+// response statuses
+const (
+	WIRE_OK byte = iota
+	WIRE_ERR
+	// overloaded, timed out or rate limited, and safe to retry later
+	WIRE_RETRY
+	// not authenticated, or not permitted
+	WIRE_DENIED
+)
+
+// the request WIRE_AUTH headers are checked as part of, for signing
+const wireAuthPath = "/wire"
+
+// length, id and code
+const wireHeaderSize = 13
+
+// requests handled at once per connection, past which we stop reading from it
+const wirePipelineDepth = 128
+
+// largest frame body either end reads, even without a smaller limit, so a bad
+// length can't make us allocate gigabytes
+var maxWireFrameBytes int64 = 256 << 20
+
+var wireOpNames = map[byte]string{
+	WIRE_PUTCOLS: ops.PUTCOLS,
+	WIRE_GETCOLS: ops.GETCOLS,
+	WIRE_PUTROW:  ops.PUTROW,
+	WIRE_GETROW:  ops.GETROW,
+	WIRE_DELROW:  ops.DELROW,
+	WIRE_AUTH:    "Auth",
+}
+
+var wireStatusNames = []string{"ok", "error", "retry", "denied"}
+
+// writes a whole frame in one call, so concurrent writers only need to hold a lock around it
+func writeFrame(w io.Writer, id uint64, code byte, body []byte) error {
+	frame := make([]byte, wireHeaderSize+len(body))
+	binary.LittleEndian.PutUint32(frame, uint32(9+len(body)))
+	binary.LittleEndian.PutUint64(frame[4:], id)
+	frame[12] = code
+	copy(frame[wireHeaderSize:], body)
+	_, err := w.Write(frame)
+	return err
+}
+
+// a frame too large to read, which has been skipped so the connection can carry on
+type frameTooLarge struct {
+	id   uint64
+	size int64
+}
+
+func (e *frameTooLarge) Error() string {
+	return fmt.Sprintf("Frame of %d bytes is over the limit", e.size)
+}
+
+// reads the next frame, skipping its body and returning a *frameTooLarge if it's bigger
+// than maxSize, or maxWireFrameBytes if that's smaller or maxSize is zero
+func readFrame(r *bufio.Reader, maxSize int64) (uint64, byte, []byte, error) {
+	if maxSize <= 0 || maxSize > maxWireFrameBytes {
+		maxSize = maxWireFrameBytes
+	}
+	header := make([]byte, wireHeaderSize)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	length := int64(binary.LittleEndian.Uint32(header))
+	if length < 9 {
+		return 0, 0, nil, fmt.Errorf("Frame length %d is shorter than its header", length)
+	}
+	id := binary.LittleEndian.Uint64(header[4:])
+	code := header[12]
+	bodyLen := length - 9
+	if bodyLen > maxSize {
+		_, err = io.CopyN(io.Discard, r, bodyLen)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		return id, code, nil, &frameTooLarge{id, bodyLen}
+	}
+	body := make([]byte, bodyLen)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	return id, code, body, nil
+}
+
+// listener and open connections for the wire protocol
+type wireServer struct {
+	listener net.Listener
+	lock     *sync.Mutex
+	conns    map[net.Conn]bool
+	requests *sync.WaitGroup
+}
+
+// serves the wire protocol on l until it's closed
+func (s *Server) serveWire(l net.Listener) {
+	if s.tlsState != nil {
+		l = s.tlsListener(l)
+	}
+	s.wire = &wireServer{l, &sync.Mutex{}, make(map[net.Conn]bool), &sync.WaitGroup{}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				select {
+				case <-s.closed:
+				default:
+					s.lg.Error("Error accepting wire connection", "addr", l.Addr(), "err", err)
+				}
+				return
+			}
+			s.wire.lock.Lock()
+			s.wire.conns[conn] = true
+			s.wire.lock.Unlock()
+			select {
+			case <-s.closed:
+				// accepted as we were closing, after closeWire looked at conns
+				conn.Close()
+			default:
+			}
+			go s.serveWireConn(conn)
+		}
+	}()
+}
+
+// stops accepting wire connections and closes those open, cutting off their requests
+func (s *Server) closeWire() {
+	if s.wire == nil {
+		return
+	}
+	s.wire.listener.Close()
+	s.wire.lock.Lock()
+	defer s.wire.lock.Unlock()
+	for conn := range s.wire.conns {
+		conn.Close()
+	}
+}
+
+// stops accepting wire connections and waits for requests in flight to be answered
+// before closing them, or for ctx to be done
+func (s *Server) shutdownWire(ctx context.Context) error {
+	if s.wire == nil {
+		return nil
+	}
+	s.wire.listener.Close()
+	drained := make(chan struct{})
+	go func() {
+		s.wire.requests.Wait()
+		close(drained)
+	}()
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	s.closeWire()
+	return err
+}
+
+// reads requests off conn and answers each as it completes
+func (s *Server) serveWireConn(conn net.Conn) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		conn.Close()
+		s.wire.lock.Lock()
+		delete(s.wire.conns, conn)
+		s.wire.lock.Unlock()
+	}()
+	lg := s.lg.With("remote", conn.RemoteAddr().String())
+	client, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		client = conn.RemoteAddr().String()
+	}
+	principal := ""
+	authenticated := s.auth == nil
+	writeLock := &sync.Mutex{}
+	respond := func(id uint64, status byte, body []byte) {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+		err := writeFrame(conn, id, status, body)
+		if err != nil {
+			lg.Debug("Error writing wire response", "err", err)
+			conn.Close()
+		}
+	}
+	r := bufio.NewReader(conn)
+	slots := make(chan struct{}, wirePipelineDepth)
+	for {
+		id, op, body, err := readFrame(r, s.maxBodyBytes)
+		if tooLarge, ok := err.(*frameTooLarge); ok {
+			respond(tooLarge.id, WIRE_ERR, []byte(err.Error()))
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				lg.Debug("Closing wire connection", "err", err)
+			}
+			return
+		}
+		if op == WIRE_AUTH {
+			// handled before reading on, so requests after it run as the new principal
+			start := time.Now()
+			newPrincipal, authErr := s.wireAuthenticate(conn, body)
+			status, resp := WIRE_OK, []byte(nil)
+			if authErr != nil {
+				lg.Info("Rejected wire connection", "err", authErr)
+				status, resp = WIRE_DENIED, []byte(authErr.Error())
+			} else {
+				principal, authenticated, client = newPrincipal, true, newPrincipal
+			}
+			s.observeWire(op, status, start)
+			respond(id, status, resp)
+			continue
+		}
+		slots <- struct{}{}
+		s.wire.requests.Add(1)
+		go func(principal string, authenticated bool, client string) {
+			defer func() {
+				<-slots
+				s.wire.requests.Done()
+			}()
+			start := time.Now()
+			status, resp := WIRE_DENIED, []byte("Connection isn't authenticated")
+			if authenticated {
+				status, resp = s.wireRequest(ctx, principal, client, op, body)
+			}
+			s.observeWire(op, status, start)
+			if status != WIRE_OK {
+				lg.Debug("Failed wire request", "op", wireOpNames[op], "status", wireStatusNames[status], "err", string(resp))
+			}
+			respond(id, status, resp)
+		}(principal, authenticated, client)
+	}
+}
+
+// runs the headers in a WIRE_AUTH body through our Authenticator
+func (s *Server) wireAuthenticate(conn net.Conn, body []byte) (string, error) {
+	if s.auth == nil {
+		return "", fmt.Errorf("Authentication isn't enabled on this node")
+	}
+	headers, err := ops.DecodeCols(body)
+	if err != nil {
+		return "", err
+	}
+	r, err := http.NewRequest("GET", wireAuthPath, http.NoBody)
+	if err != nil {
+		return "", err
+	}
+	r.RemoteAddr = conn.RemoteAddr().String()
+	for i := 0; i < len(headers); i += 2 {
+		r.Header.Add(string(headers[i]), string(headers[i+1]))
+	}
+	return s.auth.Authenticate(r)
+}
+
+// checks and runs one request, returning the response status and body
+func (s *Server) wireRequest(ctx context.Context, principal string, client string, op byte, body []byte) (byte, []byte) {
+	opName, ok := wireOpNames[op]
+	if !ok {
+		return WIRE_ERR, []byte(fmt.Sprintf("Unknown op %d", op))
+	}
+	keyVals, err := ops.DecodeCols(body)
+	if err != nil {
+		return WIRE_ERR, []byte(err.Error())
+	}
+	// the web API can't take empty names or keys either
+	if len(keyVals) < 2 || len(keyVals[0]) == 0 || len(keyVals[1]) == 0 {
+		return WIRE_ERR, []byte("Requests start with a table name and row key, neither can be empty")
+	}
+	table, rowKey, cols := keyVals[0], keyVals[1], keyVals[2:]
+	need := ops.PERM_WRITE
+	if op == WIRE_GETCOLS || op == WIRE_GETROW {
+		need = ops.PERM_READ
+	}
+	tables := []string{string(table)}
+	if s.acls {
+		err = s.allowed(principal, need, tables)
+		if err != nil {
+			return WIRE_DENIED, []byte(err.Error())
+		}
+	}
+	if s.limiter != nil {
+		ok, wait := s.limiter.take(rateLimitKeys(client, tables, need > ops.PERM_READ), time.Now())
+		if !ok {
+			return WIRE_RETRY, []byte(fmt.Sprintf("Rate limit exceeded, retry after %s", wait))
+		}
+	}
+
+	// args for flotilla are rowKey, tableName and then the columns, values, names or families
+	flotillaArgs := [][]byte{rowKey, table}
+	switch op {
+	case WIRE_PUTCOLS, WIRE_PUTROW:
+		flotillaArgs = append(flotillaArgs, cols...)
+		// stamp the write here so every replica applies the same family TTLs
+		flotillaArgs = append(flotillaArgs, ops.Timestamp(time.Now()))
+	case WIRE_GETCOLS, WIRE_GETROW:
+		for i := 0; i < len(cols); i += 2 {
+			flotillaArgs = append(flotillaArgs, cols[i])
+		}
+	}
+	var result flotilla.Result
+	if op == WIRE_PUTCOLS {
+		result = s.putCols(ctx, flotillaArgs)
+	} else {
+		result = s.command(ctx, opName, flotillaArgs)
+	}
+	if result.Err == ErrOverloaded || result.Err == ErrCommandTimeout {
+		return WIRE_RETRY, []byte(result.Err.Error())
+	}
+	if result.Err != nil {
+		return WIRE_ERR, []byte(result.Err.Error())
+	}
+	if need == ops.PERM_READ {
+		return WIRE_OK, result.Response
+	}
+	return WIRE_OK, nil
+}
+
+func (s *Server) observeWire(op byte, status byte, start time.Time) {
+	opName, ok := wireOpNames[op]
+	if !ok {
+		opName = strconv.Itoa(int(op))
+	}
+	statusName := strconv.Itoa(int(status))
+	if int(status) < len(wireStatusNames) {
+		statusName = wireStatusNames[status]
+	}
+	s.metrics.wireRequests.Inc(opName, statusName)
+	s.metrics.wireLatency.Observe(time.Since(start).Seconds(), opName)
+}
@@ -0,0 +1,155 @@
+package merchdb
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func newWireTestServer(t *testing.T, cfg config) (*Server, *WireClient) {
+	db := newLocalDB(t, "/tmp/merchdbWireTest/"+t.Name())
+	s := &Server{
+		flotilla:     db,
+		lg:           defaultLogger(),
+		metrics:      newServerMetrics(),
+		tracing:      newServerTracer(nil),
+		closed:       make(chan struct{}),
+		closeOnce:    &sync.Once{},
+		maxBodyBytes: 1024,
+		config:       cfg,
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.serveWire(l)
+	c, err := DialWire(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+		s.markClosed()
+		s.closeWire()
+		db.Close()
+	})
+	return s, c
+}
+
+func TestWireProtocol(t *testing.T) {
+	_, c := newWireTestServer(t, config{})
+
+	// pipeline a bunch of writes on the one connection before waiting on any
+	results := make([]<-chan WireResult, 0)
+	for i := 0; i < 50; i++ {
+		row := []byte{byte('a' + i%5)}
+		results = append(results, c.Send(WIRE_PUTCOLS, "t", row, [][]byte{[]byte("col"), row, []byte("n"), {byte(i)}}))
+	}
+	for _, result := range results {
+		if err := (<-result).Err; err != nil {
+			t.Fatal(err)
+		}
+	}
+	cols, err := c.GetCols("t", []byte("c"), [][]byte{[]byte("col"), []byte("missing")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cols) != 2 || string(cols[0]) != "col" || string(cols[1]) != "c" {
+		t.Fatalf("Unexpected cols %q", cols)
+	}
+
+	err = c.DelRow("t", []byte("c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the op rejects reserved tables
+	err = c.DelRow("_t", []byte("c"))
+	if werr, ok := err.(*WireError); !ok || werr.Status != WIRE_ERR {
+		t.Fatalf("Expected an error from the server, got %v", err)
+	}
+	err = c.PutCols("", []byte("c"), nil)
+	if err == nil {
+		t.Fatal("Expected an error for a request without a table")
+	}
+	err = c.PutCols("t", []byte{}, [][]byte{[]byte("col"), []byte("v")})
+	if err == nil {
+		t.Fatal("Expected an error for an empty row key")
+	}
+	// too large to read, but the connection carries on
+	err = c.PutCols("t", []byte("c"), [][]byte{[]byte("big"), make([]byte, 2048)})
+	if err == nil {
+		t.Fatal("Expected an error for an oversized frame")
+	}
+	err = c.PutCols("t", []byte("c"), [][]byte{[]byte("small"), []byte("v")})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWireAuth(t *testing.T) {
+	_, c := newWireTestServer(t, config{auth: TokenAuth{"secret": "alice"}, acls: true, admins: map[string]bool{"alice": true}})
+	err := c.PutCols("t", []byte("r"), [][]byte{[]byte("c"), []byte("v")})
+	if werr, ok := err.(*WireError); !ok || werr.Status != WIRE_DENIED {
+		t.Fatalf("Expected unauthenticated request to be denied, got %v", err)
+	}
+	err = c.Authenticate(http.Header{"Authorization": {"Bearer wrong"}})
+	if err == nil {
+		t.Fatal("Expected a bad token to be rejected")
+	}
+	err = c.Authenticate(http.Header{"Authorization": {"Bearer secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.PutCols("t", []byte("r"), [][]byte{[]byte("c"), []byte("v")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := c.GetCols("t", []byte("r"), [][]byte{[]byte("c")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cols) != 2 || string(cols[1]) != "v" {
+		t.Fatalf("Expected write to be applied, got %q", cols)
+	}
+}
+
+func TestFrames(t *testing.T) {
+	buf := &bytes.Buffer{}
+	for i := uint64(0); i < 3; i++ {
+		err := writeFrame(buf, i, byte(i), bytes.Repeat([]byte{'x'}, int(i)*10))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := bufio.NewReader(buf)
+	for i := uint64(0); i < 3; i++ {
+		id, code, body, err := readFrame(r, 15)
+		if i == 2 {
+			if _, ok := err.(*frameTooLarge); !ok || id != 2 {
+				t.Fatalf("Expected frame 2 to be too large, got %v", err)
+			}
+			continue
+		}
+		if err != nil || id != i || code != byte(i) || len(body) != int(i)*10 {
+			t.Fatalf("Bad frame %d : id %d code %d len %d err %v", i, id, code, len(body), err)
+		}
+	}
+	// even without a limit frames are capped
+	defer func(max int64) { maxWireFrameBytes = max }(maxWireFrameBytes)
+	maxWireFrameBytes = 15
+	writeFrame(buf, 5, 1, bytes.Repeat([]byte{'x'}, 20))
+	_, _, _, err := readFrame(bufio.NewReader(buf), 0)
+	if _, ok := err.(*frameTooLarge); !ok {
+		t.Fatalf("Expected a frame over the cap to be too large, got %v", err)
+	}
+	// truncated
+	writeFrame(buf, 7, 1, []byte("abc"))
+	buf.Truncate(buf.Len() - 1)
+	_, _, _, err = readFrame(bufio.NewReader(buf), 0)
+	if err == nil {
+		t.Fatal("Expected an error for a truncated frame")
+	}
+}
@@ -0,0 +1,215 @@
+package merchdb
+
+import (
+	"bufio"
+	"fmt"
+	ops "github.com/jbooth/merchdb/ops"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// WireError is a response from the server with a status other than WIRE_OK
+type WireError struct {
+	Status byte
+	Msg    string
+}
+
+func (e *WireError) Error() string {
+	return e.Msg
+}
+
+// whether the request was turned away by load shedding or rate limits, and can be retried later
+func (e *WireError) Retryable() bool {
+	return e.Status == WIRE_RETRY
+}
+
+// WireResult is the outcome of a request sent with WireClient.Send.  Cols are
+// alternating column keys and values, for reads.
+type WireResult struct {
+	Cols [][]byte
+	Err  error
+}
+
+// WireClient talks the wire protocol over a single connection.  It's safe for
+// concurrent use, and requests from any number of goroutines are pipelined.
+type WireClient struct {
+	conn      net.Conn
+	writeLock *sync.Mutex
+	lock      *sync.Mutex
+	nextID    uint64
+	pending   map[uint64]chan WireResult
+	// set once the connection fails, every request after fails with it
+	err error
+}
+
+// DialWire connects to a server's WireAddr, a host:port or unix socket path
+// with the unix: prefix.  Use NewWireClient to connect over TLS.
+func DialWire(addr string) (*WireClient, error) {
+	network := "tcp"
+	if isUnixAddr(addr) {
+		network, addr = "unix", strings.TrimPrefix(addr, unixAddrPrefix)
+	}
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewWireClient(conn), nil
+}
+
+// NewWireClient speaks the wire protocol over conn, which it closes when it's closed
+func NewWireClient(conn net.Conn) *WireClient {
+	c := &WireClient{
+		conn:      conn,
+		writeLock: &sync.Mutex{},
+		lock:      &sync.Mutex{},
+		pending:   make(map[uint64]chan WireResult),
+	}
+	go c.readResponses()
+	return c
+}
+
+func (c *WireClient) Close() error {
+	return c.conn.Close()
+}
+
+// hands each response to the request waiting on it, until the connection fails
+func (c *WireClient) readResponses() {
+	r := bufio.NewReader(c.conn)
+	for {
+		id, status, body, err := readFrame(r, 0)
+		if tooLarge, ok := err.(*frameTooLarge); ok {
+			// skipped, so only its request fails
+			id, status, body = tooLarge.id, WIRE_ERR, []byte(err.Error())
+		} else if err != nil {
+			c.fail(fmt.Errorf("Wire connection to %s failed : %s", c.conn.RemoteAddr(), err))
+			return
+		}
+		c.lock.Lock()
+		result, ok := c.pending[id]
+		delete(c.pending, id)
+		c.lock.Unlock()
+		if !ok {
+			continue
+		}
+		if status != WIRE_OK {
+			result <- WireResult{nil, &WireError{status, string(body)}}
+			continue
+		}
+		cols, err := ops.DecodeCols(body)
+		result <- WireResult{cols, err}
+	}
+}
+
+// fails every request waiting and any sent later
+func (c *WireClient) fail(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+	for id, result := range c.pending {
+		result <- WireResult{nil, c.err}
+		delete(c.pending, id)
+	}
+	c.conn.Close()
+}
+
+// Send sends a request without waiting for its response, which arrives on the
+// returned channel.  keyVals are alternating keys and values, as described for
+// the op, after the table and row key.
+func (c *WireClient) Send(op byte, table string, rowKey []byte, keyVals [][]byte) <-chan WireResult {
+	body, err := ops.EncodeCols(append([][]byte{[]byte(table), rowKey}, keyVals...), true)
+	if err != nil {
+		result := make(chan WireResult, 1)
+		result <- WireResult{nil, err}
+		return result
+	}
+	return c.send(op, body)
+}
+
+// frames body under the next request id
+func (c *WireClient) send(op byte, body []byte) <-chan WireResult {
+	result := make(chan WireResult, 1)
+	c.lock.Lock()
+	if c.err != nil {
+		result <- WireResult{nil, c.err}
+		c.lock.Unlock()
+		return result
+	}
+	id := c.nextID
+	c.nextID++
+	c.pending[id] = result
+	c.lock.Unlock()
+
+	c.writeLock.Lock()
+	err := writeFrame(c.conn, id, op, body)
+	c.writeLock.Unlock()
+	if err != nil {
+		c.fail(err)
+	}
+	return result
+}
+
+// sends a request and waits for its response
+func (c *WireClient) do(op byte, table string, rowKey []byte, keyVals [][]byte) ([][]byte, error) {
+	result := <-c.Send(op, table, rowKey, keyVals)
+	return result.Cols, result.Err
+}
+
+// pairs each name with an empty value
+func namesOnly(names [][]byte) [][]byte {
+	ret := make([][]byte, 0, 2*len(names))
+	for _, n := range names {
+		ret = append(ret, n, nil)
+	}
+	return ret
+}
+
+// Authenticate checks the connection's credentials with the server's
+// Authenticator, which sees them as headers on a GET to /wire with an empty
+// body.  For TokenAuth that's an Authorization header with the bearer token.
+// Requests sent after this run as the authenticated principal.
+func (c *WireClient) Authenticate(header http.Header) error {
+	headers := make([][]byte, 0)
+	for k, vals := range header {
+		for _, v := range vals {
+			headers = append(headers, []byte(k), []byte(v))
+		}
+	}
+	body, err := ops.EncodeCols(headers, true)
+	if err != nil {
+		return err
+	}
+	// auth has no table or row, so it's framed directly
+	return (<-c.send(WIRE_AUTH, body)).Err
+}
+
+// keyVals are alternating column keys and values
+func (c *WireClient) PutCols(table string, rowKey []byte, keyVals [][]byte) error {
+	_, err := c.do(WIRE_PUTCOLS, table, rowKey, keyVals)
+	return err
+}
+
+// replaces the whole row with keyVals
+func (c *WireClient) PutRow(table string, rowKey []byte, keyVals [][]byte) error {
+	_, err := c.do(WIRE_PUTROW, table, rowKey, keyVals)
+	return err
+}
+
+// returns alternating keys and values of the named columns that are present
+func (c *WireClient) GetCols(table string, rowKey []byte, cols [][]byte) ([][]byte, error) {
+	return c.do(WIRE_GETCOLS, table, rowKey, namesOnly(cols))
+}
+
+// returns alternating keys and values of the whole row, or only the columns in
+// families if there are any
+func (c *WireClient) GetRow(table string, rowKey []byte, families [][]byte) ([][]byte, error) {
+	return c.do(WIRE_GETROW, table, rowKey, namesOnly(families))
+}
+
+func (c *WireClient) DelRow(table string, rowKey []byte) error {
+	_, err := c.do(WIRE_DELROW, table, rowKey, nil)
+	return err
+}